@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// RateLimitSettings is the body of the /admin/ratelimit endpoint
+type RateLimitSettings struct {
+	MaxPerSec int `json:"max_per_sec"`
+	Burst     int `json:"burst,omitempty"`
+}
+
+// rateLimitStatus is the response of the /admin/ratelimit endpoint
+type rateLimitStatus struct {
+	RateLimitSettings
+	RateLimiterStats
+}
+
+// requireAdmin only lets requests carrying the configured admin bearer token through
+func requireAdmin(cfg *Config, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+			writeError(w, "admin_auth_required", "Admin authentication required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// GetRateLimitAdminHandler creates an HTTP handler to read and update the rate limiter settings. A limiter
+// that can't be administered, like the one used when rate limiting is disabled, gets a 409.
+func GetRateLimitAdminHandler(rateLimiter Limiter) http.HandlerFunc {
+	admin, enabled := rateLimiter.(LimiterAdmin)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPut {
+			writeMethodNotAllowed(w, http.MethodGet, http.MethodPut)
+			return
+		}
+		if !enabled {
+			writeError(w, "rate_limit_disabled", "Rate limiting is disabled, set RATE_LIMIT_ENABLED=true to manage it")
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			var settings RateLimitSettings
+			if err := decodeJSONObject(r.Body, &settings); err != nil {
+				writeBodyError(w, err)
+				return
+			}
+			// A max_per_sec of 0 disables the limiter
+			if settings.MaxPerSec == 0 || settings.Burst == 0 {
+				settings.Burst = settings.MaxPerSec * 2
+			}
+			if settings.MaxPerSec < 0 || (settings.MaxPerSec > 0 && settings.Burst < 1) {
+				writeError(w, "invalid_rate_limit", "max_per_sec can't be negative and burst must be positive")
+				return
+			}
+			admin.SetLimits(settings.MaxPerSec, settings.Burst)
+			requestLogger(r.Context()).Info("Rate limit updated", "max_per_sec", settings.MaxPerSec, "burst", settings.Burst)
+		}
+
+		maxPerSec, burst := admin.Limits()
+		writeJSON(w, http.StatusOK, rateLimitStatus{
+			RateLimitSettings: RateLimitSettings{MaxPerSec: maxPerSec, Burst: burst},
+			RateLimiterStats:  admin.Stats(),
+		})
+	}
+}
+
+// principalLimits is the response of the /admin/principal/{name}/limits endpoint
+type principalLimits struct {
+	Principal       string        `json:"principal"`
+	Configured      bool          `json:"configured"`
+	MaxPerSec       int           `json:"max_per_sec"`
+	Burst           int           `json:"burst"`
+	WindowLimit     *WindowLimit  `json:"window_limit"`
+	SendWindows     []*SendWindow `json:"send_windows"`
+	SharedMailboxes []string      `json:"shared_mailboxes"`
+	HTMLPolicy      string        `json:"html_policy"`
+
+	MaxAttachmentBytes int `json:"max_attachment_bytes"`
+	MaxAttachments     int `json:"max_attachments"`
+}
+
+// GetPrincipalLimitsHandler creates an HTTP handler reporting the limits that apply to a principal
+// after its overrides from PRINCIPALS_FILE
+func GetPrincipalLimitsHandler(rateLimiter Limiter, cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+
+		name := r.PathValue("name")
+		principal := cfg.principal(name)
+		_, configured := cfg.Principals[name]
+		maxPerSec, burst := userLimits(rateLimiter, name)
+
+		limits := principalLimits{
+			Principal:       name,
+			Configured:      configured,
+			MaxPerSec:       maxPerSec,
+			Burst:           burst,
+			WindowLimit:     cfg.windowLimit(name),
+			SendWindows:     principal.SendWindows,
+			SharedMailboxes: append(append([]string{}, cfg.SharedMailboxes...), principal.SharedMailboxes...),
+			HTMLPolicy:      principal.HTMLPolicy,
+
+			MaxAttachmentBytes: cfg.maxAttachmentBytes(name),
+			MaxAttachments:     cfg.maxAttachments(name),
+		}
+		if limits.SendWindows == nil {
+			limits.SendWindows = []*SendWindow{}
+		}
+		if limits.HTMLPolicy == "" {
+			limits.HTMLPolicy = "default"
+		}
+		writeJSON(w, http.StatusOK, limits)
+	}
+}
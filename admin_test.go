@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// With rate limiting disabled there is nothing to manage, reads and updates are refused
+func TestRateLimitAdminHandlerDisabled(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantStatus int
+	}{
+		{"get", http.MethodGet, "", errorStatus("rate_limit_disabled")},
+		{"put", http.MethodPut, `{"max_per_sec": 1}`, errorStatus("rate_limit_disabled")},
+		{"post", http.MethodPost, "", errorStatus("method_not_allowed")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			GetRateLimitAdminHandler(noopLimiter{})(rec, httptest.NewRequest(tt.method, "/admin/ratelimit", strings.NewReader(tt.body)))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRateLimitAdminHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		body       string
+		wantStatus int
+		// wantAllowed is the number of sends a fresh user gets right after the update, -1 for unlimited
+		wantAllowed int
+	}{
+		{"lower rate", "token", `{"max_per_sec": 1, "burst": 3}`, http.StatusOK, 3},
+		{"default burst", "token", `{"max_per_sec": 2}`, http.StatusOK, 4},
+		{"disabled", "token", `{"max_per_sec": 0}`, http.StatusOK, -1},
+		{"negative rate", "token", `{"max_per_sec": -1}`, errorStatus("invalid_rate_limit"), 20},
+		{"wrong token", "guessed", `{"max_per_sec": 1, "burst": 1}`, errorStatus("admin_auth_required"), 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rateLimiter := newTestRateLimiter(t, 10, nil)
+			// A user seen before the update keeps no more tokens than the new burst
+			rateLimiter.Allow("seen@example.com")
+			handler := requireAdmin(&Config{AdminToken: "token"}, GetRateLimitAdminHandler(rateLimiter))
+
+			req := httptest.NewRequest(http.MethodPut, "/admin/ratelimit", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+
+			for _, user := range []string{"new@example.com", "seen@example.com"} {
+				allowed := 0
+				for allowed < 100 && rateLimiter.Allow(user) {
+					allowed++
+				}
+				want := tt.wantAllowed
+				if want == -1 {
+					want = 100
+				} else if user == "seen@example.com" && tt.wantStatus != http.StatusOK {
+					want-- // the send before the update is still charged
+				}
+				if allowed != want {
+					t.Errorf("%s got %d sends after the update, want %d", user, allowed, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPrincipalLimitsHandler(t *testing.T) {
+	principals := filepath.Join(t.TempDir(), "principals.json")
+	if err := os.WriteFile(principals, []byte(`{"vip@example.com": {
+		"rate_limit": {"max_per_sec": 5, "burst": 10},
+		"shared_mailboxes": ["billing@example.com"],
+		"max_attachments": 2
+	}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := newTestConfig(t, nil, map[string]string{"PRINCIPALS_FILE": principals, "SHARED_MAILBOXES": "support@example.com", "MAX_ATTACHMENTS": "5"})
+	rateLimiter := newTestRateLimiter(t, 10, cfg.rateLimitOverrides())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/principal/{name}/limits", GetPrincipalLimitsHandler(rateLimiter, cfg))
+
+	tests := []struct {
+		name string
+		want principalLimits
+	}{
+		{"vip@example.com", principalLimits{Principal: "vip@example.com", Configured: true, MaxPerSec: 5, Burst: 10,
+			SharedMailboxes: []string{"support@example.com", "billing@example.com"}, HTMLPolicy: "default", MaxAttachments: 2}},
+		{"other@example.com", principalLimits{Principal: "other@example.com", MaxPerSec: 10, Burst: 20,
+			SharedMailboxes: []string{"support@example.com"}, HTMLPolicy: "default", MaxAttachments: 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/principal/"+tt.name+"/limits", nil))
+			var got principalLimits
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Principal != tt.want.Principal || got.Configured != tt.want.Configured || got.MaxPerSec != tt.want.MaxPerSec ||
+				got.Burst != tt.want.Burst || got.HTMLPolicy != tt.want.HTMLPolicy || got.MaxAttachments != tt.want.MaxAttachments ||
+				strings.Join(got.SharedMailboxes, ",") != strings.Join(tt.want.SharedMailboxes, ",") || got.SendWindows == nil {
+				t.Errorf("got %s, want %+v", rec.Body, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/base64"
+	"mime"
+	"path"
+	"strings"
+)
+
+// Attachment is a file sent along with the message
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type,omitempty"` // application/octet-stream when empty
+	Data        string `json:"data"`                   // base64 encoded file content
+}
+
+// defaultBlockedExtensions are executable and script types mail clients may run when opened
+var defaultBlockedExtensions = []string{
+	"bat", "cmd", "com", "cpl", "dll", "exe", "hta", "jar", "js", "jse", "lnk", "msi", "msp",
+	"pif", "ps1", "reg", "scr", "vbe", "vbs", "wsf", "wsh",
+}
+
+// blockedExtension returns the extension of the filename when it is in the blocklist, trailing dots and
+// spaces are ignored as Windows does
+func blockedExtension(filename string, blocked map[string]bool) (string, bool) {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(strings.TrimRight(filename, ". ")), "."))
+	return ext, ext != "" && blocked[ext]
+}
+
+// validateAttachments checks the attachments have a filename, a valid content type and base64 data
+func validateAttachments(attachments []Attachment) []FieldError {
+	for _, attachment := range attachments {
+		if strings.TrimSpace(attachment.Filename) == "" {
+			return []FieldError{{"attachments", "required", "Every attachment needs a filename"}}
+		}
+		if sanitizeHeaderValue(attachment.Filename) != nil || sanitizeHeaderValue(attachment.ContentType) != nil {
+			return []FieldError{{"attachments", "invalid_header_value", "Attachment filenames and content types " + errHeaderInjection.Error()}}
+		}
+		if attachment.ContentType != "" {
+			if _, _, err := mime.ParseMediaType(attachment.ContentType); err != nil {
+				return []FieldError{{"attachments", "invalid", "Invalid content type " + attachment.ContentType}}
+			}
+		}
+		if attachment.Data == "" {
+			return []FieldError{{"attachments", "required", "Attachment " + attachment.Filename + " has no data"}}
+		}
+	}
+	return nil
+}
+
+// decode returns the attachment as a base64 encoded MIME part, and its decoded size
+func (a *Attachment) decode() (*message, int, error) {
+	data, err := base64.StdEncoding.DecodeString(a.Data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	mediaType, params := "application/octet-stream", map[string]string{}
+	if a.ContentType != "" {
+		mediaType, params, _ = mime.ParseMediaType(a.ContentType)
+	}
+	params["name"] = a.Filename
+
+	part := &message{body: wrapBase64(data)}
+	part.addHeader("Content-Type", mime.FormatMediaType(mediaType, params))
+	part.addHeader("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename}))
+	part.addHeader("Content-Transfer-Encoding", "base64")
+	return part, len(data), nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestAttachmentDecode(t *testing.T) {
+	tests := []struct {
+		name            string
+		attachment      Attachment
+		wantContentType string
+		wantSize        int
+		wantErr         bool
+	}{
+		{"default content type", Attachment{Filename: "a.bin", Data: "AAEC"}, "application/octet-stream; name=a.bin", 3, false},
+		{"given content type", Attachment{Filename: "report.pdf", ContentType: "application/pdf", Data: "JVBERg=="}, "application/pdf; name=report.pdf", 4, false},
+		{"content type parameters kept", Attachment{Filename: "a.txt", ContentType: "text/plain; charset=utf-8", Data: "aGk="}, "text/plain; charset=utf-8; name=a.txt", 2, false},
+		{"filename quoted", Attachment{Filename: "my report.pdf", Data: "JVBERg=="}, `application/octet-stream; name="my report.pdf"`, 4, false},
+		{"invalid base64", Attachment{Filename: "a.bin", Data: "not base64!"}, "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			part, size, err := tt.attachment.decode()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decode() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if size != tt.wantSize {
+				t.Errorf("size = %d, want %d", size, tt.wantSize)
+			}
+			headers := messageHeaders(part.bytes())
+			if !strings.Contains(headers, "Content-Type: "+tt.wantContentType+"\r\n") {
+				t.Errorf("Content-Type %s missing from headers:\n%s", tt.wantContentType, headers)
+			}
+			_, filename, _ := strings.Cut(tt.wantContentType, "name=")
+			if !strings.Contains(headers, "Content-Disposition: attachment; filename="+filename+"\r\n") {
+				t.Errorf("Content-Disposition missing from headers:\n%s", headers)
+			}
+		})
+	}
+}
+
+func TestAttachmentDecodeWrapsLines(t *testing.T) {
+	data := bytes.Repeat([]byte{0xff}, 1000)
+	attachment := Attachment{Filename: "a.bin", Data: base64.StdEncoding.EncodeToString(data)}
+	part, _, err := attachment.decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(part.body, "\r\n") {
+		if len(line) > 76 {
+			t.Fatalf("line of %d characters, base64 lines are at most 76", len(line))
+		}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(part.body, "\r\n", ""))
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Errorf("wrapped body doesn't decode back to the attachment: %v", err)
+	}
+}
+
+func TestValidateAttachments(t *testing.T) {
+	tests := []struct {
+		name       string
+		attachment Attachment
+		wantCode   string
+	}{
+		{"valid", Attachment{Filename: "a.txt", ContentType: "text/plain", Data: "aGk="}, ""},
+		{"no filename", Attachment{Filename: " ", Data: "aGk="}, "required"},
+		{"no data", Attachment{Filename: "a.txt"}, "required"},
+		{"filename with CRLF", Attachment{Filename: "a.txt\r\nBcc: victim@example.com", Data: "aGk="}, "invalid_header_value"},
+		{"invalid content type", Attachment{Filename: "a.txt", ContentType: "text/", Data: "aGk="}, "invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validateAttachments([]Attachment{tt.attachment})
+			code := ""
+			if len(errs) > 0 {
+				code = errs[0].Code
+			}
+			if code != tt.wantCode {
+				t.Errorf("validateAttachments() = %+v, want code %q", errs, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestBlockedExtension(t *testing.T) {
+	blocked := map[string]bool{}
+	for _, ext := range defaultBlockedExtensions {
+		blocked[ext] = true
+	}
+	tests := []struct {
+		filename string
+		want     bool
+	}{
+		{"report.pdf", false},
+		{"setup.exe", true},
+		{"SETUP.EXE", true},
+		{"invoice.pdf.exe", true},
+		{"script.js.", true},
+		{"script.js . ", true},
+		{"archive.tar.gz", false},
+		{"exe", false},
+		{"noextension", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			if _, got := blockedExtension(tt.filename, blocked); got != tt.want {
+				t.Errorf("blockedExtension(%q) = %v, want %v", tt.filename, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errExpectedArray is returned for batch request bodies that hold valid JSON but not an array
+var errExpectedArray = errors.New("the request body must be a JSON array")
+
+// batchMailer sends several messages of one user over a single session
+type batchMailer interface {
+	SendBatch(ctx context.Context, username, password string, items []*batchItem) error
+}
+
+// batchResult is the outcome of one message of a batch, by its position in the request
+type batchResult struct {
+	Index        int      `json:"index"`
+	Status       string   `json:"status"` // sent, failed, rejected or skipped
+	MessageID    string   `json:"message_id,omitempty"`
+	SMTPResponse string   `json:"smtp_response,omitempty"`
+	Code         string   `json:"code,omitempty"`
+	Error        string   `json:"error,omitempty"`
+	Warnings     []string `json:"warnings,omitempty"`
+
+	// RetryAfterSeconds tells when a skipped message can be sent again in a new request
+	RetryAfterSeconds int `json:"retry_after_seconds,omitempty"`
+}
+
+// itemWriter records the error response prepareMessage writes for a message of a batch
+type itemWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *itemWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *itemWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *itemWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// error returns the code and message of the recorded error response
+func (w *itemWriter) error() (string, string) {
+	var response struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal(w.body.Bytes(), &response)
+	return response.Code, response.Message
+}
+
+// sendErrorCode returns the registered code of a failed send
+func sendErrorCode(err error) string {
+	switch {
+	case errors.Is(err, errSMTPUTF8Unsupported):
+		return "smtputf8_unsupported"
+	case errors.Is(err, err8BitMIMEUnsupported):
+		return "8bitmime_unsupported"
+	case errors.Is(err, errSMTPTimeout):
+		return "smtp_timeout"
+	default:
+		return "send_failed"
+	}
+}
+
+// decodeJSONArray decodes a request body that must hold a JSON array into its raw elements
+func decodeJSONArray(body *bytes.Reader) ([]json.RawMessage, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimLeft(raw, " \t\r\n"); len(trimmed) == 0 || trimmed[0] != '[' {
+		return nil, errExpectedArray
+	}
+	var elements []json.RawMessage
+	return elements, json.Unmarshal(raw, &elements)
+}
+
+// GetBatchHandler creates an HTTP handler sending several distinct messages of a user over one SMTP session
+func GetBatchHandler(rateLimiter Limiter, windowLimiter *SlidingWindowLimiter, mailer batchMailer, cfg *Config, usage UsageRecorder, hooks Hooks) http.HandlerFunc {
+	var idempotency *replayCache
+	if cfg.IdempotencyKeyTTL > 0 {
+		idempotency = newReplayCache(cfg.IdempotencyKeyTTL)
+	}
+	// The Message-IDs of the emails of batches are remembered like those of /mail/send, with the result of the email
+	var dedupe *replayCache
+	if cfg.MessageIDDedupeTTL > 0 {
+		dedupe = newReplayCache(cfg.MessageIDDedupeTTL)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		if !limitRequestBody(w, r, cfg.requestBytesLimit()) {
+			return
+		}
+
+		username, password, authErr := parseBasicAuth(r.Header.Get("Authorization"), cfg.MaxCredentialsBytes)
+		if authErr != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mail-api"`)
+			writeError(w, authErr.code, authErr.message)
+			return
+		}
+		if !cfg.SMTPAuth && !cfg.principal(username).CheckAPIPassword(password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mail-api"`)
+			writeError(w, "auth_invalid", "Invalid username or password")
+			return
+		}
+		w, finish, ok := reserveIdempotencyKey(w, r, idempotency, username, password)
+		if !ok {
+			return
+		}
+		defer finish()
+		if !cfg.principal(username).CanSendAt(time.Now()) {
+			writeError(w, "outside_send_window", "Sending is not allowed at this time")
+			return
+		}
+
+		// The array is read whole, every message is then decoded on its own so one bad entry only fails itself
+		var body bytes.Buffer
+		if _, err := body.ReadFrom(newAttachmentLimitReader(r.Body, cfg.MaxRequestBytes, 2)); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		elements, err := decodeJSONArray(bytes.NewReader(body.Bytes()))
+		if errors.Is(err, errExpectedArray) {
+			writeError(w, "expected_array", "The request body must be a JSON array of emails")
+			return
+		}
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if len(elements) == 0 {
+			writeError(w, "invalid_batch", "A batch must hold at least 1 email")
+			return
+		}
+		// A MAX_BATCH_SIZE of 0 doesn't limit the size
+		if cfg.MaxBatchSize > 0 && len(elements) > cfg.MaxBatchSize {
+			writeError(w, "invalid_batch", fmt.Sprintf("A batch must hold between 1 and %d emails", cfg.MaxBatchSize))
+			return
+		}
+
+		// Check and assemble every message first, the rate limit is charged per message and running out
+		// of tokens skips the rest of the batch
+		results := make([]batchResult, len(elements))
+		var items []*batchItem
+		var prepared []*preparedMessage
+		var positions []int
+		var retryAfter time.Duration
+
+		// The Message-IDs reserved by the emails, the result of a sent email is stored once the response is
+		// written and the others are released for a retry
+		dedupeKeys := make([]string, len(elements))
+		defer func() {
+			for i, key := range dedupeKeys {
+				if key == "" {
+					continue
+				}
+				rec := &capturingWriter{ResponseWriter: &itemWriter{}}
+				if results[i].Status == "sent" {
+					writeJSON(rec, http.StatusOK, results[i])
+				}
+				dedupe.finish(key, rec)
+			}
+		}()
+
+		for i, element := range elements {
+			results[i].Index = i
+			var emailReq EmailRequest
+			if err := decodeJSONObject(bytes.NewReader(element), &emailReq); err != nil {
+				results[i].Status, results[i].Code, results[i].Error = "rejected", "invalid_body", "The email must be a JSON object"
+				continue
+			}
+
+			// An email with the Message-ID of one already sent is skipped before it is charged, like on /mail/send
+			if clientID, ok := customHeader(emailReq.Headers, "Message-ID"); ok && dedupe != nil {
+				owner := credentialsHash(username, password)
+				key := string(owner[:]) + strings.ToLower(clientID)
+				state, cached := dedupe.reserve(key)
+				switch state {
+				case replayCached:
+					var original batchResult
+					json.Unmarshal(cached.body, &original)
+					results[i].Status, results[i].Code = "skipped", "duplicate_message"
+					results[i].Error = "A message with this Message-ID was already sent"
+					results[i].MessageID, results[i].SMTPResponse = original.MessageID, original.SMTPResponse
+					continue
+				case replayPending:
+					results[i].Status, results[i].Code = "skipped", "duplicate_in_progress"
+					results[i].Error = "A message with this Message-ID is already being sent"
+					continue
+				}
+				dedupeKeys[i] = key
+			}
+
+			if retryAfter > 0 {
+				results[i].Status, results[i].Code, results[i].Error = "skipped", "rate_limited", "Rate limit exceeded"
+				continue
+			}
+			if emailReq.PerRecipient {
+				results[i].Status, results[i].Code = "rejected", "batch_unsupported"
+				results[i].Error = "Emails with per_recipient can't be sent in a batch"
+				continue
+			}
+
+			rec := &itemWriter{}
+			p, ok := prepareMessage(rec, r, &emailReq, username, cfg, rateLimiter, hooks)
+			if !ok {
+				code, message := rec.error()
+				if code == "rate_limited" {
+					_, retryAfter = rateLimiter.Status(username)
+					retryAfter = max(retryAfter, time.Second)
+					results[i].Status, results[i].Code, results[i].Error = "skipped", code, message
+					continue
+				}
+				results[i].Status, results[i].Code, results[i].Error = "rejected", code, message
+				continue
+			}
+			// Only a valid email is charged a token and takes a window slot, the slot is given back when the email
+			// fails to send
+			if cfg.RateLimitCost == "request" && !rateLimiter.Allow(username) {
+				rateLimitedTotal.Add(1)
+				_, retryAfter = rateLimiter.Status(username)
+				retryAfter = max(retryAfter, time.Second)
+				results[i].Status, results[i].Code, results[i].Error = "skipped", "rate_limited", "Rate limit exceeded"
+				continue
+			}
+			if limit := cfg.windowLimit(username); limit != nil {
+				if ok, resetAfter := windowLimiter.Allow(username, limit); !ok {
+					rateLimitedTotal.Add(1)
+					retryAfter = max(resetAfter, time.Second)
+					results[i].Status, results[i].Code = "skipped", "window_limit_exceeded"
+					results[i].Error = fmt.Sprintf("At most %d messages can be sent per %s", limit.Max, limit.window)
+					continue
+				}
+			}
+			results[i].MessageID, results[i].Warnings = p.messageID, p.warnings
+			prepared = append(prepared, p)
+			positions = append(positions, i)
+			items = append(items, &batchItem{
+				from:            p.env.From,
+				to:              p.env.Recipients,
+				msg:             p.data,
+				require8BitMIME: strings.EqualFold(emailReq.Encoding, "8bit"),
+			})
+		}
+
+		// Hand every message to the mail server over one session
+		var sessionErr error
+		if len(items) > 0 {
+			sessionErr = mailer.SendBatch(r.Context(), username, password, items)
+		}
+		sent := 0
+		for j, item := range items {
+			result, p := &results[positions[j]], prepared[j]
+			// Messages the session didn't get to share its error
+			err := item.err
+			if !item.done {
+				err = sessionErr
+			}
+			if err != nil {
+				if cfg.windowLimit(username) != nil {
+					windowLimiter.Refund(username)
+				}
+				recordSendFailure(err, len(p.env.Recipients))
+				p.logger.Error("Failed to send email", "error", err)
+				hooks.runPostSend(r.Context(), p.env, SendResult{Err: err})
+				result.Status, result.Code, result.Error = "failed", sendErrorCode(err), err.Error()
+				continue
+			}
+
+			sent++
+			recordSend(len(p.env.Recipients))
+			hooks.runPostSend(r.Context(), p.env, SendResult{Response: item.response})
+			usage.Record(UsageRecord{
+				RequestID:  requestID(r.Context()),
+				Principal:  username,
+				Recipients: len(p.env.Recipients),
+				Bytes:      len(p.data),
+				Timestamp:  time.Now().UTC(),
+			})
+			p.logger.Info("Email sent in a batch", "sender", p.env.From, "index", positions[j], "html", p.isHTML)
+			result.Status, result.SMTPResponse = "sent", item.response
+		}
+
+		// Skipped messages carry their own retry hint. A batch that sent anything is a 207 so an Idempotency-Key
+		// keeps its response and a retry can't deliver the sent messages twice, only a batch that sent
+		// nothing because of the rate limit is a 429.
+		writeRateLimitHeaders(w, rateLimiter, username)
+		retryAfterSeconds := int(math.Ceil(retryAfter.Seconds()))
+		for i := range results {
+			if results[i].Status == "skipped" && (results[i].Code == "rate_limited" || results[i].Code == "window_limit_exceeded") {
+				results[i].RetryAfterSeconds = retryAfterSeconds
+			}
+		}
+		status, outcome, message := http.StatusOK, "success", "Every email was sent"
+		switch {
+		case retryAfter > 0 && sent == 0:
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+			status, outcome, message = http.StatusTooManyRequests, "rate_limited", "Rate limit exceeded, no email was sent"
+		case retryAfter > 0:
+			status, outcome, message = http.StatusMultiStatus, "partial", "Rate limit exceeded, some emails were skipped"
+		case sent < len(results):
+			status, outcome, message = http.StatusMultiStatus, "partial", "Some emails were not sent"
+		}
+		writeJSON(w, status, map[string]any{
+			"status":  outcome,
+			"message": message,
+			"sent":    sent,
+			"results": results,
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// batchResponse is the body of a /mail/send/batch response
+type batchResponse struct {
+	Status  string        `json:"status"`
+	Sent    int           `json:"sent"`
+	Results []batchResult `json:"results"`
+}
+
+// postBatch sends body to the batch handler with the test credentials and headers
+func postBatch(t *testing.T, handler http.HandlerFunc, body string, headers map[string]string) (*httptest.ResponseRecorder, batchResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/mail/send/batch", strings.NewReader(body))
+	req.SetBasicAuth("user@example.com", "secret")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	var response batchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response body %q: %v", rec.Body.String(), err)
+	}
+	return rec, response
+}
+
+func TestBatchHandler(t *testing.T) {
+	email := func(to, subject string) string {
+		return `{"to":["` + to + `"],"subject":"` + subject + `","content":"hello"}`
+	}
+	tests := []struct {
+		name        string
+		rate        int
+		body        string
+		wantCode    int
+		wantStatus  string
+		wantResults []string
+		wantSent    int
+	}{
+		{
+			name:        "every email sent",
+			rate:        10,
+			body:        "[" + email("a@example.com", "a") + "," + email("b@example.com", "b") + "]",
+			wantCode:    http.StatusOK,
+			wantStatus:  "success",
+			wantResults: []string{"sent", "sent"},
+			wantSent:    2,
+		},
+		{
+			name:        "refused recipient and invalid email",
+			rate:        10,
+			body:        "[" + email("a@example.com", "a") + "," + email("refused@example.com", "b") + "," + email("c@example.com", "") + "]",
+			wantCode:    http.StatusMultiStatus,
+			wantStatus:  "partial",
+			wantResults: []string{"sent", "failed", "rejected"},
+			wantSent:    1,
+		},
+		{
+			name:        "per_recipient unsupported",
+			rate:        10,
+			body:        `[{"to":["a@example.com"],"subject":"a","content":"hello","per_recipient":true}]`,
+			wantCode:    http.StatusMultiStatus,
+			wantStatus:  "partial",
+			wantResults: []string{"rejected"},
+			wantSent:    0,
+		},
+		{
+			name:        "rate limit skips the rest",
+			rate:        1,
+			body:        "[" + email("a@example.com", "a") + "," + email("b@example.com", "b") + "," + email("c@example.com", "c") + "]",
+			wantCode:    http.StatusMultiStatus,
+			wantStatus:  "partial",
+			wantResults: []string{"sent", "sent", "skipped"},
+			wantSent:    2,
+		},
+		{
+			name:        "invalid emails aren't charged",
+			rate:        1,
+			body:        "[" + email("a@example.com", "") + `,"not an object",` + email("b@example.com", "b") + "," + email("c@example.com", "c") + "," + email("d@example.com", "d") + "]",
+			wantCode:    http.StatusMultiStatus,
+			wantStatus:  "partial",
+			wantResults: []string{"rejected", "rejected", "sent", "sent", "skipped"},
+			wantSent:    2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t, "AUTH PLAIN")
+			server.rcptReplies["refused@example.com"] = "550 5.1.1 no such user"
+			cfg := newTestConfig(t, server, nil)
+			handler := GetBatchHandler(newTestRateLimiter(t, tt.rate, nil), NewSlidingWindowLimiter(), NewSMTPMailer(cfg), cfg, nopUsageRecorder{}, Hooks{})
+
+			rec, response := postBatch(t, handler, tt.body, nil)
+			if rec.Code != tt.wantCode || response.Status != tt.wantStatus {
+				t.Fatalf("got %d %q, want %d %q: %s", rec.Code, response.Status, tt.wantCode, tt.wantStatus, rec.Body)
+			}
+			if response.Sent != tt.wantSent {
+				t.Errorf("sent = %d, want %d", response.Sent, tt.wantSent)
+			}
+			if len(response.Results) != len(tt.wantResults) {
+				t.Fatalf("got %d results, want %d", len(response.Results), len(tt.wantResults))
+			}
+			for i, want := range tt.wantResults {
+				result := response.Results[i]
+				if result.Index != i || result.Status != want {
+					t.Errorf("result %d = index %d %q, want %q", i, result.Index, result.Status, want)
+				}
+				if want == "skipped" && result.RetryAfterSeconds < 1 {
+					t.Errorf("result %d has retry_after_seconds %d, want at least 1", i, result.RetryAfterSeconds)
+				}
+			}
+			if got := server.connections(); tt.wantSent > 0 && got != 1 {
+				t.Errorf("batch used %d SMTP sessions, want 1", got)
+			}
+		})
+	}
+}
+
+func TestBatchHandlerRateLimitedBeforeSending(t *testing.T) {
+	server := newFakeSMTP(t, "AUTH PLAIN")
+	cfg := newTestConfig(t, server, nil)
+	rateLimiter := newTestRateLimiter(t, 1, nil)
+	for rateLimiter.Allow("user@example.com") {
+	}
+	handler := GetBatchHandler(rateLimiter, NewSlidingWindowLimiter(), NewSMTPMailer(cfg), cfg, nopUsageRecorder{}, Hooks{})
+
+	rec, response := postBatch(t, handler, `[{"to":["a@example.com"],"subject":"a","content":"hello"}]`, nil)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("got %d with Retry-After %q, want 429 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if response.Sent != 0 || response.Results[0].Status != "skipped" {
+		t.Errorf("got sent = %d and status %q, want nothing sent", response.Sent, response.Results[0].Status)
+	}
+}
+
+// A retried batch with the same Idempotency-Key must never deliver the messages the first attempt sent
+func TestBatchHandlerIdempotencyKeyAfterRateLimit(t *testing.T) {
+	server := newFakeSMTP(t, "AUTH PLAIN")
+	cfg := newTestConfig(t, server, nil)
+	handler := GetBatchHandler(newTestRateLimiter(t, 1, nil), NewSlidingWindowLimiter(), NewSMTPMailer(cfg), cfg, nopUsageRecorder{}, Hooks{})
+
+	body := `[{"to":["a@example.com"],"subject":"a","content":"hello"},` +
+		`{"to":["b@example.com"],"subject":"b","content":"hello"},` +
+		`{"to":["c@example.com"],"subject":"c","content":"hello"}]`
+	headers := map[string]string{"Idempotency-Key": "batch-1"}
+	first, firstResponse := postBatch(t, handler, body, headers)
+	second, secondResponse := postBatch(t, handler, body, headers)
+
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry wasn't replayed, got %d %s", second.Code, second.Body)
+	}
+	if first.Code != second.Code || firstResponse.Sent != secondResponse.Sent {
+		t.Errorf("retry got %d sent=%d, want the original %d sent=%d", second.Code, secondResponse.Sent, first.Code, firstResponse.Sent)
+	}
+	if messages, _ := server.delivered(); len(messages) != firstResponse.Sent {
+		t.Errorf("server got %d messages, want %d", len(messages), firstResponse.Sent)
+	}
+}
+
+// Invalid and failed emails of a batch don't use up the sliding window
+func TestBatchHandlerWindowCountsSentOnly(t *testing.T) {
+	cfg := newTestConfig(t, nil, map[string]string{"RATE_WINDOW_MAX": "1", "RATE_WINDOW": "1h"})
+	mailer := &fakeMailer{}
+	handler := GetBatchHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), mailer, cfg, nopUsageRecorder{}, Hooks{})
+
+	tests := []struct {
+		name        string
+		body        string
+		wantResults []string
+	}{
+		{"invalid emails", `[{"to":["a@example.com"],"subject":"","content":"hello"}, "not an object",
+			{"to":["a@example.com"],"subject":"a","content":"hello"},
+			{"to":["b@example.com"],"subject":"b","content":"hello"}]`, []string{"rejected", "rejected", "sent", "skipped"}},
+		{"window full", `[{"to":["a@example.com"],"subject":"a","content":"hello"}]`, []string{"skipped"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, response := postBatch(t, handler, tt.body, nil)
+			var got []string
+			for _, result := range response.Results {
+				got = append(got, result.Status)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.wantResults, ",") {
+				t.Errorf("results = %v, want %v", got, tt.wantResults)
+			}
+		})
+	}
+}
+
+func TestBatchHandlerMessageIDDedupe(t *testing.T) {
+	email := func(subject, messageID string) string {
+		return `{"to":["to@example.com"],"subject":"` + subject + `","content":"hello","headers":{"Message-ID":"` + messageID + `"}}`
+	}
+	tests := []struct {
+		name string
+		rate int
+		env  map[string]string
+		// batches are sent in order, the results of the last one are checked
+		batches   []string
+		sendErr   error
+		wantCodes []string
+	}{
+		{"retry isn't charged to the rate limit", 1, nil,
+			[]string{"[" + email("a", "<a@example.com>") + "]",
+				"[" + email("a", "<a@example.com>") + "," + email("b", "<b@example.com>") + "," + email("c", "<c@example.com>") + "]"},
+			nil, []string{"duplicate_message", "", "rate_limited"}},
+		{"retry isn't charged to the sliding window", 10, map[string]string{"RATE_WINDOW_MAX": "2", "RATE_WINDOW": "1h"},
+			[]string{"[" + email("a", "<a@example.com>") + "]",
+				"[" + email("a", "<A@example.com>") + "," + email("b", "<b@example.com>") + "," + email("c", "<c@example.com>") + "]"},
+			nil, []string{"duplicate_message", "", "window_limit_exceeded"}},
+		{"same Message-ID twice in a batch", 10, nil,
+			[]string{"[" + email("a", "<a@example.com>") + "," + email("a", "<a@example.com>") + "]"},
+			nil, []string{"", "duplicate_in_progress"}},
+		{"failed email is sent again", 10, nil,
+			[]string{"[" + email("a", "<a@example.com>") + "]", "[" + email("a", "<a@example.com>") + "]"},
+			&textproto.Error{Code: 554, Msg: "5.7.1 rejected"}, []string{"send_failed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"MESSAGE_ID_DEDUPE_TTL": "1h"}
+			for key, value := range tt.env {
+				env[key] = value
+			}
+			cfg := newTestConfig(t, nil, env)
+			handler := GetBatchHandler(newTestRateLimiter(t, tt.rate, nil), NewSlidingWindowLimiter(), &fakeMailer{err: tt.sendErr}, cfg, nopUsageRecorder{}, Hooks{})
+
+			var response batchResponse
+			for _, body := range tt.batches {
+				_, response = postBatch(t, handler, body, nil)
+			}
+			var got []string
+			for _, result := range response.Results {
+				got = append(got, result.Code)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.wantCodes, ",") {
+				t.Errorf("codes = %q, want %q", got, tt.wantCodes)
+			}
+			if first := response.Results[0]; first.Code == "duplicate_message" && (first.MessageID != "<a@example.com>" || first.RetryAfterSeconds != 0) {
+				t.Errorf("duplicate result = %+v, want the original message_id without a retry hint", first)
+			}
+		})
+	}
+}
+
+func TestBatchHandlerSize(t *testing.T) {
+	email := `{"to":["a@example.com"],"subject":"a","content":"hello"}`
+	tests := []struct {
+		name        string
+		maxSize     string
+		body        string
+		wantCode    int
+		wantMessage string
+	}{
+		{"empty", "50", "[]", errorStatus("invalid_batch"), "A batch must hold at least 1 email"},
+		{"empty without a limit", "0", "[]", errorStatus("invalid_batch"), "A batch must hold at least 1 email"},
+		{"too large", "2", "[" + email + "," + email + "," + email + "]", errorStatus("invalid_batch"), "A batch must hold between 1 and 2 emails"},
+		{"no limit", "0", "[" + email + "," + email + "," + email + "]", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, map[string]string{"MAX_BATCH_SIZE": tt.maxSize})
+			handler := GetBatchHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), &fakeMailer{}, cfg, nopUsageRecorder{}, Hooks{})
+
+			req := httptest.NewRequest(http.MethodPost, "/mail/send/batch", strings.NewReader(tt.body))
+			req.SetBasicAuth("user@example.com", "secret")
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			var response struct {
+				Message string `json:"message"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &response)
+			if rec.Code != tt.wantCode || (tt.wantMessage != "" && response.Message != tt.wantMessage) {
+				t.Errorf("got %d %s, want %d %q", rec.Code, rec.Body, tt.wantCode, tt.wantMessage)
+			}
+		})
+	}
+}
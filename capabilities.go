@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// capabilities is the response of the /me/capabilities endpoint, the limits and features that apply
+// to the authenticated user so clients can configure themselves
+type capabilities struct {
+	Principal     string          `json:"principal"`
+	FromAddresses []string        `json:"from_addresses"`
+	RateLimit     rateLimitCaps   `json:"rate_limit"`
+	SendWindows   []*SendWindow   `json:"send_windows"`
+	HTMLPolicy    string          `json:"html_policy"`
+	Limits        map[string]int  `json:"limits"`
+	Features      map[string]bool `json:"features"`
+}
+
+// rateLimitCaps describes the rate limit of the user
+type rateLimitCaps struct {
+	MaxPerSec int    `json:"max_per_sec"`
+	Burst     int    `json:"burst"`
+	Cost      string `json:"cost"` // request or recipients
+}
+
+// credentialVerifier checks a username and password without sending anything
+type credentialVerifier interface {
+	Verify(ctx context.Context, username, password string) error
+}
+
+// GetCapabilitiesHandler creates an HTTP handler describing what the authenticated user can send
+func GetCapabilitiesHandler(rateLimiter Limiter, verifier credentialVerifier, cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+
+		username, password, authErr := parseBasicAuth(r.Header.Get("Authorization"), cfg.MaxCredentialsBytes)
+		if authErr != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mail-api"`)
+			writeError(w, authErr.code, authErr.message)
+			return
+		}
+		if err := verifier.Verify(r.Context(), username, password); errors.Is(err, errInvalidCredentials) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mail-api"`)
+			writeError(w, "auth_invalid", "Invalid username or password")
+			return
+		} else if err != nil {
+			requestLogger(r.Context()).Error("Failed to verify credentials", "username", username, "error", err)
+			writeError(w, "smtp_unavailable", "The mail server could not verify the credentials")
+			return
+		}
+
+		principal := cfg.principal(username)
+		maxPerSec, burst := userLimits(rateLimiter, username)
+		caps := capabilities{
+			Principal:     username,
+			FromAddresses: []string{},
+			RateLimit:     rateLimitCaps{MaxPerSec: maxPerSec, Burst: burst, Cost: cfg.RateLimitCost},
+			SendWindows:   principal.SendWindows,
+			HTMLPolicy:    principal.HTMLPolicy,
+			Limits: map[string]int{
+				"max_request_bytes":            int(cfg.MaxRequestBytes),
+				"max_attachment_request_bytes": int(cfg.requestBytesLimit()),
+				"max_message_bytes":            cfg.MaxMessageBytes,
+				"max_attachment_bytes":         cfg.maxAttachmentBytes(username),
+				"max_attachments":              cfg.maxAttachments(username),
+				"max_custom_headers":           cfg.MaxCustomHeaders,
+				"max_recipients":               cfg.MaxRecipients,
+				"max_recipient_header_bytes":   cfg.MaxRecipientHeaderBytes,
+			},
+			Features: map[string]bool{
+				"attachments":        true,
+				"custom_headers":     true,
+				"text_content":       true,
+				"unsubscribe_footer": cfg.unsubscribeURL(username) != "",
+				"spam_scoring":       cfg.SpamScoreThreshold > 0,
+			},
+		}
+		if sender, ok := cfg.senderAddress(username); ok {
+			caps.FromAddresses = append(caps.FromAddresses, sender)
+		}
+		caps.FromAddresses = append(append(caps.FromAddresses, cfg.SharedMailboxes...), principal.SharedMailboxes...)
+		if caps.SendWindows == nil {
+			caps.SendWindows = []*SendWindow{}
+		}
+		if caps.HTMLPolicy == "" {
+			caps.HTMLPolicy = "default"
+		}
+		writeJSON(w, http.StatusOK, caps)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeVerifier answers Verify with err
+type fakeVerifier struct{ err error }
+
+func (v fakeVerifier) Verify(ctx context.Context, username, password string) error { return v.err }
+
+func TestCapabilitiesHandler(t *testing.T) {
+	dir := t.TempDir()
+	principals := filepath.Join(dir, "principals.json")
+	policies := filepath.Join(dir, "policies.json")
+	if err := os.WriteFile(principals, []byte(`{"trusted@example.com": {"max_attachments": 3, "html_policy": "strict"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(policies, []byte(`{"strict": {"strip_scripts": true}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := newTestConfig(t, nil, map[string]string{"PRINCIPALS_FILE": principals, "HTML_POLICIES_FILE": policies})
+
+	tests := []struct {
+		name       string
+		username   string
+		method     string
+		verifyErr  error
+		wantStatus int
+		wantCode   string
+	}{
+		{"trusted user", "trusted@example.com", http.MethodGet, nil, http.StatusOK, ""},
+		{"default user", "user@example.com", http.MethodGet, nil, http.StatusOK, ""},
+		{"no credentials", "", http.MethodGet, nil, http.StatusUnauthorized, "auth_missing"},
+		{"wrong password", "user@example.com", http.MethodGet, errInvalidCredentials, http.StatusUnauthorized, "auth_invalid"},
+		{"mail server down", "user@example.com", http.MethodGet, errors.New("connection refused"), http.StatusBadGateway, "smtp_unavailable"},
+		{"wrong method", "user@example.com", http.MethodPost, nil, http.StatusMethodNotAllowed, "method_not_allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/me/capabilities", nil)
+			if tt.username != "" {
+				req.SetBasicAuth(tt.username, "secret")
+			}
+			rec := httptest.NewRecorder()
+			GetCapabilitiesHandler(newTestRateLimiter(t, 10, nil), fakeVerifier{tt.verifyErr}, cfg)(rec, req)
+			if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.wantCode) {
+				t.Fatalf("got %d %s, want %d %s", rec.Code, rec.Body, tt.wantStatus, tt.wantCode)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var caps capabilities
+			if err := json.Unmarshal(rec.Body.Bytes(), &caps); err != nil {
+				t.Fatal(err)
+			}
+			wantAttachments, wantPolicy := cfg.MaxAttachments, "default"
+			if tt.username == "trusted@example.com" {
+				wantAttachments, wantPolicy = 3, "strict"
+			}
+			if caps.Principal != tt.username || caps.Limits["max_attachments"] != wantAttachments || caps.HTMLPolicy != wantPolicy {
+				t.Errorf("capabilities = %+v, want %d attachments and the %s policy for %s", caps, wantAttachments, wantPolicy, tt.username)
+			}
+			if caps.RateLimit.MaxPerSec != 10 || caps.SendWindows == nil {
+				t.Errorf("capabilities = %+v, want the rate limit and an empty list of windows", caps)
+			}
+		})
+	}
+}
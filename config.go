@@ -0,0 +1,781 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the runtime settings of the mail API, read from environment variables
+type Config struct {
+	// XMailerEnabled adds an X-Mailer header identifying this API to outgoing messages
+	XMailerEnabled bool
+
+	// ProcessedByHeader adds an X-Processed-By header recording the request ID and processing time
+	ProcessedByHeader bool
+
+	// ReportSMTPHost includes the mail server that accepted the message in the success response
+	ReportSMTPHost bool
+
+	// DebugTimings includes how long each SMTP phase took in the success response
+	DebugTimings bool
+
+	// MaxInflightRequests sheds load with 503 once this many requests are being served, 0 disables it
+	MaxInflightRequests int
+
+	// EndpointTimeouts bounds how long each endpoint may take to respond, keyed by path
+	EndpointTimeouts map[string]time.Duration
+
+	// SMTPHost is the mail server messages are submitted to
+	SMTPHost string
+
+	// SMTPPort is the submission port of SMTPHost
+	SMTPPort int
+
+	// SMTPHosts are the host:port of the mail servers a send is routed between, SMTPHost alone unless
+	// SMTP_HOSTS lists several
+	SMTPHosts []string
+
+	// SMTPRouting is how a send picks among SMTPHosts, failover or round-robin
+	SMTPRouting string
+
+	// SMTPAuth authenticates to the mail server with the request credentials. When disabled messages are
+	// handed to the unauthenticated local relay at SMTPRelayAddr and the API checks the credentials itself.
+	SMTPAuth bool
+
+	// SMTPTimeout bounds a whole SMTP session, 0 disables it
+	SMTPTimeout time.Duration
+
+	// SMTPAuthOrder is starttls-first, or auth-first for servers that want AUTH before STARTTLS
+	SMTPAuthOrder string
+
+	// SMTPRelayAddr is the host:port of the local relay used when SMTPAuth is disabled
+	SMTPRelayAddr string
+
+	// EHLOHostname is the name the API greets the mail server with, empty keeps "localhost"
+	EHLOHostname string
+
+	// MaxRecipientsPerTransaction splits sends to more recipients into several SMTP transactions,
+	// for servers limiting RCPT commands. 0 sends to everyone in one transaction.
+	MaxRecipientsPerTransaction int
+
+	// GroupRecipientsByDomain sends to the recipients of every domain in their own SMTP transactions
+	GroupRecipientsByDomain bool
+
+	// AdminToken is the bearer token required by the /admin endpoints, they are disabled when empty
+	AdminToken string
+
+	// NormalizeTextBody strips a leading BOM and trailing whitespace from plain text bodies
+	NormalizeTextBody bool
+
+	// NormalizeHTMLBody applies the same normalization to HTML bodies
+	NormalizeHTMLBody bool
+
+	// ReportAllValidationErrors returns every invalid field of a request instead of only the first
+	ReportAllValidationErrors bool
+
+	// VisibleRecipientWarningThreshold adds a warning to the response when more recipients than this
+	// can see each other in the headers, 0 disables the warning
+	VisibleRecipientWarningThreshold int
+
+	// SelfSendMode controls sends where the sender is also a recipient: allow, warn or reject
+	SelfSendMode string
+
+	// MaxRequestBytes caps the size of request bodies, 0 disables the limit
+	MaxRequestBytes int64
+
+	// MaxCredentialsBytes caps the length of the decoded Basic credentials, 0 disables the limit
+	MaxCredentialsBytes int
+
+	// MaxAttachmentRequestBytes is the larger cap of request bodies with attachments, 0 applies MaxRequestBytes
+	MaxAttachmentRequestBytes int64
+
+	// MaxMessageBytes caps the size of the fully assembled message, 0 disables the check.
+	// The default matches the message_size_limit Mail-in-a-Box configures in Postfix.
+	MaxMessageBytes int
+
+	// MaxAttachmentBytes caps the decoded size of all attachments of a message, 0 disables the check
+	MaxAttachmentBytes int
+
+	// MaxAttachments caps the number of attachments of a message, 0 disables the check
+	MaxAttachments int
+
+	// BlockedExtensions are the lowercase attachment filename extensions rejected with 415, without the dot
+	BlockedExtensions map[string]bool
+
+	// HTMLDetection is how bodies without an explicit type are classified: loose matches common tags,
+	// strict only trusts document markers and uses ContentTypeFallback for ambiguous content
+	HTMLDetection string
+
+	// ContentTypeFallback is text/plain or text/html, the type of ambiguous content in the strict mode
+	ContentTypeFallback string
+
+	// HTMLPolicy is how HTML bodies are cleaned and checked for principals without a policy of their own
+	HTMLPolicy *HTMLPolicy
+
+	// HTMLPolicies are the named policies principals can select, loaded from HTML_POLICIES_FILE
+	HTMLPolicies map[string]*HTMLPolicy
+
+	// SMTPWarningKeywords flag a successful send whose 250 reply contains one of them, e.g "quarantine"
+	SMTPWarningKeywords []string
+
+	// DefaultDomain is appended to usernames without a domain to form the From address
+	DefaultDomain string
+
+	// SharedMailboxes are addresses every principal may send as
+	SharedMailboxes []string
+
+	// VerifiedFromDomains are the lowercase domains From addresses must belong to, any domain is allowed when empty
+	VerifiedFromDomains map[string]bool
+
+	// RateLimitEnabled is false for deployments that don't limit the rate of sends at all
+	RateLimitEnabled bool
+
+	// RateLimitPerSec is the default sends per second of every user, the burst is twice that
+	RateLimitPerSec int
+
+	// RateLimitCost is what a send costs in rate limit tokens: one per request or one per recipient
+	RateLimitCost string
+
+	// ExpvarEnabled publishes the send counters on the admin protected /debug/vars endpoint
+	ExpvarEnabled bool
+
+	// LogFormat is json, or text for human readable lines
+	LogFormat string
+
+	// LogLevel is the least severe level logged
+	LogLevel slog.Level
+
+	// MetricsEnabled serves the counters for Prometheus on the unauthenticated /metrics endpoint
+	MetricsEnabled bool
+
+	// SpamScoreThreshold rejects messages whose heuristic spam score reaches it, 0 disables scoring
+	SpamScoreThreshold float64
+
+	// MaxFromHeaderBytes caps the length of the From header value, 0 disables the check
+	MaxFromHeaderBytes int
+
+	// MaxRecipientHeaderBytes caps the length of the To and Cc header values, 0 disables the check
+	MaxRecipientHeaderBytes int
+
+	// UnsubscribeURL is appended to bodies as a visible unsubscribe line for principals without a URL
+	// of their own, {sender} is replaced with the sender address. No footer is added when empty.
+	UnsubscribeURL string
+
+	// UsageRecorder selects where per request usage records go: none or memory
+	UsageRecorder string
+
+	// UsageRecordsMax caps how many records the memory usage recorder keeps, 0 keeps all of them
+	UsageRecordsMax int
+
+	// MaxCustomHeaders caps how many custom headers a request may set, 0 disables the check
+	MaxCustomHeaders int
+
+	// MaxCustomHeaderBytes caps the length of a custom header name and value together, 0 disables the check
+	MaxCustomHeaderBytes int
+
+	// RecipientNames are the display names of known recipients keyed by lowercase address, from RECIPIENT_NAMES_FILE
+	RecipientNames map[string]string
+
+	// DeriveRecipientNames gives bare recipient addresses without a known name one derived from the local part
+	DeriveRecipientNames bool
+
+	// MessageIDDedupeTTL is how long a client supplied Message-ID is remembered, a repeat within it
+	// returns the original response without sending again. 0 disables deduplication.
+	MessageIDDedupeTTL time.Duration
+
+	// IdempotencyKeyTTL is how long the response to a request with an Idempotency-Key header is kept for
+	// replaying to retries with the same key. 0 ignores the header.
+	IdempotencyKeyTTL time.Duration
+
+	// MaxRecipients caps the To, Cc and Bcc entries of a send combined, checked before they are parsed.
+	// 0 disables the limit.
+	MaxRecipients int
+
+	// MaxBatchSize caps the emails of one /mail/send/batch request, 0 disables the limit
+	MaxBatchSize int
+
+	// AsyncWorkers is the number of workers sending async=true requests, 0 disables asynchronous sends
+	AsyncWorkers int
+
+	// AsyncQueueSize is how many asynchronous sends may wait for a worker, more are rejected with 503
+	AsyncQueueSize int
+
+	// AsyncJobTTL is how long the status of a finished asynchronous send can be queried
+	AsyncJobTTL time.Duration
+
+	// RetryQueueDir persists sends that failed transiently for background retries, empty disables the queue
+	RetryQueueDir string
+
+	// RetryQueueKey is the AES-256 key encrypting the passwords of the queued sends
+	RetryQueueKey []byte
+
+	// RetryMaxAttempts is how many times a queued send is tried in total before it is given up
+	RetryMaxAttempts int
+
+	// RetryInitialBackoff is the delay before the first retry, doubled after each attempt up to RetryMaxBackoff
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+
+	// HTTP server timeouts against slow clients, 0 disables each of them. The write timeout has to outlast
+	// the slowest endpoint timeout or those responses are cut off.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// ShutdownGracePeriod is how long in-flight requests get to finish after SIGINT or SIGTERM
+	ShutdownGracePeriod time.Duration
+
+	// WindowLimit caps sends over a sliding window for principals without a limit of their own, nil disables it
+	WindowLimit *WindowLimit
+
+	// Principals holds the per user settings keyed by username
+	Principals map[string]*PrincipalConfig
+}
+
+// principal returns the settings of a user, or the defaults when the user has none
+func (c *Config) principal(username string) *PrincipalConfig {
+	if principal, ok := c.Principals[username]; ok {
+		return principal
+	}
+	return &PrincipalConfig{}
+}
+
+// defaultEndpointTimeouts are used for endpoints not listed in ENDPOINT_TIMEOUTS
+var defaultEndpointTimeouts = map[string]time.Duration{
+	"/mail/send":       60 * time.Second,
+	"/mail/send/batch": 60 * time.Second,
+	"/health":          5 * time.Second,
+	"/me/capabilities": 30 * time.Second,
+}
+
+// htmlPolicy returns the HTML policy selected by the user, or the default policy
+func (c *Config) htmlPolicy(username string) *HTMLPolicy {
+	if policy, ok := c.HTMLPolicies[c.principal(username).HTMLPolicy]; ok {
+		return policy
+	}
+	return c.HTMLPolicy
+}
+
+// unsubscribeURL returns the unsubscribe URL template of the user, empty when no footer is added
+func (c *Config) unsubscribeURL(username string) string {
+	if template := c.principal(username).UnsubscribeURL; template != "" {
+		return template
+	}
+	return c.UnsubscribeURL
+}
+
+// fromDomainVerified reports whether the domain of the From address is one of the verified domains
+func (c *Config) fromDomainVerified(address string) bool {
+	if len(c.VerifiedFromDomains) == 0 {
+		return true
+	}
+	at := strings.LastIndex(address, "@")
+	return at >= 0 && c.VerifiedFromDomains[strings.ToLower(address[at+1:])]
+}
+
+// ehloHostname returns the name the user's sessions greet the mail server with, empty for the default
+func (c *Config) ehloHostname(username string) string {
+	if name := c.principal(username).EHLOHostname; name != "" {
+		return name
+	}
+	return c.EHLOHostname
+}
+
+// maxAttachmentBytes returns the decoded attachment size limit of the user's messages
+func (c *Config) maxAttachmentBytes(username string) int {
+	if limit := c.principal(username).MaxAttachmentBytes; limit > 0 {
+		return limit
+	}
+	return c.MaxAttachmentBytes
+}
+
+// maxAttachments returns the most attachments the user's messages may have
+func (c *Config) maxAttachments(username string) int {
+	if limit := c.principal(username).MaxAttachments; limit > 0 {
+		return limit
+	}
+	return c.MaxAttachments
+}
+
+// senderAddress returns the From address of the user, usernames without a domain get the default domain.
+// It reports false when the username has no domain and no default is configured.
+func (c *Config) senderAddress(username string) (string, bool) {
+	if strings.Contains(username, "@") {
+		return username, true
+	}
+	if c.DefaultDomain == "" {
+		return "", false
+	}
+	return username + "@" + c.DefaultDomain, true
+}
+
+// windowLimit returns the sliding window limit of the user, nil when there is none
+func (c *Config) windowLimit(username string) *WindowLimit {
+	if limit := c.principal(username).WindowLimit; limit != nil {
+		return limit
+	}
+	return c.WindowLimit
+}
+
+// rateLimitOverrides returns the rate limit of every principal that replaces the default
+func (c *Config) rateLimitOverrides() map[string]RateLimitSettings {
+	overrides := make(map[string]RateLimitSettings)
+	for name, principal := range c.Principals {
+		if principal.RateLimit != nil {
+			overrides[name] = *principal.RateLimit
+		}
+	}
+	return overrides
+}
+
+// requestBytesLimit returns the most bytes any request body may have, 0 when there is no limit
+func (c *Config) requestBytesLimit() int64 {
+	if c.MaxRequestBytes == 0 {
+		return 0
+	}
+	return max(c.MaxRequestBytes, c.MaxAttachmentRequestBytes)
+}
+
+// canSendAs reports whether the user may send as the shared mailbox address
+func (c *Config) canSendAs(username, address string) bool {
+	return containsAddress(c.SharedMailboxes, address) || containsAddress(c.principal(username).SharedMailboxes, address)
+}
+
+// LoadConfig reads the configuration from the environment, falling back to defaults
+func LoadConfig() (*Config, error) {
+	cfg := &Config{}
+
+	var err error
+	if cfg.XMailerEnabled, err = envBool("X_MAILER_ENABLED", true); err != nil {
+		return nil, err
+	}
+
+	if cfg.ProcessedByHeader, err = envBool("PROCESSED_BY_HEADER", false); err != nil {
+		return nil, err
+	}
+	if cfg.ReportSMTPHost, err = envBool("REPORT_SMTP_HOST", false); err != nil {
+		return nil, err
+	}
+	if cfg.DebugTimings, err = envBool("DEBUG_TIMINGS", false); err != nil {
+		return nil, err
+	}
+	if cfg.NormalizeTextBody, err = envBool("NORMALIZE_TEXT_BODY", true); err != nil {
+		return nil, err
+	}
+	if cfg.NormalizeHTMLBody, err = envBool("NORMALIZE_HTML_BODY", false); err != nil {
+		return nil, err
+	}
+	if cfg.ReportAllValidationErrors, err = envBool("REPORT_ALL_VALIDATION_ERRORS", false); err != nil {
+		return nil, err
+	}
+	if cfg.VisibleRecipientWarningThreshold, err = envInt("VISIBLE_RECIPIENT_WARNING_THRESHOLD", 10); err != nil {
+		return nil, err
+	}
+	if cfg.SelfSendMode, err = envChoice("SELF_SEND_MODE", "allow", "allow", "warn", "reject"); err != nil {
+		return nil, err
+	}
+	if cfg.MaxRequestBytes, err = envInt64("MAX_REQUEST_BYTES", 10<<20); err != nil {
+		return nil, err
+	}
+	if cfg.MaxCredentialsBytes, err = envInt("MAX_CREDENTIALS_BYTES", 1024); err != nil {
+		return nil, err
+	}
+	if cfg.MaxAttachmentRequestBytes, err = envInt64("MAX_ATTACHMENT_REQUEST_BYTES", 40<<20); err != nil {
+		return nil, err
+	}
+	if cfg.MaxMessageBytes, err = envInt("MAX_MESSAGE_BYTES", 128<<20); err != nil {
+		return nil, err
+	}
+	if cfg.MaxAttachmentBytes, err = envInt("MAX_ATTACHMENT_BYTES", 25<<20); err != nil {
+		return nil, err
+	}
+	if cfg.MaxAttachments, err = envInt("MAX_ATTACHMENTS", 0); err != nil {
+		return nil, err
+	}
+	if cfg.HTMLDetection, err = envChoice("HTML_DETECTION", "loose", "loose", "strict"); err != nil {
+		return nil, err
+	}
+	if cfg.ContentTypeFallback, err = envChoice("CONTENT_TYPE_FALLBACK", "text/plain", "text/plain", "text/html"); err != nil {
+		return nil, err
+	}
+	cfg.HTMLPolicy = &HTMLPolicy{}
+	if cfg.HTMLPolicy.Validation, err = envChoice("HTML_VALIDATION", "off", "off", "warn", "reject"); err != nil {
+		return nil, err
+	}
+	if cfg.HTMLPolicy.StripTracking, err = envBool("STRIP_TRACKING", false); err != nil {
+		return nil, err
+	}
+	if cfg.HTMLPolicy.StripScripts, err = envBool("STRIP_SCRIPTS", false); err != nil {
+		return nil, err
+	}
+	cfg.SMTPWarningKeywords = envList("SMTP_WARNING_KEYWORDS")
+	cfg.DefaultDomain = strings.TrimPrefix(os.Getenv("DEFAULT_DOMAIN"), "@")
+	cfg.SharedMailboxes = envList("SHARED_MAILBOXES")
+	cfg.VerifiedFromDomains = make(map[string]bool)
+	for _, domain := range envList("VERIFIED_FROM_DOMAINS") {
+		cfg.VerifiedFromDomains[strings.ToLower(domain)] = true
+	}
+
+	// An empty BLOCKED_ATTACHMENT_EXTENSIONS allows every extension
+	extensions := defaultBlockedExtensions
+	if _, ok := os.LookupEnv("BLOCKED_ATTACHMENT_EXTENSIONS"); ok {
+		extensions = envList("BLOCKED_ATTACHMENT_EXTENSIONS")
+	}
+	cfg.BlockedExtensions = make(map[string]bool, len(extensions))
+	for _, ext := range extensions {
+		cfg.BlockedExtensions[strings.ToLower(strings.TrimPrefix(ext, "."))] = true
+	}
+	if cfg.ExpvarEnabled, err = envBool("EXPVAR_ENABLED", false); err != nil {
+		return nil, err
+	}
+	if cfg.MetricsEnabled, err = envBool("METRICS_ENABLED", false); err != nil {
+		return nil, err
+	}
+	if cfg.LogFormat, err = envChoice("LOG_FORMAT", "json", "json", "text"); err != nil {
+		return nil, err
+	}
+	level, err := envChoice("LOG_LEVEL", "info", "debug", "info", "warn", "error")
+	if err != nil {
+		return nil, err
+	}
+	cfg.LogLevel = logLevels[level]
+	if cfg.SpamScoreThreshold, err = envFloat("SPAM_SCORE_THRESHOLD", 0); err != nil {
+		return nil, err
+	}
+	if cfg.MaxFromHeaderBytes, err = envInt("MAX_FROM_HEADER_BYTES", 998); err != nil {
+		return nil, err
+	}
+	if cfg.MaxRecipientHeaderBytes, err = envInt("MAX_RECIPIENT_HEADER_BYTES", 65536); err != nil {
+		return nil, err
+	}
+	if cfg.MaxCustomHeaders, err = envInt("MAX_CUSTOM_HEADERS", 20); err != nil {
+		return nil, err
+	}
+	if cfg.MaxCustomHeaderBytes, err = envInt("MAX_CUSTOM_HEADER_BYTES", 998); err != nil {
+		return nil, err
+	}
+	if cfg.MaxInflightRequests, err = envInt("MAX_INFLIGHT_REQUESTS", 256); err != nil {
+		return nil, err
+	}
+	if cfg.EndpointTimeouts, err = envDurationMap("ENDPOINT_TIMEOUTS", defaultEndpointTimeouts); err != nil {
+		return nil, err
+	}
+
+	if cfg.SMTPHost = strings.TrimSpace(envString("SMTP_HOST", "box.domain.com")); cfg.SMTPHost == "" {
+		return nil, fmt.Errorf("invalid value for SMTP_HOST: the host must not be empty")
+	}
+	if cfg.SMTPPort, err = envInt("SMTP_PORT", 587); err != nil {
+		return nil, err
+	}
+	if cfg.SMTPPort < 1 || cfg.SMTPPort > 65535 {
+		return nil, fmt.Errorf("invalid value for SMTP_PORT: %d is not a valid port", cfg.SMTPPort)
+	}
+	cfg.SMTPHosts = []string{net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort))}
+	if hosts := envList("SMTP_HOSTS"); len(hosts) > 0 {
+		cfg.SMTPHosts = nil
+		for _, host := range hosts {
+			addr, err := smtpHostAddr(host, cfg.SMTPPort)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for SMTP_HOSTS: %w", err)
+			}
+			cfg.SMTPHosts = append(cfg.SMTPHosts, addr)
+		}
+	}
+	if cfg.SMTPRouting, err = envChoice("SMTP_ROUTING", "failover", "failover", "round-robin"); err != nil {
+		return nil, err
+	}
+	if cfg.SMTPAuth, err = envBool("SMTP_AUTH", true); err != nil {
+		return nil, err
+	}
+	if cfg.SMTPTimeout, err = envDuration("SMTP_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.SMTPAuthOrder, err = envChoice("SMTP_AUTH_ORDER", "starttls-first", "starttls-first", "auth-first"); err != nil {
+		return nil, err
+	}
+	cfg.SMTPRelayAddr = envString("SMTP_RELAY_ADDR", "localhost:25")
+	if _, _, err := net.SplitHostPort(cfg.SMTPRelayAddr); err != nil {
+		return nil, fmt.Errorf("invalid value for SMTP_RELAY_ADDR: %w", err)
+	}
+	cfg.EHLOHostname = os.Getenv("SMTP_EHLO_HOSTNAME")
+	if cfg.EHLOHostname != "" && !isHostname(cfg.EHLOHostname) {
+		return nil, fmt.Errorf("invalid value for SMTP_EHLO_HOSTNAME: %q is not a valid hostname", cfg.EHLOHostname)
+	}
+
+	if cfg.MaxRecipientsPerTransaction, err = envInt("SMTP_MAX_RECIPIENTS_PER_TRANSACTION", 0); err != nil {
+		return nil, err
+	}
+	if cfg.GroupRecipientsByDomain, err = envBool("SMTP_GROUP_RECIPIENTS_BY_DOMAIN", false); err != nil {
+		return nil, err
+	}
+
+	if cfg.RateLimitEnabled, err = envBool("RATE_LIMIT_ENABLED", true); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimitPerSec, err = envInt("RATE_LIMIT_PER_SEC", 10); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimitCost, err = envChoice("RATE_LIMIT_COST", "request", "request", "recipients"); err != nil {
+		return nil, err
+	}
+
+	if cfg.ReadHeaderTimeout, err = envDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.ReadTimeout, err = envDuration("HTTP_READ_TIMEOUT", 60*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.WriteTimeout, err = envDuration("HTTP_WRITE_TIMEOUT", 75*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.IdleTimeout, err = envDuration("HTTP_IDLE_TIMEOUT", 120*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.ShutdownGracePeriod, err = envDuration("SHUTDOWN_GRACE_PERIOD", 15*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.MessageIDDedupeTTL, err = envDuration("MESSAGE_ID_DEDUPE_TTL", 0); err != nil {
+		return nil, err
+	}
+	if cfg.IdempotencyKeyTTL, err = envDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.MaxRecipients, err = envInt("MAX_RECIPIENTS", 1000); err != nil {
+		return nil, err
+	}
+	if cfg.MaxBatchSize, err = envInt("MAX_BATCH_SIZE", 50); err != nil {
+		return nil, err
+	}
+	if cfg.AsyncWorkers, err = envInt("ASYNC_WORKERS", 0); err != nil {
+		return nil, err
+	}
+	if cfg.AsyncQueueSize, err = envInt("ASYNC_QUEUE_SIZE", 100); err != nil {
+		return nil, err
+	}
+	if cfg.AsyncJobTTL, err = envDuration("ASYNC_JOB_TTL", time.Hour); err != nil {
+		return nil, err
+	}
+	cfg.RetryQueueDir = os.Getenv("RETRY_QUEUE_DIR")
+	if cfg.RetryMaxAttempts, err = envInt("RETRY_MAX_ATTEMPTS", 8); err != nil {
+		return nil, err
+	}
+	if cfg.RetryInitialBackoff, err = envDuration("RETRY_INITIAL_BACKOFF", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.RetryMaxBackoff, err = envDuration("RETRY_MAX_BACKOFF", time.Hour); err != nil {
+		return nil, err
+	}
+	if key := os.Getenv("RETRY_QUEUE_KEY"); key != "" {
+		if cfg.RetryQueueKey, err = base64.StdEncoding.DecodeString(key); err != nil || len(cfg.RetryQueueKey) != 32 {
+			return nil, fmt.Errorf("invalid RETRY_QUEUE_KEY: must be 32 bytes encoded in base64")
+		}
+	}
+	// The queued sends need the user's password with SMTP authentication, it is only written encrypted
+	if cfg.RetryQueueDir != "" && cfg.SMTPAuth && cfg.RetryQueueKey == nil {
+		return nil, fmt.Errorf("RETRY_QUEUE_DIR with SMTP_AUTH=true needs a RETRY_QUEUE_KEY to encrypt the queued passwords")
+	}
+	if cfg.RetryQueueDir != "" && (cfg.RetryMaxAttempts < 2 || cfg.RetryInitialBackoff <= 0 || cfg.RetryMaxBackoff < cfg.RetryInitialBackoff) {
+		return nil, fmt.Errorf("invalid retry queue settings: RETRY_MAX_ATTEMPTS must be at least 2 and RETRY_MAX_BACKOFF at least RETRY_INITIAL_BACKOFF")
+	}
+
+	windowMax, err := envInt("RATE_WINDOW_MAX", 0)
+	if err != nil {
+		return nil, err
+	}
+	if windowMax > 0 {
+		cfg.WindowLimit = &WindowLimit{Max: windowMax, Window: envString("RATE_WINDOW", "1h")}
+		if err := cfg.WindowLimit.init(); err != nil {
+			return nil, fmt.Errorf("invalid value for RATE_WINDOW: %w", err)
+		}
+	}
+
+	if cfg.UsageRecorder, err = envChoice("USAGE_RECORDER", "none", "none", "memory"); err != nil {
+		return nil, err
+	}
+	if cfg.UsageRecordsMax, err = envInt("USAGE_RECORDS_MAX", 10000); err != nil {
+		return nil, err
+	}
+
+	cfg.AdminToken = os.Getenv("ADMIN_TOKEN")
+	cfg.UnsubscribeURL = os.Getenv("UNSUBSCRIBE_URL")
+
+	if path := os.Getenv("HTML_POLICIES_FILE"); path != "" {
+		if cfg.HTMLPolicies, err = LoadHTMLPolicies(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if path := os.Getenv("RECIPIENT_NAMES_FILE"); path != "" {
+		if cfg.RecipientNames, err = LoadRecipientNames(path); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.DeriveRecipientNames, err = envBool("DERIVE_RECIPIENT_NAMES", false); err != nil {
+		return nil, err
+	}
+
+	if path := os.Getenv("PRINCIPALS_FILE"); path != "" {
+		if cfg.Principals, err = LoadPrincipals(path); err != nil {
+			return nil, err
+		}
+	}
+	hasAPIPassword := false
+	for name, principal := range cfg.Principals {
+		if _, ok := cfg.HTMLPolicies[principal.HTMLPolicy]; principal.HTMLPolicy != "" && !ok {
+			return nil, fmt.Errorf("principal %s: undefined HTML policy %q", name, principal.HTMLPolicy)
+		}
+		hasAPIPassword = hasAPIPassword || principal.APIPasswordSHA256 != ""
+	}
+	if !cfg.SMTPAuth && !hasAPIPassword {
+		return nil, fmt.Errorf("SMTP_AUTH=false requires principals with an api_password_sha256 in PRINCIPALS_FILE")
+	}
+
+	return cfg, nil
+}
+
+// smtpHostAddr returns the host:port of an SMTP_HOSTS entry, entries without a port get port
+func smtpHostAddr(entry string, port int) (string, error) {
+	host, portText, err := net.SplitHostPort(entry)
+	if err != nil {
+		host, portText = strings.Trim(entry, "[]"), strconv.Itoa(port)
+	}
+	if host == "" {
+		return "", fmt.Errorf("%q has no host", entry)
+	}
+	if n, err := strconv.Atoi(portText); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("%q doesn't have a valid port", entry)
+	}
+	return net.JoinHostPort(host, portText), nil
+}
+
+// envString reads a string environment variable, returning def when it is unset
+func envString(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// envBool reads a boolean environment variable, returning def when it is unset
+func envBool(key string, def bool) (bool, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for %s: %q is not a boolean", key, value)
+	}
+	return parsed, nil
+}
+
+// envInt reads a non-negative integer environment variable, returning def when it is unset
+func envInt(key string, def int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("invalid value for %s: %q is not a non-negative integer", key, value)
+	}
+	return parsed, nil
+}
+
+// envInt64 reads a non-negative 64-bit integer environment variable, returning def when it is unset
+func envInt64(key string, def int64) (int64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("invalid value for %s: %q is not a non-negative integer", key, value)
+	}
+	return parsed, nil
+}
+
+// envFloat reads a non-negative number environment variable, returning def when it is unset
+func envFloat(key string, def float64) (float64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("invalid value for %s: %q is not a non-negative number", key, value)
+	}
+	return parsed, nil
+}
+
+// envChoice reads an environment variable that must be one of choices, returning def when it is unset
+func envChoice(key, def string, choices ...string) (string, error) {
+	value := strings.ToLower(os.Getenv(key))
+	if value == "" {
+		return def, nil
+	}
+	for _, choice := range choices {
+		if value == choice {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("invalid value for %s: %q, expected one of %s", key, value, strings.Join(choices, ", "))
+}
+
+// envList reads a comma separated environment variable, dropping empty entries
+func envList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envDurationMap reads a comma separated list of key=duration pairs e.g "/mail/send=60s,/health=2s".
+// Keys that are not listed keep their value from def.
+func envDurationMap(key string, def map[string]time.Duration) (map[string]time.Duration, error) {
+	result := make(map[string]time.Duration, len(def))
+	for k, v := range def {
+		result[k] = v
+	}
+
+	value := os.Getenv(key)
+	if value == "" {
+		return result, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		name, raw, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid value for %s: %q is not a key=duration pair", key, pair)
+		}
+		duration, err := time.ParseDuration(raw)
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("invalid value for %s: %q is not a valid duration", key, raw)
+		}
+		result[name] = duration
+	}
+	return result, nil
+}
+
+// envDuration reads a non-negative duration environment variable e.g "24h", returning def when it is unset
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid value for %s: %q is not a valid duration", key, value)
+	}
+	return duration, nil
+}
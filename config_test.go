@@ -0,0 +1,222 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigSMTPServer(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     string
+		port     string
+		wantHost string
+		wantPort int
+		wantErr  bool
+	}{
+		{"defaults", "", "", "box.domain.com", 587, false},
+		{"custom", " mail.example.com ", "465", "mail.example.com", 465, false},
+		{"blank host", "   ", "", "", 0, true},
+		{"port zero", "", "0", "", 0, true},
+		{"port too large", "", "65536", "", 0, true},
+		{"port not a number", "", "smtp", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SMTP_HOST", tt.host)
+			t.Setenv("SMTP_PORT", tt.port)
+			cfg, err := LoadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			if err == nil && (cfg.SMTPHost != tt.wantHost || cfg.SMTPPort != tt.wantPort) {
+				t.Errorf("SMTP server = %s:%d, want %s:%d", cfg.SMTPHost, cfg.SMTPPort, tt.wantHost, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestLoadConfigSMTPHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		hosts   string
+		routing string
+		want    []string
+		wantErr bool
+	}{
+		{"defaults to SMTP_HOST", "", "", []string{"box.domain.com:587"}, false},
+		{"default port", "a.example.com, b.example.com:465", "round-robin", []string{"a.example.com:587", "b.example.com:465"}, false},
+		{"ipv6", "[::1]:25,::2", "failover", []string{"[::1]:25", "[::2]:587"}, false},
+		{"invalid port", "a.example.com:smtp", "", nil, true},
+		{"no host", ":25", "", nil, true},
+		{"unknown routing", "a.example.com", "random", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SMTP_HOSTS", tt.hosts)
+			t.Setenv("SMTP_ROUTING", tt.routing)
+			cfg, err := LoadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			if err == nil && strings.Join(cfg.SMTPHosts, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("SMTPHosts = %v, want %v", cfg.SMTPHosts, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigEndpointTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]time.Duration
+		wantErr bool
+	}{
+		{"defaults", "", map[string]time.Duration{"/mail/send": 60 * time.Second, "/health": 5 * time.Second}, false},
+		{"override one", "/health=1s", map[string]time.Duration{"/mail/send": 60 * time.Second, "/health": time.Second}, false},
+		{"add one", " /admin/usage=10s , /mail/send=0s", map[string]time.Duration{"/admin/usage": 10 * time.Second, "/mail/send": 0}, false},
+		{"missing duration", "/health", nil, true},
+		{"missing endpoint", "=5s", nil, true},
+		{"negative", "/health=-1s", nil, true},
+		{"not a duration", "/health=soon", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ENDPOINT_TIMEOUTS", tt.value)
+			cfg, err := LoadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			for endpoint, want := range tt.want {
+				if got, ok := cfg.EndpointTimeouts[endpoint]; !ok || got != want {
+					t.Errorf("EndpointTimeouts[%s] = %v, want %v", endpoint, got, want)
+				}
+			}
+		})
+	}
+	if defaultEndpointTimeouts["/health"] != 5*time.Second {
+		t.Error("LoadConfig() changed the default timeouts")
+	}
+}
+
+func TestSenderAddress(t *testing.T) {
+	tests := []struct {
+		name          string
+		defaultDomain string
+		username      string
+		want          string
+		wantOK        bool
+	}{
+		{"full address", "", "user@example.com", "user@example.com", true},
+		{"full address keeps its domain", "other.example", "user@example.com", "user@example.com", true},
+		{"default domain", "example.com", "user", "user@example.com", true},
+		{"default domain with @", "@example.com", "user", "user@example.com", true},
+		{"no default domain", "", "user", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DEFAULT_DOMAIN", tt.defaultDomain)
+			cfg, err := LoadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := cfg.senderAddress(tt.username); got != tt.want || ok != tt.wantOK {
+				t.Errorf("senderAddress(%q) = %q, %v, want %q, %v", tt.username, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestLoadConfigHTMLDetection(t *testing.T) {
+	tests := []struct {
+		name         string
+		detection    string
+		fallback     string
+		wantMode     string
+		wantFallback string
+		wantErr      bool
+	}{
+		{"defaults", "", "", "loose", "text/plain", false},
+		{"strict with html fallback", "strict", "text/html", "strict", "text/html", false},
+		{"unknown mode", "fuzzy", "", "", "", true},
+		{"unknown fallback", "strict", "application/json", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HTML_DETECTION", tt.detection)
+			t.Setenv("CONTENT_TYPE_FALLBACK", tt.fallback)
+			cfg, err := LoadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			if err == nil && (cfg.HTMLDetection != tt.wantMode || cfg.ContentTypeFallback != tt.wantFallback) {
+				t.Errorf("detection = %s/%s, want %s/%s", cfg.HTMLDetection, cfg.ContentTypeFallback, tt.wantMode, tt.wantFallback)
+			}
+		})
+	}
+}
+
+func TestLoadConfigShutdownGracePeriod(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 15 * time.Second, false},
+		{"1m", time.Minute, false},
+		{"0s", 0, false},
+		{"-5s", 0, true},
+		{"soon", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("SHUTDOWN_GRACE_PERIOD", tt.value)
+			cfg, err := LoadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.ShutdownGracePeriod != tt.want {
+				t.Errorf("ShutdownGracePeriod = %v, want %v", cfg.ShutdownGracePeriod, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigHTTPTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    [4]time.Duration // read header, read, write and idle
+		wantErr bool
+	}{
+		{"defaults", nil, [4]time.Duration{10 * time.Second, 60 * time.Second, 75 * time.Second, 120 * time.Second}, false},
+		{"custom", map[string]string{
+			"HTTP_READ_HEADER_TIMEOUT": "2s",
+			"HTTP_READ_TIMEOUT":        "30s",
+			"HTTP_WRITE_TIMEOUT":       "45s",
+			"HTTP_IDLE_TIMEOUT":        "0s",
+		}, [4]time.Duration{2 * time.Second, 30 * time.Second, 45 * time.Second, 0}, false},
+		{"invalid read header", map[string]string{"HTTP_READ_HEADER_TIMEOUT": "10"}, [4]time.Duration{}, true},
+		{"negative write", map[string]string{"HTTP_WRITE_TIMEOUT": "-1s"}, [4]time.Duration{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"HTTP_READ_HEADER_TIMEOUT", "HTTP_READ_TIMEOUT", "HTTP_WRITE_TIMEOUT", "HTTP_IDLE_TIMEOUT"} {
+				t.Setenv(key, tt.env[key])
+			}
+			cfg, err := LoadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := [4]time.Duration{cfg.ReadHeaderTimeout, cfg.ReadTimeout, cfg.WriteTimeout, cfg.IdleTimeout}
+			if got != tt.want {
+				t.Errorf("HTTP timeouts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// maxLineLength is the longest line SMTP allows, excluding the CRLF
+const maxLineLength = 998
+
+// encodeBody applies a Content-Transfer-Encoding to the content. An empty encoding leaves it unchanged.
+func encodeBody(content, encoding string) (string, error) {
+	switch strings.ToLower(encoding) {
+	case "":
+		return content, nil
+	case "7bit":
+		if !isASCII(content) {
+			return "", fmt.Errorf("the content contains non-ASCII characters, which the 7bit encoding can't carry")
+		}
+		if hasLongLines(content) {
+			return "", fmt.Errorf("the content has lines over %d characters, which the 7bit encoding can't carry", maxLineLength)
+		}
+		return content, nil
+	case "8bit":
+		if hasLongLines(content) {
+			return "", fmt.Errorf("the content has lines over %d characters, which the 8bit encoding can't carry", maxLineLength)
+		}
+		return content, nil
+	case "base64":
+		return wrapBase64([]byte(content)), nil
+	case "quoted-printable":
+		var b strings.Builder
+		w := quotedprintable.NewWriter(&b)
+		w.Write([]byte(content))
+		w.Close()
+		return b.String(), nil
+	default:
+		return "", fmt.Errorf("unsupported encoding %q, expected 7bit, 8bit, base64 or quoted-printable", encoding)
+	}
+}
+
+// wrapBase64 base64 encodes data in lines of 76 characters
+func wrapBase64(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	var b strings.Builder
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76])
+		b.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded)
+	return b.String()
+}
+
+// hasLongLines reports whether any line of the content is longer than SMTP allows
+func hasLongLines(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		if len(strings.TrimSuffix(line, "\r")) > maxLineLength {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"mime/quotedprintable"
+	"strings"
+	"testing"
+)
+
+func TestEncodeBody(t *testing.T) {
+	longLine := strings.Repeat("a", maxLineLength+1)
+	tests := []struct {
+		name     string
+		content  string
+		encoding string
+		wantErr  bool
+	}{
+		{"unchanged", "héllo", "", false},
+		{"7bit ascii", "hello\nworld", "7bit", false},
+		{"7bit non-ascii", "héllo", "7bit", true},
+		{"7bit long line", longLine, "7bit", true},
+		{"8bit non-ascii", "héllo", "8bit", false},
+		{"8bit long line", longLine, "8bit", true},
+		{"8bit CRLF at the limit", strings.Repeat("a", maxLineLength) + "\r\nb", "8bit", false},
+		{"base64", "héllo", "base64", false},
+		{"base64 upper case", "héllo", "BASE64", false},
+		{"quoted-printable", "héllo " + longLine, "quoted-printable", false},
+		{"unknown", "hello", "uuencode", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := encodeBody(tt.content, tt.encoding)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("encodeBody() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if hasLongLines(encoded) {
+				t.Error("the encoded body has lines SMTP can't carry")
+			}
+
+			var decoded string
+			switch strings.ToLower(tt.encoding) {
+			case "base64":
+				data, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(encoded, "\r\n", ""))
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded = string(data)
+			case "quoted-printable":
+				data, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(encoded)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded = string(data)
+			default:
+				decoded = encoded
+			}
+			if decoded != tt.content {
+				t.Errorf("decoded body = %q, want %q", decoded, tt.content)
+			}
+		})
+	}
+}
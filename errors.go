@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// errorCode is a stable machine readable error the API responds with
+type errorCode struct {
+	Code        string `json:"code"`
+	Status      int    `json:"status"`
+	Description string `json:"description"`
+}
+
+// errorRegistry lists every error code of the API. It is the only place statuses are assigned,
+// writeError looks them up here and GET /errors serves the list.
+var errorRegistry = []errorCode{
+	{"method_not_allowed", http.StatusMethodNotAllowed, "The endpoint doesn't support the HTTP method, see the Allow header"},
+	{"auth_missing", http.StatusUnauthorized, "The request has no Authorization header"},
+	{"auth_unsupported_scheme", http.StatusUnauthorized, "The Authorization header doesn't use Basic authentication"},
+	{"auth_too_large", http.StatusUnauthorized, "The credentials are longer than MAX_CREDENTIALS_BYTES"},
+	{"auth_malformed", http.StatusUnauthorized, "The Basic credentials can't be decoded"},
+	{"auth_invalid", http.StatusUnauthorized, "The username or password is wrong"},
+	{"admin_auth_required", http.StatusUnauthorized, "The admin bearer token is missing or wrong"},
+	{"invalid_rate_limit", http.StatusBadRequest, "max_per_sec is negative or burst isn't positive"},
+	{"rate_limit_disabled", http.StatusConflict, "The rate limit can't be managed because RATE_LIMIT_ENABLED is false"},
+	{"outside_send_window", http.StatusForbidden, "The user isn't allowed to send at this time"},
+	{"rate_limited", http.StatusTooManyRequests, "The user's rate limit is exhausted, see Retry-After"},
+	{"window_limit_exceeded", http.StatusTooManyRequests, "The user sent the most messages allowed in the sliding window"},
+	{"request_too_large", http.StatusRequestEntityTooLarge, "The request body is larger than allowed"},
+	{"expected_object", http.StatusBadRequest, "The request body isn't a JSON object"},
+	{"expected_array", http.StatusBadRequest, "The batch request body isn't a JSON array"},
+	{"invalid_batch", http.StatusBadRequest, "The batch is empty or holds more than MAX_BATCH_SIZE emails"},
+	{"batch_unsupported", http.StatusBadRequest, "An email of a batch uses a feature batches don't support, e.g per_recipient"},
+	{"invalid_body", http.StatusBadRequest, "The request body isn't valid JSON for the endpoint"},
+	{"validation_failed", http.StatusBadRequest, "Fields of the request are invalid, the details list each field and its problem"},
+	{"too_many_recipients", http.StatusBadRequest, "The request has more To, Cc and Bcc entries than MAX_RECIPIENTS"},
+	{"too_many_headers", http.StatusBadRequest, "The request has more custom headers than MAX_CUSTOM_HEADERS"},
+	{"header_too_long", http.StatusBadRequest, "A header is longer than allowed"},
+	{"invalid_sender", http.StatusBadRequest, "The username isn't an email address and no default domain is configured"},
+	{"shared_mailbox_forbidden", http.StatusForbidden, "The user isn't allowed to send as the from address"},
+	{"unverified_from_domain", http.StatusForbidden, "The from address isn't in one of VERIFIED_FROM_DOMAINS"},
+	{"sender_in_recipients", http.StatusBadRequest, "The sender is one of the recipients"},
+	{"invalid_encoding", http.StatusBadRequest, "The body can't be sent with the requested encoding"},
+	{"malformed_html", http.StatusUnprocessableEntity, "The HTML content is malformed, the details list the problems"},
+	{"spam_suspected", http.StatusUnprocessableEntity, "The message scored above SPAM_SCORE_THRESHOLD"},
+	{"invalid_attachment", http.StatusBadRequest, "An attachment can't be decoded"},
+	{"blocked_attachment", http.StatusUnsupportedMediaType, "An attachment has a blocked filename extension"},
+	{"too_many_attachments", http.StatusRequestEntityTooLarge, "The message has more attachments than MAX_ATTACHMENTS"},
+	{"attachments_too_large", http.StatusRequestEntityTooLarge, "The attachments are larger than MAX_ATTACHMENT_BYTES"},
+	{"message_too_large", http.StatusRequestEntityTooLarge, "The assembled message is larger than MAX_MESSAGE_BYTES"},
+	{"pre_send_rejected", http.StatusUnprocessableEntity, "A pre-send hook rejected the message"},
+	{"invalid_idempotency_key", http.StatusBadRequest, "The Idempotency-Key header is too long or has control characters"},
+	{"idempotency_key_in_progress", http.StatusConflict, "A request with the same Idempotency-Key didn't finish in time"},
+	{"duplicate_in_progress", http.StatusConflict, "A message with the same Message-ID is being sent right now"},
+	{"duplicate_message", http.StatusConflict, "An email of a batch has the Message-ID of one already sent, it is skipped"},
+	{"async_disabled", http.StatusBadRequest, "async=true was requested but ASYNC_WORKERS is 0"},
+	{"async_unsupported", http.StatusBadRequest, "per_recipient sends can't be asynchronous"},
+	{"queue_full", http.StatusServiceUnavailable, "Too many asynchronous sends are waiting, see Retry-After"},
+	{"job_not_found", http.StatusNotFound, "No asynchronous send of the user has the job ID"},
+	{"smtputf8_unsupported", http.StatusUnprocessableEntity, "An address needs SMTPUTF8, which the mail server doesn't support"},
+	{"8bitmime_unsupported", http.StatusUnprocessableEntity, "The 8bit encoding needs 8BITMIME, which the mail server doesn't support"},
+	{"smtp_timeout", http.StatusGatewayTimeout, "The mail server didn't respond within SMTP_TIMEOUT"},
+	{"smtp_unavailable", http.StatusBadGateway, "The mail server couldn't be asked to verify the credentials"},
+	{"send_failed", http.StatusInternalServerError, "The mail server didn't accept the message"},
+	{"request_timeout", http.StatusServiceUnavailable, "The request took longer than its ENDPOINT_TIMEOUTS entry"},
+	{"overloaded", http.StatusServiceUnavailable, "Too many requests are in flight, see Retry-After"},
+	{"shutting_down", http.StatusServiceUnavailable, "The server is shutting down, see Retry-After"},
+}
+
+// fieldErrorCodes are the codes of the details of a validation_failed response
+var fieldErrorCodes = []errorCode{
+	{"required", http.StatusBadRequest, "The field is missing or empty"},
+	{"invalid", http.StatusBadRequest, "The field has an unsupported value"},
+	{"conflict", http.StatusBadRequest, "The field contradicts another field"},
+	{"invalid_header_value", http.StatusBadRequest, "The field contains CR, LF or NUL, or a header value is malformed"},
+	{"invalid_header_name", http.StatusBadRequest, "A custom header name isn't a valid field name"},
+	{"reserved_header", http.StatusBadRequest, "A custom header is set by the API itself"},
+	{"duplicate_header", http.StatusBadRequest, "Two custom header names only differ by case"},
+	{"empty_address", http.StatusBadRequest, "A recipient address is empty"},
+	{"invalid_address", http.StatusBadRequest, "A recipient address is malformed"},
+}
+
+// errorStatuses maps the registered codes to their HTTP status
+var errorStatuses = func() map[string]int {
+	statuses := make(map[string]int, len(errorRegistry))
+	for _, e := range errorRegistry {
+		statuses[e.Code] = e.Status
+	}
+	return statuses
+}()
+
+// errorStatus returns the HTTP status of a registered code, 500 for codes missing from the registry
+func errorStatus(code string) int {
+	if status, ok := errorStatuses[code]; ok {
+		return status
+	}
+	slog.Error("Unregistered error code", "code", code)
+	return http.StatusInternalServerError
+}
+
+// writeError writes a JSON error response with a machine readable code and the status registered for it
+func writeError(w http.ResponseWriter, code, message string) {
+	writeErrorFields(w, code, message, nil)
+}
+
+// writeErrorFields writes an error response like writeError with additional fields
+func writeErrorFields(w http.ResponseWriter, code, message string, fields map[string]any) {
+	response := map[string]any{
+		"status":  "error",
+		"code":    code,
+		"message": message,
+	}
+	for key, value := range fields {
+		response[key] = value
+	}
+	writeJSON(w, errorStatus(code), response)
+}
+
+// GetErrorsHandler lists the error codes of the API with their statuses and descriptions
+func GetErrorsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"errors":       errorRegistry,
+			"field_errors": fieldErrorCodes,
+		})
+	}
+}
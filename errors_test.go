@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorRegistry(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, e := range append(append([]errorCode{}, errorRegistry...), fieldErrorCodes...) {
+		if seen[e.Code] {
+			t.Errorf("%s is registered twice", e.Code)
+		}
+		seen[e.Code] = true
+		if e.Description == "" {
+			t.Errorf("%s has no description", e.Code)
+		}
+	}
+	for _, e := range errorRegistry {
+		if e.Status < 400 || e.Status > 599 || http.StatusText(e.Status) == "" {
+			t.Errorf("%s has status %d, want an HTTP error status", e.Code, e.Status)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		code       string
+		wantStatus int
+	}{
+		{"auth_missing", http.StatusUnauthorized},
+		{"rate_limited", http.StatusTooManyRequests},
+		{"not_registered", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeErrorFields(rec, tt.code, "message", map[string]any{"retry_after": 3})
+			var body map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.wantStatus || body["code"] != tt.code || body["status"] != "error" || body["retry_after"] != 3.0 {
+				t.Errorf("got %d %s, want %d with the code and fields", rec.Code, rec.Body, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestErrorsHandler(t *testing.T) {
+	tests := []struct {
+		method     string
+		wantStatus int
+	}{
+		{http.MethodGet, http.StatusOK},
+		{http.MethodPost, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			GetErrorsHandler()(rec, httptest.NewRequest(tt.method, "/errors", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var body struct {
+				Errors      []errorCode `json:"errors"`
+				FieldErrors []errorCode `json:"field_errors"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Errors) != len(errorRegistry) || len(body.FieldErrors) != len(fieldErrorCodes) {
+				t.Errorf("listed %d errors and %d field errors, want the whole registry", len(body.Errors), len(body.FieldErrors))
+			}
+		})
+	}
+}
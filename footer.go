@@ -0,0 +1,26 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"strings"
+)
+
+// unsubscribeURL resolves an unsubscribe URL template, {sender} is replaced with the escaped sender address
+func unsubscribeURL(template, sender string) string {
+	return strings.ReplaceAll(template, "{sender}", url.QueryEscape(sender))
+}
+
+// addUnsubscribeFooter appends a visible unsubscribe line to the body, HTML bodies get it before </body>
+func addUnsubscribeFooter(content, link string, isHTML bool) string {
+	if !isHTML {
+		return strings.TrimRight(content, "\r\n") + "\n\n--\nUnsubscribe: " + link + "\n"
+	}
+
+	escaped := html.EscapeString(link)
+	footer := `<p style="font-size:12px;color:#666">To unsubscribe, visit <a href="` + escaped + `">` + escaped + `</a></p>`
+	if i := strings.LastIndex(strings.ToLower(content), "</body>"); i >= 0 {
+		return content[:i] + footer + content[i:]
+	}
+	return content + footer
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestUnsubscribeURL(t *testing.T) {
+	tests := []struct {
+		template string
+		sender   string
+		want     string
+	}{
+		{"https://example.com/unsubscribe?list={sender}", "news+a@example.com", "https://example.com/unsubscribe?list=news%2Ba%40example.com"},
+		{"https://example.com/unsubscribe", "news@example.com", "https://example.com/unsubscribe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			if got := unsubscribeURL(tt.template, tt.sender); got != tt.want {
+				t.Errorf("unsubscribeURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddUnsubscribeFooter(t *testing.T) {
+	const link = "https://example.com/unsubscribe?a=1&b=2"
+	footer := `<p style="font-size:12px;color:#666">To unsubscribe, visit <a href="https://example.com/unsubscribe?a=1&amp;b=2">https://example.com/unsubscribe?a=1&amp;b=2</a></p>`
+	tests := []struct {
+		name    string
+		content string
+		isHTML  bool
+		want    string
+	}{
+		{"text", "hello\n\n", false, "hello\n\n--\nUnsubscribe: " + link + "\n"},
+		{"html document", "<html><body><p>hello</p></BODY></html>", true, "<html><body><p>hello</p>" + footer + "</BODY></html>"},
+		{"html fragment", "<p>hello</p>", true, "<p>hello</p>" + footer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addUnsubscribeFooter(tt.content, link, tt.isHTML); got != tt.want {
+				t.Errorf("addUnsubscribeFooter() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// PreSendHook runs before a message is handed to the mail server, returning an error aborts the send
+// with a 422 carrying the error message
+type PreSendHook func(ctx context.Context, env *Envelope) error
+
+// PostSendHook runs after every send attempt for side effects such as notifications,
+// it can't change the response to the client
+type PostSendHook func(ctx context.Context, env *Envelope, result SendResult)
+
+// Hooks are the operator's custom steps around every send
+type Hooks struct {
+	PreSend  []PreSendHook
+	PostSend []PostSendHook
+}
+
+// sendHooks are run by the mail handler, add operator specific hooks here
+var sendHooks Hooks
+
+// SendResult is the outcome of a send attempt passed to the post-send hooks
+type SendResult struct {
+	Response string // text of the mail server's final reply, empty when the send failed
+	Err      error  // why the send failed, nil on success
+}
+
+// Envelope is the message about to be sent, hooks may change the envelope sender and recipients too
+type Envelope struct {
+	Principal  string   // authenticated username
+	From       string   // envelope sender
+	Recipients []string // every RCPT, including Bcc
+
+	msg *message
+}
+
+// Header returns the value of the first top level header with the name, or "" when there is none
+func (e *Envelope) Header(name string) string {
+	for _, h := range e.msg.headers {
+		if strings.EqualFold(h.name, name) {
+			return h.value
+		}
+	}
+	return ""
+}
+
+// SetHeader replaces the value of the header with the name, or adds it when there is none
+func (e *Envelope) SetHeader(name, value string) error {
+	if err := sanitizeHeaderValue(name + value); err != nil {
+		return err
+	}
+	for i, h := range e.msg.headers {
+		if strings.EqualFold(h.name, name) {
+			e.msg.headers[i].value = value
+			return nil
+		}
+	}
+	e.msg.addHeader(name, value)
+	return nil
+}
+
+// runPreSend runs the pre-send hooks in order, stopping at the first error
+func (h Hooks) runPreSend(ctx context.Context, env *Envelope) error {
+	for _, hook := range h.PreSend {
+		if err := hook(ctx, env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPostSend runs the post-send hooks in order in the background, so they don't delay the response.
+// A panicking hook is logged and doesn't stop the others.
+func (h Hooks) runPostSend(ctx context.Context, env *Envelope, result SendResult) {
+	if len(h.PostSend) == 0 {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		for _, hook := range h.PostSend {
+			func() {
+				defer func() {
+					if p := recover(); p != nil {
+						requestLogger(ctx).Error("Post-send hook panicked", "panic", p)
+					}
+				}()
+				hook(ctx, env, result)
+			}()
+		}
+	}()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvelopeSetHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"replace", "subject", "changed", "changed", false},
+		{"add", "X-Tenant", "acme", "acme", false},
+		{"injection", "X-Tenant", "acme\r\nBcc: victim@example.com", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &message{}
+			msg.addHeader("Subject", "hi")
+			env := &Envelope{msg: msg}
+			if err := env.SetHeader(tt.header, tt.value); (err != nil) != tt.wantErr {
+				t.Fatalf("SetHeader() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			if got := env.Header(tt.header); got != tt.want {
+				t.Errorf("Header(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+			if strings.Contains(string(msg.bytes()), "victim") {
+				t.Error("the rejected value was written to the message")
+			}
+		})
+	}
+}
+
+func TestPreSendHooks(t *testing.T) {
+	tests := []struct {
+		name     string
+		hooks    []PreSendHook
+		wantCode string
+		wantSent string
+	}{
+		{"changes the message", []PreSendHook{func(ctx context.Context, env *Envelope) error {
+			env.Recipients = append(env.Recipients, "archive@example.com")
+			return env.SetHeader("X-Tenant", "acme")
+		}}, "", "X-Tenant: acme"},
+		{"rejects the message", []PreSendHook{
+			func(ctx context.Context, env *Envelope) error { return errors.New("blocked by policy") },
+			func(ctx context.Context, env *Envelope) error { panic("runs after a rejection") },
+		}, "pre_send_rejected", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, nil)
+			emailReq := &EmailRequest{To: []string{"to@example.com"}, Subject: "hi", Content: "hello"}
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/mail/send", nil)
+			prepared, ok := prepareMessage(rec, req, emailReq, "user@example.com", cfg, newTestRateLimiter(t, 10, nil), Hooks{PreSend: tt.hooks})
+			if tt.wantCode != "" {
+				if ok || rec.Code != errorStatus(tt.wantCode) || !strings.Contains(rec.Body.String(), tt.wantCode) {
+					t.Errorf("got %d %s, want %s", rec.Code, rec.Body, tt.wantCode)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("prepareMessage() refused the message: %d %s", rec.Code, rec.Body)
+			}
+			if !strings.Contains(messageHeaders(prepared.data), tt.wantSent) {
+				t.Errorf("%q missing from the message:\n%s", tt.wantSent, prepared.data)
+			}
+			if got := strings.Join(prepared.env.Recipients, ","); got != "to@example.com,archive@example.com" {
+				t.Errorf("recipients = %s, want the one the hook added", got)
+			}
+		})
+	}
+}
+
+func TestRunPostSendRecoversPanics(t *testing.T) {
+	results := make(chan SendResult, 1)
+	hooks := Hooks{PostSend: []PostSendHook{
+		func(ctx context.Context, env *Envelope, result SendResult) { panic("broken hook") },
+		func(ctx context.Context, env *Envelope, result SendResult) { results <- result },
+	}}
+	hooks.runPostSend(context.Background(), &Envelope{msg: &message{}}, SendResult{Response: "250 ok"})
+
+	select {
+	case result := <-results:
+		if result.Response != "250 ok" {
+			t.Errorf("Response = %q, want the send's", result.Response)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the hook after a panicking one never ran")
+	}
+}
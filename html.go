@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// HTMLPolicy selects how HTML bodies are cleaned and checked before sending
+type HTMLPolicy struct {
+	StripTracking bool   `json:"strip_tracking"`
+	StripScripts  bool   `json:"strip_scripts"`
+	Validation    string `json:"validation"` // off, warn or reject
+}
+
+// LoadHTMLPolicies reads named HTML policies from a JSON file mapping names to policies
+func LoadHTMLPolicies(path string) (map[string]*HTMLPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HTML policies file: %w", err)
+	}
+
+	var policies map[string]*HTMLPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("failed to parse HTML policies file: %w", err)
+	}
+
+	for name, policy := range policies {
+		if policy == nil {
+			policies[name] = &HTMLPolicy{Validation: "off"}
+			continue
+		}
+		switch policy.Validation {
+		case "":
+			policy.Validation = "off"
+		case "off", "warn", "reject":
+		default:
+			return nil, fmt.Errorf("HTML policy %s: invalid validation %q, expected off, warn or reject", name, policy.Validation)
+		}
+	}
+	return policies, nil
+}
+
+// criticalTags are the elements whose missing end tag can break the layout of the whole message
+var criticalTags = map[string]bool{
+	"html":   true,
+	"head":   true,
+	"body":   true,
+	"title":  true,
+	"style":  true,
+	"script": true,
+	"table":  true,
+	"div":    true,
+	"a":      true,
+	"ul":     true,
+	"ol":     true,
+}
+
+// tagPattern matches comments and start or end tags, capturing the slash and the tag name
+var tagPattern = regexp.MustCompile(`<!--[\s\S]*?-->|<(/?)([a-zA-Z][a-zA-Z0-9-]*)\b[^>]*>`)
+
+// checkHTML returns the problems found with critical tags in the HTML content, nil when it is well-formed
+func checkHTML(content string) []string {
+	var problems []string
+	var open []string
+
+	pos := 0
+	for {
+		loc := tagPattern.FindStringSubmatchIndex(content[pos:])
+		if loc == nil {
+			break
+		}
+		start, end := pos+loc[0], pos+loc[1]
+		pos = end
+
+		// Comments have no name group
+		if loc[4] < 0 {
+			continue
+		}
+		name := strings.ToLower(content[start+loc[4]-loc[0] : start+loc[5]-loc[0]])
+		closing := loc[3] > loc[2]
+		selfClosing := strings.HasSuffix(content[start:end], "/>")
+		if !criticalTags[name] || selfClosing {
+			continue
+		}
+
+		if !closing {
+			open = append(open, name)
+
+			// Script and style contents are raw text, jump straight to their end tag
+			if name == "script" || name == "style" {
+				closeAt := strings.Index(strings.ToLower(content[pos:]), "</"+name)
+				if closeAt < 0 {
+					break
+				}
+				pos += closeAt
+			}
+			continue
+		}
+
+		// Find the matching start tag, anything opened after it was never closed
+		match := -1
+		for i := len(open) - 1; i >= 0; i-- {
+			if open[i] == name {
+				match = i
+				break
+			}
+		}
+		if match < 0 {
+			problems = append(problems, fmt.Sprintf("unexpected </%s> without a matching <%s>", name, name))
+			continue
+		}
+		for _, unclosed := range open[match+1:] {
+			problems = append(problems, fmt.Sprintf("<%s> is not closed before </%s>", unclosed, name))
+		}
+		open = open[:match]
+	}
+
+	for _, unclosed := range open {
+		problems = append(problems, fmt.Sprintf("<%s> is never closed", unclosed))
+	}
+	return problems
+}
+
+// scriptPattern matches script elements including their content
+var scriptPattern = regexp.MustCompile(`(?is)<script\b.*?</script\s*>`)
+
+// startTagPattern matches start tags with their attributes
+var startTagPattern = regexp.MustCompile(`<[a-zA-Z][^>]*>`)
+
+// eventAttrPattern matches inline event handler attributes such as onclick
+var eventAttrPattern = regexp.MustCompile(`(?i)\s+on[a-z]+\s*=\s*(?:"[^"]*"|'[^']*'|[^\s>]+)`)
+
+// stripScripts removes script elements and inline event handlers from HTML content
+func stripScripts(content string) string {
+	content = scriptPattern.ReplaceAllString(content, "")
+	return startTagPattern.ReplaceAllStringFunc(content, func(tag string) string {
+		return eventAttrPattern.ReplaceAllString(tag, "")
+	})
+}
+
+// imgPattern matches image tags
+var imgPattern = regexp.MustCompile(`(?i)<img\b[^>]*>`)
+
+// sizePattern captures the width and height of an image from its attributes or inline style
+var sizePattern = regexp.MustCompile(`(?i)\b(width|height)\s*[=:]\s*["']?\s*(\d+)`)
+
+// hrefPattern matches quoted link targets, capturing the prefix and the double or single quoted URL
+var hrefPattern = regexp.MustCompile(`(?i)(\bhref\s*=\s*)(?:"([^"]*)"|'([^']*)')`)
+
+// stripTracking removes 1x1 tracking pixels and utm_* query parameters from links in HTML content
+func stripTracking(content string) string {
+	content = imgPattern.ReplaceAllStringFunc(content, func(img string) string {
+		if isTrackingPixel(img) {
+			return ""
+		}
+		return img
+	})
+
+	return hrefPattern.ReplaceAllStringFunc(content, func(attr string) string {
+		parts := hrefPattern.FindStringSubmatch(attr)
+		if strings.HasSuffix(attr, "'") {
+			return parts[1] + "'" + stripUTMParams(parts[3]) + "'"
+		}
+		return parts[1] + `"` + stripUTMParams(parts[2]) + `"`
+	})
+}
+
+// isTrackingPixel reports whether an image tag is sized 1x1 pixel or smaller
+func isTrackingPixel(img string) bool {
+	sizes := map[string]bool{}
+	for _, match := range sizePattern.FindAllStringSubmatch(img, -1) {
+		dimension := strings.ToLower(match[1])
+		sizes[dimension] = match[2] == "0" || match[2] == "1"
+	}
+	return len(sizes) == 2 && sizes["width"] && sizes["height"]
+}
+
+// stripUTMParams drops utm_* parameters from the query of a link, keeping the rest of the URL as written
+func stripUTMParams(link string) string {
+	base, query, found := strings.Cut(link, "?")
+	if !found {
+		return link
+	}
+	query, fragment, hasFragment := strings.Cut(query, "#")
+
+	// Links inside HTML attributes usually escape the separator as &amp;
+	separator := "&"
+	if strings.Contains(query, "&amp;") {
+		separator = "&amp;"
+	}
+
+	var kept []string
+	for _, param := range strings.Split(query, separator) {
+		if param != "" && !strings.HasPrefix(strings.ToLower(param), "utm_") {
+			kept = append(kept, param)
+		}
+	}
+
+	result := base
+	if len(kept) > 0 {
+		result += "?" + strings.Join(kept, separator)
+	}
+	if hasFragment {
+		result += "#" + fragment
+	}
+	return result
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckHTML(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"well-formed", "<html><body><div><p>hi<br></div></body></html>", nil},
+		{"non-critical tags ignored", "<p>one<p>two<span>three", nil},
+		{"self-closing", `<div/><a href="x">link</a>`, nil},
+		{"comment", "<!-- <div> --><p>hi</p>", nil},
+		{"script content is raw text", "<script>if (a < b) { x = '<div>' }</script>", nil},
+		{"never closed", "<table><tr><td>hi</td></tr>", []string{"<table> is never closed"}},
+		{"closed out of order", "<div><a href='x'>link</div></a>", []string{
+			"<a> is not closed before </div>",
+			"unexpected </a> without a matching <a>",
+		}},
+		{"unclosed script", "<script>alert(1)", []string{"<script> is never closed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkHTML(tt.content)
+			if strings.Join(got, "; ") != strings.Join(tt.want, "; ") {
+				t.Errorf("checkHTML() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripTracking(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"tracking pixel", `<p>hi</p><img src="https://t.example.com/open.gif" width="1" height="1">`, `<p>hi</p>`},
+		{"pixel sized by style", `<img src="x.gif" style="width:0;height:0">`, ``},
+		{"normal image kept", `<img src="logo.png" width="120" height="1">`, `<img src="logo.png" width="120" height="1">`},
+		{"image without size kept", `<img src="logo.png">`, `<img src="logo.png">`},
+		{"utm parameters", `<a href="https://example.com/?utm_source=mail&id=7&utm_medium=email">x</a>`, `<a href="https://example.com/?id=7">x</a>`},
+		{"escaped separator", `<a href="https://example.com/?id=7&amp;utm_campaign=fall">x</a>`, `<a href="https://example.com/?id=7">x</a>`},
+		{"only utm parameters", `<a href='https://example.com/page?utm_source=mail#top'>x</a>`, `<a href='https://example.com/page#top'>x</a>`},
+		{"no query", `<a href="https://example.com/">x</a>`, `<a href="https://example.com/">x</a>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripTracking(tt.content); got != tt.want {
+				t.Errorf("stripTracking() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripScripts(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"script element", `<p>hi</p><script type="text/javascript">alert(1)</script>`, `<p>hi</p>`},
+		{"upper case script", `<SCRIPT>alert(1)</SCRIPT ><p>hi</p>`, `<p>hi</p>`},
+		{"event handlers", `<a href="x" onclick="steal()" ONMOUSEOVER='x()'>link</a>`, `<a href="x">link</a>`},
+		{"unquoted handler", `<img src="a.png" onerror=steal()>`, `<img src="a.png">`},
+		{"text mentioning onclick kept", `<p>use onclick= wisely</p>`, `<p>use onclick= wisely</p>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripScripts(tt.content); got != tt.want {
+				t.Errorf("stripScripts() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadHTMLPolicies(t *testing.T) {
+	tests := []struct {
+		name           string
+		data           string
+		wantValidation string
+		wantErr        bool
+	}{
+		{"valid", `{"strict": {"strip_scripts": true, "validation": "reject"}}`, "reject", false},
+		{"validation defaults to off", `{"strict": {"strip_scripts": true}}`, "off", false},
+		{"empty policy", `{"strict": null}`, "off", false},
+		{"invalid validation", `{"strict": {"validation": "maybe"}}`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "policies.json")
+			if err := os.WriteFile(path, []byte(tt.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			policies, err := LoadHTMLPolicies(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadHTMLPolicies() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			if err == nil && policies["strict"].Validation != tt.wantValidation {
+				t.Errorf("Validation = %q, want %q", policies["strict"].Validation, tt.wantValidation)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Job statuses reported by /mail/jobs/{id}
+const (
+	jobPending = "pending"
+	jobSent    = "sent"
+	jobFailed  = "failed"
+)
+
+// asyncJob is a send accepted with async=true, processed by a worker of the JobPool
+type asyncJob struct {
+	ID           string     `json:"job_id"`
+	Status       string     `json:"status"`
+	MessageID    string     `json:"message_id"`
+	SMTPResponse string     `json:"smtp_response,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	Created      time.Time  `json:"created"`
+	Finished     *time.Time `json:"finished,omitempty"`
+
+	// QueuePosition is 1 for the next job a worker takes, it is left out once the job is being sent
+	QueuePosition int `json:"queue_position,omitempty"`
+	// EstimatedSendTime is when a worker should get to a waiting job, known once a job was sent
+	EstimatedSendTime *time.Time `json:"estimated_send_time,omitempty"`
+
+	owner   [sha256.Size]byte // hash of the credentials that submitted the job
+	send    func() (string, error)
+	seq     uint64 // jobs submitted before this one
+	running bool
+}
+
+// JobPool runs asynchronous sends on a fixed number of workers. Jobs wait in a bounded queue and finished
+// jobs are kept for ttl so their status can be queried.
+type JobPool struct {
+	queue chan *asyncJob
+	ttl   time.Duration
+
+	mutex     sync.Mutex
+	jobs      map[string]*asyncJob
+	lastSweep time.Time
+	closed    bool
+
+	// Jobs leave the queue in the order they were submitted, so started tells how far the queue moved
+	submitted   uint64
+	started     uint64
+	sendTime    time.Duration // moving average of the time a send takes, 0 until the first one
+	workerCount int
+
+	workers sync.WaitGroup
+}
+
+// NewJobPool starts workers processing a queue of at most queueSize waiting jobs
+func NewJobPool(workers, queueSize int, ttl time.Duration) *JobPool {
+	p := &JobPool{
+		queue:       make(chan *asyncJob, queueSize),
+		ttl:         ttl,
+		jobs:        make(map[string]*asyncJob),
+		workerCount: workers,
+	}
+	for range workers {
+		p.workers.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// credentialsHash identifies the owner of a job without keeping the password
+func credentialsHash(username, password string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(username + "\x00" + password))
+}
+
+// Submit queues send for a worker and returns a copy of the job. It reports false when the queue is full.
+func (p *JobPool) Submit(username, password, messageID string, send func() (string, error)) (asyncJob, bool) {
+	job := &asyncJob{
+		ID:        newRequestID(),
+		Status:    jobPending,
+		MessageID: messageID,
+		Created:   time.Now().UTC(),
+		owner:     credentialsHash(username, password),
+		send:      send,
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return asyncJob{}, false
+	}
+	job.seq = p.submitted
+	select {
+	case p.queue <- job:
+	default:
+		return asyncJob{}, false
+	}
+	p.submitted++
+	now := time.Now()
+	p.sweep(now)
+	p.jobs[job.ID] = job
+	return p.progress(job, now), true
+}
+
+// Get returns a copy of the job when it exists and was submitted with the same credentials
+func (p *JobPool) Get(id, username, password string) (asyncJob, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	job, ok := p.jobs[id]
+	if !ok {
+		return asyncJob{}, false
+	}
+	owner := credentialsHash(username, password)
+	if subtle.ConstantTimeCompare(job.owner[:], owner[:]) != 1 {
+		return asyncJob{}, false
+	}
+	return p.progress(job, time.Now()), true
+}
+
+// progress returns a copy of the job with its place in the queue while it waits. The caller must hold
+// the mutex.
+func (p *JobPool) progress(job *asyncJob, now time.Time) asyncJob {
+	progress := *job
+	if job.Status != jobPending || job.running {
+		return progress
+	}
+	progress.QueuePosition = int(job.seq-p.started) + 1
+	if p.sendTime > 0 {
+		rounds := (progress.QueuePosition + p.workerCount - 1) / p.workerCount
+		estimate := now.Add(time.Duration(rounds) * p.sendTime).UTC().Truncate(time.Second)
+		progress.EstimatedSendTime = &estimate
+	}
+	return progress
+}
+
+// Close stops accepting jobs and waits for the workers to finish the queued ones or for ctx to be done.
+// It returns the number of jobs left unfinished.
+func (p *JobPool) Close(ctx context.Context) int {
+	p.mutex.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mutex.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		p.workers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return 0
+	case <-ctx.Done():
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var pending int
+	for _, job := range p.jobs {
+		if job.Status == jobPending {
+			pending++
+		}
+	}
+	return pending
+}
+
+// work sends queued jobs until the queue is closed
+func (p *JobPool) work() {
+	defer p.workers.Done()
+	for job := range p.queue {
+		p.mutex.Lock()
+		p.started++
+		job.running = true
+		p.mutex.Unlock()
+
+		start := time.Now()
+		response, err := job.send()
+
+		finished := time.Now().UTC()
+		p.mutex.Lock()
+		if took := finished.Sub(start); p.sendTime == 0 {
+			p.sendTime = took
+		} else {
+			p.sendTime = (p.sendTime*4 + took) / 5
+		}
+		job.Finished = &finished
+		if err != nil {
+			job.Status, job.Error = jobFailed, err.Error()
+		} else {
+			job.Status, job.SMTPResponse = jobSent, response
+		}
+		job.send = nil
+		p.mutex.Unlock()
+	}
+}
+
+// sweep drops jobs finished more than ttl ago at most once a minute. The caller must hold the mutex.
+func (p *JobPool) sweep(now time.Time) {
+	if now.Sub(p.lastSweep) < time.Minute {
+		return
+	}
+	p.lastSweep = now
+	for id, job := range p.jobs {
+		if job.Finished != nil && now.Sub(*job.Finished) > p.ttl {
+			delete(p.jobs, id)
+		}
+	}
+}
+
+// GetJobHandler serves the status of an asynchronous send to the user that submitted it
+func GetJobHandler(jobs *JobPool, cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+
+		username, password, authErr := parseBasicAuth(r.Header.Get("Authorization"), cfg.MaxCredentialsBytes)
+		if authErr != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mail-api"`)
+			writeError(w, authErr.code, authErr.message)
+			return
+		}
+
+		// Jobs of other users are reported as missing so their IDs can't be probed
+		job, ok := jobs.Get(r.PathValue("id"), username, password)
+		if !ok {
+			writeError(w, "job_not_found", "No job with this ID")
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	}
+}
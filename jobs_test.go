@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForJob polls the job until done reports true for it
+func waitForJob(t *testing.T, pool *JobPool, id string, done func(asyncJob) bool) asyncJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, ok := pool.Get(id, "user", "secret")
+		if !ok {
+			t.Fatalf("job %s not found", id)
+		}
+		if done(job) {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s never got there: %+v", id, job)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestJobPoolQueuePosition(t *testing.T) {
+	pool := NewJobPool(1, 10, time.Hour)
+	release := make(chan struct{})
+	defer close(release)
+
+	// The first job gives the pool a send time, the second holds the only worker
+	first, _ := pool.Submit("user", "secret", "<1@example.com>", func() (string, error) {
+		time.Sleep(20 * time.Millisecond)
+		return "ok", nil
+	})
+	waitForJob(t, pool, first.ID, func(job asyncJob) bool { return job.Status == jobSent })
+	blocking, _ := pool.Submit("user", "secret", "<2@example.com>", func() (string, error) {
+		<-release
+		return "ok", nil
+	})
+	running := waitForJob(t, pool, blocking.ID, func(job asyncJob) bool { return job.QueuePosition == 0 })
+
+	var waiting []asyncJob
+	for range 2 {
+		job, ok := pool.Submit("user", "secret", "<3@example.com>", func() (string, error) { return "ok", nil })
+		if !ok {
+			t.Fatal("Submit() refused a job")
+		}
+		waiting = append(waiting, job)
+	}
+
+	tests := []struct {
+		name         string
+		job          asyncJob
+		wantPosition int
+		wantEstimate bool
+	}{
+		{"being sent", running, 0, false},
+		{"next", waiting[0], 1, true},
+		{"second", waiting[1], 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job, _ := pool.Get(tt.job.ID, "user", "secret")
+			for _, got := range []asyncJob{tt.job, job} {
+				if got.QueuePosition != tt.wantPosition {
+					t.Errorf("QueuePosition = %d, want %d", got.QueuePosition, tt.wantPosition)
+				}
+				if (got.EstimatedSendTime != nil) != tt.wantEstimate {
+					t.Errorf("EstimatedSendTime = %v, want one: %v", got.EstimatedSendTime, tt.wantEstimate)
+				}
+			}
+		})
+	}
+}
+
+func TestJobPoolQueueFull(t *testing.T) {
+	pool := NewJobPool(1, 1, time.Hour)
+	release := make(chan struct{})
+	blocking, _ := pool.Submit("user", "secret", "<1@example.com>", func() (string, error) {
+		<-release
+		return "ok", nil
+	})
+	waitForJob(t, pool, blocking.ID, func(job asyncJob) bool { return job.QueuePosition == 0 })
+
+	send := func() (string, error) { return "ok", nil }
+	if _, ok := pool.Submit("user", "secret", "<2@example.com>", send); !ok {
+		t.Fatal("Submit() refused a job with room in the queue")
+	}
+	if _, ok := pool.Submit("user", "secret", "<3@example.com>", send); ok {
+		t.Error("Submit() accepted a job beyond the queue size")
+	}
+
+	// The job being sent and the queued one are both still pending when Close gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if pending := pool.Close(ctx); pending != 2 {
+		t.Errorf("Close() = %d pending, want 2", pending)
+	}
+	if _, ok := pool.Submit("user", "secret", "<4@example.com>", send); ok {
+		t.Error("Submit() accepted a job after Close()")
+	}
+	close(release)
+	if pending := pool.Close(context.Background()); pending != 0 {
+		t.Errorf("Close() once the jobs finished = %d pending, want 0", pending)
+	}
+}
+
+func TestGetJobHandler(t *testing.T) {
+	cfg := newTestConfig(t, nil, nil)
+	pool := NewJobPool(1, 10, time.Hour)
+	defer pool.Close(context.Background())
+	job, _ := pool.Submit("user", "secret", "<1@example.com>", func() (string, error) { return "2.0.0 Ok: queued", nil })
+	waitForJob(t, pool, job.ID, func(job asyncJob) bool { return job.Status == jobSent })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mail/jobs/{id}", GetJobHandler(pool, cfg))
+	tests := []struct {
+		name       string
+		method     string
+		id         string
+		password   string
+		wantStatus int
+	}{
+		{"owner", http.MethodGet, job.ID, "secret", http.StatusOK},
+		{"other credentials", http.MethodGet, job.ID, "guessed", errorStatus("job_not_found")},
+		{"unknown job", http.MethodGet, "missing", "secret", errorStatus("job_not_found")},
+		{"post", http.MethodPost, job.ID, "secret", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/mail/jobs/"+tt.id, nil)
+			req.SetBasicAuth("user", tt.password)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got asyncJob
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != job.ID || got.Status != jobSent || got.SMTPResponse != "2.0.0 Ok: queued" || got.Finished == nil {
+				t.Errorf("job = %+v, want it sent", got)
+			}
+		})
+	}
+}
+
+func TestMailHandlerAsync(t *testing.T) {
+	const body = `{"to":["to@example.com"],"subject":"hi","content":"hello"}`
+	tests := []struct {
+		name       string
+		workers    int // 0 leaves async sends disabled
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"accepted", 1, body, http.StatusAccepted, ""},
+		{"disabled", 0, body, errorStatus("async_disabled"), "async_disabled"},
+		{"per recipient", 1, `{"to":["to@example.com"],"subject":"hi","content":"hello","per_recipient":true}`,
+			errorStatus("async_unsupported"), "async_unsupported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, nil)
+			mailer := &fakeMailer{}
+			var pool *JobPool
+			if tt.workers > 0 {
+				pool = NewJobPool(tt.workers, 10, time.Hour)
+				defer pool.Close(context.Background())
+			}
+			handler := GetMailHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), mailer, cfg, nopUsageRecorder{}, Hooks{}, nil, pool)
+			req := httptest.NewRequest(http.MethodPost, "/mail/send?async=true", strings.NewReader(tt.body))
+			req.SetBasicAuth("user@example.com", "secret")
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.wantCode) {
+				t.Fatalf("got %d %s, want %d %s", rec.Code, rec.Body, tt.wantStatus, tt.wantCode)
+			}
+			if tt.wantCode != "" {
+				return
+			}
+
+			var response struct {
+				Status string `json:"status"`
+				JobID  string `json:"job_id"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Status != "accepted" || response.JobID == "" {
+				t.Fatalf("response = %s, want an accepted job", rec.Body)
+			}
+			job, ok := pool.Get(response.JobID, "user@example.com", "secret")
+			for deadline := time.Now().Add(5 * time.Second); ok && job.Status == jobPending && time.Now().Before(deadline); {
+				time.Sleep(5 * time.Millisecond)
+				job, ok = pool.Get(response.JobID, "user@example.com", "secret")
+			}
+			if !ok || job.Status != jobSent {
+				t.Fatalf("job = %+v, want it sent", job)
+			}
+			if len(mailer.submissions) != 1 || mailer.submissions[0].To[0] != "to@example.com" {
+				t.Errorf("submissions = %+v, want the message sent to to@example.com", mailer.submissions)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want any
+	}{
+		{"with a request ID", context.WithValue(context.Background(), requestIDKey{}, "abc"), "abc"},
+		{"without a request ID", context.Background(), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			requestLogger(tt.ctx).Info("hello")
+			var line map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+				t.Fatal(err)
+			}
+			if line["request_id"] != tt.want {
+				t.Errorf("request_id = %v, want %v", line["request_id"], tt.want)
+			}
+		})
+	}
+}
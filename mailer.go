@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+// errInvalidCredentials is returned by Verify when the username or password is wrong
+var errInvalidCredentials = errors.New("invalid username or password")
+
+// Mailer hands assembled messages to a mail server
+type Mailer interface {
+	Send(ctx context.Context, submission *Submission) (*sendResult, error)
+	batchMailer
+}
+
+// Submission is a message ready to be sent on behalf of an authenticated user
+type Submission struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"` // envelope sender
+	To       []string `json:"to"`   // every RCPT, including Bcc
+	Message  []byte   `json:"message"`
+
+	// Require8BitMIME rejects the send when the server can't carry an 8bit body
+	Require8BitMIME bool `json:"require_8bitmime"`
+}
+
+// SMTPMailer sends messages to the configured mail servers, authenticating with the user's
+// credentials, or to the local relay when SMTP authentication is disabled
+type SMTPMailer struct {
+	cfg    *Config
+	router Router
+}
+
+// NewSMTPMailer creates a mailer for the mail server settings of cfg, routing between SMTPHosts
+// with the SMTPRouting strategy
+func NewSMTPMailer(cfg *Config) *SMTPMailer {
+	return &SMTPMailer{cfg: cfg, router: newRouter(cfg.SMTPRouting, cfg.SMTPHosts)}
+}
+
+// Verify checks the user's credentials, with the mail server or against the API password
+// when SMTP authentication is disabled
+func (m *SMTPMailer) Verify(ctx context.Context, username, password string) error {
+	if !m.cfg.SMTPAuth {
+		if !m.cfg.principal(username).CheckAPIPassword(password) {
+			return errInvalidCredentials
+		}
+		return nil
+	}
+	err := m.eachHost(ctx, username, nil, func(smtpAddr string) (bool, error) {
+		host, _, _ := net.SplitHostPort(smtpAddr)
+		ctx := ctx
+		if m.cfg.SMTPTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, m.cfg.SMTPTimeout)
+			defer cancel()
+		}
+		err := checkAuth(ctx, smtpAddr, smtp.PlainAuth("", username, password, host), sendOptions{
+			authBeforeStartTLS: m.cfg.SMTPAuthOrder == "auth-first",
+			ehloHostname:       m.cfg.ehloHostname(username),
+		})
+		return isTransientSendError(err), err
+	})
+
+	// 535 is the reply to rejected credentials, other errors mean the server couldn't be asked
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code == 535 {
+		return errInvalidCredentials
+	}
+	return err
+}
+
+// Send delivers the submission over SMTP. Every mail server tried gets its own SMTP_TIMEOUT.
+func (m *SMTPMailer) Send(ctx context.Context, submission *Submission) (*sendResult, error) {
+	var result *sendResult
+	err := m.eachHost(ctx, submission.From, submission.To, func(smtpAddr string) (bool, error) {
+		ctx := ctx
+		if m.cfg.SMTPTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, m.cfg.SMTPTimeout)
+			defer cancel()
+		}
+
+		auth, opts := m.session(submission.Username, submission.Password, smtpAddr)
+		opts.require8BitMIME = submission.Require8BitMIME
+		var err error
+		result, err = sendMail(ctx, smtpAddr, auth, submission.From, submission.To, submission.Message, opts)
+		return isTransientSendError(err), err
+	})
+	return result, err
+}
+
+// batchResponseMargin is kept between the end of a batch session and the deadline of its request, so the
+// handler still reports which messages were sent before the endpoint timeout answers instead
+const batchResponseMargin = time.Second
+
+// SendBatch delivers the messages of one user over a single session. The session gets SMTP_TIMEOUT per
+// message, cut short to end batchResponseMargin before the request's deadline. Messages the session
+// didn't reach then fail with errSMTPTimeout. The next mail server is only tried when none of the
+// messages could be sent to the previous one.
+func (m *SMTPMailer) SendBatch(ctx context.Context, username, password string, items []*batchItem) error {
+	var deadline time.Time
+	if m.cfg.SMTPTimeout > 0 {
+		deadline = time.Now().Add(m.cfg.SMTPTimeout * time.Duration(len(items)))
+	}
+	if requestDeadline, ok := ctx.Deadline(); ok {
+		if requestDeadline = requestDeadline.Add(-batchResponseMargin); deadline.IsZero() || requestDeadline.Before(deadline) {
+			deadline = requestDeadline
+		}
+	}
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	return m.eachHost(ctx, username, nil, func(smtpAddr string) (bool, error) {
+		auth, opts := m.session(username, password, smtpAddr)
+		err := sendBatch(ctx, smtpAddr, auth, items, opts)
+		return len(items) > 0 && !items[0].done && isTransientSendError(err), err
+	})
+}
+
+// hosts returns the addresses of the mail servers to try for the envelope in order, the local relay
+// alone when SMTP authentication is disabled
+func (m *SMTPMailer) hosts(from string, to []string) []string {
+	if !m.cfg.SMTPAuth {
+		return []string{m.cfg.SMTPRelayAddr}
+	}
+	return m.router.Route(from, to)
+}
+
+// eachHost calls send with the mail servers of the envelope until one doesn't fail or send reports the
+// failure must not be retried on the next server, e.g because some of the message was already delivered
+func (m *SMTPMailer) eachHost(ctx context.Context, from string, to []string, send func(smtpAddr string) (failover bool, err error)) error {
+	hosts := m.hosts(from, to)
+	var err error
+	for i, smtpAddr := range hosts {
+		var failover bool
+		if failover, err = send(smtpAddr); err == nil || !failover || i == len(hosts)-1 {
+			return err
+		}
+		requestLogger(ctx).Warn("Mail server failed, trying the next one", "smtp_host", smtpAddr, "next", hosts[i+1], "error", err)
+	}
+	return err
+}
+
+// session returns the authentication and options of the user's SMTP sessions with the mail server at smtpAddr
+func (m *SMTPMailer) session(username, password, smtpAddr string) (smtp.Auth, sendOptions) {
+	opts := sendOptions{
+		authBeforeStartTLS:          m.cfg.SMTPAuthOrder == "auth-first",
+		maxRecipientsPerTransaction: m.cfg.MaxRecipientsPerTransaction,
+		groupByDomain:               m.cfg.GroupRecipientsByDomain,
+		ehloHostname:                m.cfg.ehloHostname(username),
+	}
+	if !m.cfg.SMTPAuth {
+		// The local relay accepts mail without authentication, TLS adds nothing on the same box
+		opts.skipStartTLS = true
+		return nil, opts
+	}
+	host, _, _ := net.SplitHostPort(smtpAddr)
+	return smtp.PlainAuth("", username, password, host), opts
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A batch cut short by the request deadline ends in time for the handler to respond, the messages it
+// didn't reach fail with errSMTPTimeout
+func TestSendBatchEndsBeforeRequestDeadline(t *testing.T) {
+	server := newFakeSMTP(t, "AUTH PLAIN")
+	server.dataDelay = 200 * time.Millisecond
+	cfg := newTestConfig(t, server, map[string]string{"SMTP_TIMEOUT": "30s"})
+
+	items := make([]*batchItem, 20)
+	for i := range items {
+		items[i] = &batchItem{from: "user@example.com", to: []string{"to@example.com"}, msg: []byte("Subject: hi\r\n\r\nhi\r\n")}
+	}
+	requestTimeout := batchResponseMargin + 500*time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := NewSMTPMailer(cfg).SendBatch(ctx, "user@example.com", "secret", items)
+	if elapsed := time.Since(start); elapsed > requestTimeout-batchResponseMargin/2 {
+		t.Errorf("SendBatch() took %v, want it to end %v before the request deadline", elapsed, batchResponseMargin)
+	}
+	if !errors.Is(err, errSMTPTimeout) {
+		t.Errorf("SendBatch() error = %v, want errSMTPTimeout", err)
+	}
+	var sent, timedOut int
+	for _, item := range items {
+		switch {
+		case item.done && item.err == nil:
+			sent++
+		case !item.done || errors.Is(item.err, errSMTPTimeout):
+			timedOut++
+		}
+	}
+	if sent == 0 || sent+timedOut != len(items) {
+		t.Errorf("got %d sent and %d timed out of %d, want some sent and the rest timed out", sent, timedOut, len(items))
+	}
+}
+
+func TestSMTPMailerSendTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeout     string
+		wantTimeout bool
+	}{
+		{"server slower than the timeout", "50ms", true},
+		{"timeout disabled", "0s", false},
+		{"server in time", "5s", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t, "AUTH PLAIN")
+			server.dataDelay = 200 * time.Millisecond
+			cfg := newTestConfig(t, server, map[string]string{"SMTP_TIMEOUT": tt.timeout})
+
+			_, err := NewSMTPMailer(cfg).Send(context.Background(), &Submission{
+				Username: "user@example.com",
+				Password: "secret",
+				From:     "user@example.com",
+				To:       []string{"to@example.com"},
+				Message:  []byte("Subject: hi\r\n\r\nhi\r\n"),
+			})
+			if errors.Is(err, errSMTPTimeout) != tt.wantTimeout {
+				t.Fatalf("Send() error = %v, want errSMTPTimeout: %v", err, tt.wantTimeout)
+			}
+			if !tt.wantTimeout && err != nil {
+				t.Errorf("Send() error = %v, want the message sent", err)
+			}
+		})
+	}
+}
+
+func TestSMTPMailerEHLOHostname(t *testing.T) {
+	principals := filepath.Join(t.TempDir(), "principals.json")
+	if err := os.WriteFile(principals, []byte(`{"tenant@example.com": {"ehlo_hostname": "mail.tenant.example"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		hostname string
+		username string
+		want     string
+	}{
+		{"default", "", "user@example.com", "localhost"},
+		{"configured", "api.example.com", "user@example.com", "api.example.com"},
+		{"principal override", "api.example.com", "tenant@example.com", "mail.tenant.example"},
+		{"principal override without a default", "", "tenant@example.com", "mail.tenant.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t, "AUTH PLAIN")
+			cfg := newTestConfig(t, server, map[string]string{"SMTP_EHLO_HOSTNAME": tt.hostname, "PRINCIPALS_FILE": principals})
+			_, err := NewSMTPMailer(cfg).Send(context.Background(), &Submission{
+				Username: tt.username,
+				Password: "secret",
+				From:     tt.username,
+				To:       []string{"to@example.com"},
+				Message:  []byte("Subject: hi\r\n\r\nhi\r\n"),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			server.mutex.Lock()
+			defer server.mutex.Unlock()
+			if len(server.ehlo) != 1 || server.ehlo[0] != tt.want {
+				t.Errorf("EHLO = %v, want %s", server.ehlo, tt.want)
+			}
+		})
+	}
+}
+
+// unusedAddr returns the address of a port nothing listens on
+func unusedAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+	return net.JoinHostPort("localhost", port)
+}
+
+func TestSMTPMailerRouting(t *testing.T) {
+	tests := []struct {
+		name      string
+		routing   string
+		firstDown bool
+		refuse    bool // the first server refuses the recipient
+		sends     int
+		want      []int // messages each server got
+		wantErr   bool
+	}{
+		{"failover sticks to the primary", "failover", false, false, 4, []int{4, 0}, false},
+		{"failover with the primary down", "failover", true, false, 2, []int{0, 2}, false},
+		{"round-robin alternates", "round-robin", false, false, 4, []int{2, 2}, false},
+		{"round-robin skips a server down", "round-robin", true, false, 4, []int{0, 4}, false},
+		{"refused message isn't sent elsewhere", "failover", false, true, 1, []int{0, 0}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := []*fakeSMTP{newFakeSMTP(t, "AUTH PLAIN"), newFakeSMTP(t, "AUTH PLAIN")}
+			if tt.refuse {
+				servers[0].rcptReplies["to@example.com"] = "550 5.1.1 no such user"
+			}
+			hosts := []string{servers[0].addr(), servers[1].addr()}
+			if tt.firstDown {
+				hosts[0] = unusedAddr(t)
+			}
+			cfg := newTestConfig(t, servers[1], map[string]string{"SMTP_HOSTS": strings.Join(hosts, ","), "SMTP_ROUTING": tt.routing})
+			mailer := NewSMTPMailer(cfg)
+
+			for i := 0; i < tt.sends; i++ {
+				result, err := mailer.Send(context.Background(), &Submission{
+					Username: "user@example.com",
+					Password: "secret",
+					From:     "user@example.com",
+					To:       []string{"to@example.com"},
+					Message:  []byte("Subject: hi\r\n\r\nhi\r\n"),
+				})
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("Send() error = %v, want an error: %v", err, tt.wantErr)
+				}
+				if err == nil && result.Host != "127.0.0.1" {
+					t.Errorf("Host = %q, want the server that took the message", result.Host)
+				}
+			}
+			for i, server := range servers {
+				if messages, _ := server.delivered(); len(messages) != tt.want[i] {
+					t.Errorf("server %d got %d messages, want %d", i, len(messages), tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// A batch that couldn't start on the primary is sent to the next server
+func TestSendBatchFailover(t *testing.T) {
+	server := newFakeSMTP(t, "AUTH PLAIN")
+	cfg := newTestConfig(t, server, map[string]string{"SMTP_HOSTS": unusedAddr(t) + "," + server.addr()})
+
+	items := []*batchItem{
+		{from: "user@example.com", to: []string{"a@example.com"}, msg: []byte("Subject: a\r\n\r\na\r\n")},
+		{from: "user@example.com", to: []string{"b@example.com"}, msg: []byte("Subject: b\r\n\r\nb\r\n")},
+	}
+	if err := NewSMTPMailer(cfg).SendBatch(context.Background(), "user@example.com", "secret", items); err != nil {
+		t.Fatalf("SendBatch() error = %v", err)
+	}
+	for i, item := range items {
+		if !item.done || item.err != nil {
+			t.Errorf("item %d done %v with error %v, want it sent", i, item.done, item.err)
+		}
+	}
+	if messages, _ := server.delivered(); len(messages) != len(items) {
+		t.Errorf("server got %d messages, want %d", len(messages), len(items))
+	}
+}
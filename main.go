@@ -1,24 +1,103 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math"
+	"mime"
 	"net/http"
-	"net/smtp"
+	"net/mail"
+	"os"
+	"os/signal"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
 )
 
+// appName identifies this API in the X-Mailer header
+const appName = "mail-in-a-box-rest-api"
+
+// version is the API version, override it at build time with -ldflags "-X main.version=..."
+var version = "1.0.0"
+
 // EmailRequest represents the structure of the incoming email request
 type EmailRequest struct {
 	To      []string `json:"to"`
+	Cc      []string `json:"cc,omitempty"`
+	Bcc     []string `json:"bcc,omitempty"` // receives the message without being listed in any header
 	Subject string   `json:"subject"`
 	Content string   `json:"content"`
-	Title   string   `json:"title,omitempty"` // it will handle from title e.g Title <sender email> in the receiver's inbox
+	Title   string   `json:"title,omitempty"`    // it will handle from title e.g Title <sender email> in the receiver's inbox
+	From    string   `json:"from,omitempty"`     // shared mailbox to send as, defaults to the authenticated user
+	ReplyTo string   `json:"reply_to,omitempty"` // address replies are sent to instead of the sender
+	// Content-Transfer-Encoding of the body: 7bit, 8bit, base64 or quoted-printable, the server's choice by default
+	Encoding string `json:"encoding,omitempty"`
+	// TextContent is a plain text version of an HTML content, both are sent as multipart/alternative
+	TextContent string `json:"text_content,omitempty"`
+	// HTML selects an HTML or plain text body, the content is inspected when it is omitted
+	HTML *bool `json:"html,omitempty"`
+	// ContentType is text/plain or text/html, it selects the body type like HTML does
+	ContentType string `json:"content_type,omitempty"`
+	// Headers are extra header fields such as X-Campaign-Id, rendered after the standard ones
+	Headers map[string]string `json:"headers,omitempty"`
+	// Attachments are sent as a multipart/mixed message after the body
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// PerRecipient sends a separate message to every recipient and reports the status of each
+	PerRecipient bool `json:"per_recipient,omitempty"`
+}
+
+// recipientStatus is the outcome of the delivery to a single recipient of a per_recipient send
+type recipientStatus struct {
+	Recipient    string `json:"recipient"`
+	Status       string `json:"status"` // sent or failed
+	SMTPResponse string `json:"smtp_response,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Limiter is the per user rate limit checked by the handlers
+type Limiter interface {
+	Allow(user string) bool
+	AllowN(user string, n int) bool
+	Status(user string) (remaining int, resetAfter time.Duration)
+	Close()
+}
+
+// LimiterAdmin is implemented by limiters whose limits can be read and changed at runtime
+type LimiterAdmin interface {
+	Limits() (maxPerSec, bucketSize int)
+	UserLimits(user string) (maxPerSec, bucketSize int)
+	SetLimits(maxPerSec, bucketSize int)
+	Stats() RateLimiterStats
+}
+
+// noopLimiter allows every request, it is used when RATE_LIMIT_ENABLED=false and tracks nothing.
+// It has no limits, which the quota headers report as unlimited.
+type noopLimiter struct{}
+
+func (noopLimiter) Allow(string) bool                  { return true }
+func (noopLimiter) AllowN(string, int) bool            { return true }
+func (noopLimiter) Status(string) (int, time.Duration) { return 0, 0 }
+func (noopLimiter) Close()                             {}
+
+// userLimits returns the rate per second and bucket size that apply to the user, 0 for a limiter without
+// limits like noopLimiter
+func userLimits(rateLimiter Limiter, user string) (maxPerSec, bucketSize int) {
+	if admin, ok := rateLimiter.(LimiterAdmin); ok {
+		return admin.UserLimits(user)
+	}
+	return 0, 0
 }
 
 // RateLimiter implements a token bucket rate limiting mechanism
@@ -28,11 +107,24 @@ type RateLimiter struct {
 	lastRefill      map[string]time.Time
 	maxPerSec       int
 	bucketSize      int
+	overrides       map[string]RateLimitSettings // per user rate and burst instead of the defaults
 	cleanupInterval time.Duration
+	cleanups        int64
+	evicted         int64
+	done            chan struct{}
+	closeOnce       sync.Once
+}
+
+// RateLimiterStats describes the internal state of a rate limiter
+type RateLimiterStats struct {
+	TrackedUsers int   `json:"ratelimit_tracked_users"`
+	Cleanups     int64 `json:"ratelimit_cleanups_total"`
+	Evicted      int64 `json:"ratelimit_evicted_total"`
 }
 
-// NewRateLimiter creates a new rate limiter with specified rate per second
-func NewRateLimiter(maxPerSec int) *RateLimiter {
+// NewRateLimiter creates a new rate limiter with specified rate per second, a rate of 0 allows every request.
+// Users in overrides get their own rate and burst instead.
+func NewRateLimiter(maxPerSec int, overrides map[string]RateLimitSettings) *RateLimiter {
 	// Bucket size is double the rate to allow for some bursting
 	bucketSize := maxPerSec * 2
 
@@ -41,7 +133,9 @@ func NewRateLimiter(maxPerSec int) *RateLimiter {
 		lastRefill:      make(map[string]time.Time),
 		maxPerSec:       maxPerSec,
 		bucketSize:      bucketSize,
+		overrides:       overrides,
 		cleanupInterval: 30 * time.Minute, // Clean up every 30 minutes
+		done:            make(chan struct{}),
 	}
 
 	// Start the cleanup goroutine
@@ -52,37 +146,132 @@ func NewRateLimiter(maxPerSec int) *RateLimiter {
 
 // Allow checks if the user has exceeded their rate limit
 func (rl *RateLimiter) Allow(user string) bool {
+	return rl.AllowN(user, 1)
+}
+
+// AllowN checks if the user may consume n tokens at once and consumes them if so. n is capped at
+// the bucket size, so a cost larger than the burst still succeeds from a full bucket.
+func (rl *RateLimiter) AllowN(user string, n int) bool {
 	rl.mutex.Lock()
 	defer rl.mutex.Unlock()
 
+	// A rate of 0 disables the limiter, users aren't even tracked
+	maxPerSec, bucketSize := rl.limitsOf(user)
+	if maxPerSec <= 0 {
+		return true
+	}
+
 	now := time.Now()
-	lastTime, exists := rl.lastRefill[user]
+	_, exists := rl.lastRefill[user]
 
 	// Initialize if first request
 	if !exists {
-		rl.tokens[user] = rl.bucketSize
+		rl.tokens[user] = bucketSize
 		rl.lastRefill[user] = now
 	} else {
-		// Calculate tokens to add based on time elapsed
-		elapsed := now.Sub(lastTime).Seconds()
-		tokensToAdd := int(elapsed * float64(rl.maxPerSec))
-
-		if tokensToAdd > 0 {
-			rl.tokens[user] = min(rl.tokens[user]+tokensToAdd, rl.bucketSize)
-			rl.lastRefill[user] = now
-		}
+		rl.refill(user, now)
 	}
 
-	// Check if any tokens available
-	if rl.tokens[user] <= 0 {
+	// Check if enough tokens are available
+	n = min(n, bucketSize)
+	if rl.tokens[user] <= 0 || rl.tokens[user] < n {
 		return false
 	}
 
-	// Consume a token and allow
-	rl.tokens[user]--
+	// Consume the tokens and allow
+	rl.tokens[user] -= n
 	return true
 }
 
+// refill adds the tokens earned since the user's last refill, capped at the bucket size.
+// The caller must hold the mutex.
+func (rl *RateLimiter) refill(user string, now time.Time) {
+	// Calculate tokens to add based on time elapsed
+	maxPerSec, bucketSize := rl.limitsOf(user)
+	elapsed := now.Sub(rl.lastRefill[user]).Seconds()
+	tokensToAdd := int(elapsed * float64(maxPerSec))
+
+	if tokensToAdd > 0 {
+		rl.tokens[user] = min(rl.tokens[user]+tokensToAdd, bucketSize)
+		rl.lastRefill[user] = now
+	}
+}
+
+// Status returns the tokens the user has left and how long until the next one is added
+func (rl *RateLimiter) Status(user string) (remaining int, resetAfter time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := time.Now()
+	maxPerSec, bucketSize := rl.limitsOf(user)
+	if _, exists := rl.lastRefill[user]; !exists {
+		return bucketSize, 0
+	}
+	rl.refill(user, now)
+
+	remaining = rl.tokens[user]
+	if remaining >= bucketSize || maxPerSec <= 0 {
+		return remaining, 0
+	}
+	perToken := time.Second / time.Duration(maxPerSec)
+	return remaining, max(perToken-now.Sub(rl.lastRefill[user]), 0)
+}
+
+// Limits returns the current rate per second and bucket size
+func (rl *RateLimiter) Limits() (maxPerSec, bucketSize int) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	return rl.maxPerSec, rl.bucketSize
+}
+
+// UserLimits returns the rate per second and bucket size that apply to the user
+func (rl *RateLimiter) UserLimits(user string) (maxPerSec, bucketSize int) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	return rl.limitsOf(user)
+}
+
+// limitsOf returns the user's override or the defaults. The caller must hold the mutex.
+func (rl *RateLimiter) limitsOf(user string) (maxPerSec, bucketSize int) {
+	if override, ok := rl.overrides[user]; ok {
+		return override.MaxPerSec, override.Burst
+	}
+	return rl.maxPerSec, rl.bucketSize
+}
+
+// SetLimits changes the default rate per second and bucket size at runtime, users with an override
+// keep theirs. Every bucket is first refilled at the old rate so tokens already earned are kept, then
+// capped at the new size.
+func (rl *RateLimiter) SetLimits(maxPerSec, bucketSize int) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := time.Now()
+	for user := range rl.tokens {
+		rl.refill(user, now)
+		if _, ok := rl.overrides[user]; !ok {
+			rl.tokens[user] = min(rl.tokens[user], bucketSize)
+		}
+	}
+
+	rl.maxPerSec = maxPerSec
+	rl.bucketSize = bucketSize
+}
+
+// Stats returns the number of tracked users and the cleanup counters
+func (rl *RateLimiter) Stats() RateLimiterStats {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	return RateLimiterStats{
+		TrackedUsers: len(rl.tokens),
+		Cleanups:     rl.cleanups,
+		Evicted:      rl.evicted,
+	}
+}
+
 // min returns the smaller of two integers
 func min(a, b int) int {
 	if a < b {
@@ -96,11 +285,23 @@ func (rl *RateLimiter) periodicCleanup() {
 	ticker := time.NewTicker(rl.cleanupInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		rl.cleanupInactiveBuckets()
+	for {
+		select {
+		case <-ticker.C:
+			rl.cleanupInactiveBuckets()
+		case <-rl.done:
+			return
+		}
 	}
 }
 
+// Close stops the cleanup goroutine, it is safe to call more than once
+func (rl *RateLimiter) Close() {
+	rl.closeOnce.Do(func() {
+		close(rl.done)
+	})
+}
+
 // cleanupInactiveBuckets removes user buckets that haven't been used in a while
 func (rl *RateLimiter) cleanupInactiveBuckets() {
 	rl.mutex.Lock()
@@ -122,11 +323,12 @@ func (rl *RateLimiter) cleanupInactiveBuckets() {
 		delete(rl.tokens, user)
 		delete(rl.lastRefill, user)
 	}
+	rl.cleanups++
+	rl.evicted += int64(len(inactiveUsers))
 
 	// Log cleanup results if any users were removed
 	if len(inactiveUsers) > 0 {
-		log.Printf("Rate limiter cleanup: removed %d inactive users, current user count: %d",
-			len(inactiveUsers), len(rl.tokens))
+		slog.Info("Rate limiter cleanup", "removed", len(inactiveUsers), "users", len(rl.tokens))
 	}
 }
 
@@ -136,135 +338,1168 @@ func isHTML(content string) bool {
 	return htmlPattern.MatchString(content)
 }
 
-// GetMailHandler creates an HTTP handler for sending emails
-func GetMailHandler(rateLimiter *RateLimiter) http.HandlerFunc {
+// htmlDocumentPattern matches the markers of a complete HTML document
+var htmlDocumentPattern = regexp.MustCompile(`(?i)<!DOCTYPE html|<html[\s>]|<body[\s>]`)
+
+// htmlTagPattern matches anything that looks like an opening or closing tag
+var htmlTagPattern = regexp.MustCompile(`</?[a-zA-Z][a-zA-Z0-9]*(\s[^<>]*)?/?>`)
+
+// detectHTML reports whether the content is HTML. The loose mode uses isHTML, the strict mode only
+// trusts document markers and the absence of tags, content with stray tags gets the fallback type.
+func detectHTML(content, mode, fallback string) bool {
+	if mode != "strict" {
+		return isHTML(content)
+	}
+	switch {
+	case htmlDocumentPattern.MatchString(content):
+		return true
+	case !htmlTagPattern.MatchString(content):
+		return false
+	default:
+		return fallback == "text/html"
+	}
+}
+
+// containsAddress reports whether address is in the list, ignoring case
+func containsAddress(list []string, address string) bool {
+	for _, item := range list {
+		if strings.EqualFold(strings.TrimSpace(item), address) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeBody strips a leading UTF-8 byte order mark and trailing whitespace from the content
+func normalizeBody(content string) string {
+	content = strings.TrimPrefix(content, "\uFEFF")
+	return strings.TrimRightFunc(content, unicode.IsSpace)
+}
+
+// formatAddress renders a display name and address for a header e.g "Title" <sender email>.
+// Quotes and backslashes in the name are escaped per RFC 5322 and non-ASCII names are RFC 2047 encoded.
+func formatAddress(displayName, address string) string {
+	return (&mail.Address{Name: displayName, Address: address}).String()
+}
+
+// customHeader returns the value of a custom header, names are matched case-insensitively
+func customHeader(headers map[string]string, name string) (string, bool) {
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// headerNames returns the names of the custom headers sorted, so they are checked and rendered in a stable order
+func headerNames(headers map[string]string) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mailerHeader returns the value of the X-Mailer header e.g mail-in-a-box-rest-api/1.0.0
+func mailerHeader() string {
+	return appName + "/" + version
+}
+
+// errExpectedObject is returned when the request body is valid JSON but not an object
+var errExpectedObject = errors.New("the request body must be a JSON object")
+
+// decodeJSONObject decodes a request body that must hold a JSON object into v
+func decodeJSONObject(body io.Reader, v any) error {
+	var raw json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return err
+	}
+	if trimmed := bytes.TrimLeft(raw, " \t\r\n"); len(trimmed) == 0 || trimmed[0] != '{' {
+		return errExpectedObject
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// limitRequestBody rejects a request whose declared length is over max and bounds reading the rest of
+// its body to max bytes. It reports whether the request may proceed, 0 disables the limit.
+func limitRequestBody(w http.ResponseWriter, r *http.Request, max int64) bool {
+	if max == 0 {
+		return true
+	}
+	if r.ContentLength > max {
+		writeRequestTooLarge(w, max)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, max)
+	return true
+}
+
+// attachmentLimitReader bounds a JSON request body to limit bytes while it is read, unless an "attachments"
+// key was read first. The larger limit of a request with attachments is enforced by limitRequestBody, so a
+// big body without them is refused before it is buffered and decoded. Keys are looked for in the objects
+// at keyDepth, 1 for a single email and 2 for the emails of a batch.
+type attachmentLimitReader struct {
+	r           io.Reader
+	n           int64
+	limit       int64
+	attachments bool // an attachments key was seen, only the larger limit applies
+	scanner     jsonKeyScanner
+}
+
+// newAttachmentLimitReader bounds r to limit bytes unless it holds attachments, 0 disables the bound
+func newAttachmentLimitReader(r io.Reader, limit int64, keyDepth int) *attachmentLimitReader {
+	return &attachmentLimitReader{r: r, limit: limit, scanner: jsonKeyScanner{keyDepth: keyDepth, key: "attachments"}}
+}
+
+func (a *attachmentLimitReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	a.n += int64(n)
+	if !a.attachments && a.scanner.scan(p[:n]) {
+		a.attachments = true
+	}
+	if a.limit > 0 && !a.attachments && a.n > a.limit {
+		return n, &http.MaxBytesError{Limit: a.limit}
+	}
+	return n, err
+}
+
+// jsonKeyScanner follows a JSON document as it streams to spot a key of the objects at keyDepth. Keys are
+// compared case-insensitively like encoding/json does, keys written with escapes are never matched.
+type jsonKeyScanner struct {
+	keyDepth int
+	key      string
+
+	depth     int
+	inObject  bool // the container at keyDepth is an object
+	expectKey bool // the next string at keyDepth is a key
+	inString  bool
+	escaped   bool
+	isKey     bool
+	current   []byte
+}
+
+// scan consumes the next bytes of the document and reports whether the key was completed in them
+func (s *jsonKeyScanner) scan(p []byte) bool {
+	for _, b := range p {
+		if s.inString {
+			switch {
+			case s.escaped:
+				s.escaped = false
+				s.isKey = false
+			case b == '\\':
+				s.escaped = true
+			case b == '"':
+				s.inString = false
+				if s.isKey && strings.EqualFold(string(s.current), s.key) {
+					return true
+				}
+			case s.isKey && len(s.current) <= len(s.key):
+				s.current = append(s.current, b)
+			}
+			continue
+		}
+
+		switch b {
+		case '"':
+			s.inString = true
+			s.isKey = s.depth == s.keyDepth && s.inObject && s.expectKey
+			s.expectKey = false
+			s.current = s.current[:0]
+		case '{', '[':
+			s.depth++
+			if s.depth == s.keyDepth {
+				s.inObject, s.expectKey = b == '{', b == '{'
+			}
+		case '}', ']':
+			s.depth--
+		case ',':
+			s.expectKey = s.depth == s.keyDepth && s.inObject
+		}
+	}
+	return false
+}
+
+// writeRequestTooLarge responds with 413 for a request body over the limit
+func writeRequestTooLarge(w http.ResponseWriter, max int64) {
+	writeError(w, "request_too_large",
+		fmt.Sprintf("The request body is larger than %d bytes", max))
+}
+
+// writeBodyError responds to a request body decodeJSONObject couldn't decode
+func writeBodyError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeRequestTooLarge(w, maxBytesErr.Limit)
+		return
+	}
+	if errors.Is(err, errExpectedObject) {
+		writeError(w, "expected_object", "The request body must be a JSON object")
+		return
+	}
+	writeError(w, "invalid_body", "Invalid request body")
+}
+
+// writeJSON writes v as the JSON response body with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// authError describes why the Authorization header was rejected
+type authError struct {
+	code    string
+	message string
+}
+
+// parseBasicAuth extracts the username and password from a Basic Authorization header. Credentials that
+// would decode to more than maxBytes are rejected without decoding them, 0 disables the limit.
+func parseBasicAuth(authHeader string, maxBytes int) (username, password string, authErr *authError) {
+	if authHeader == "" {
+		return "", "", &authError{"auth_missing", "Authentication required"}
+	}
+
+	scheme, encoded, _ := strings.Cut(authHeader, " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return "", "", &authError{"auth_unsupported_scheme", "Only Basic authentication is supported"}
+	}
+
+	encoded = strings.TrimSpace(encoded)
+	if maxBytes > 0 && len(encoded) > base64.StdEncoding.EncodedLen(maxBytes) {
+		return "", "", &authError{"auth_too_large", "The credentials are too long"}
+	}
+
+	// Decode credentials
+	credentials, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", &authError{"auth_malformed", "Invalid authentication format"}
+	}
+	// the encoded length is a multiple of 4, so up to two bytes past the limit get through the check above
+	if maxBytes > 0 && len(credentials) > maxBytes {
+		return "", "", &authError{"auth_too_large", "The credentials are too long"}
+	}
+
+	// Split username and password
+	// The username ends up in the From header, so it gets the same checks as other header values
+	username, password, found := strings.Cut(string(credentials), ":")
+	if !found || sanitizeHeaderValue(username) != nil {
+		return "", "", &authError{"auth_malformed", "Invalid authentication format"}
+	}
+	return username, password, nil
+}
+
+// writeRateLimitHeaders tells the client its burst and how many tokens it has left, both "unlimited"
+// when the user isn't limited
+func writeRateLimitHeaders(w http.ResponseWriter, rateLimiter Limiter, username string) {
+	maxPerSec, burst := userLimits(rateLimiter, username)
+	if maxPerSec <= 0 {
+		w.Header().Set("X-RateLimit-Limit", "unlimited")
+		w.Header().Set("X-RateLimit-Remaining", "unlimited")
+		return
+	}
+	remaining, _ := rateLimiter.Status(username)
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(burst))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+}
+
+// writeRateLimited responds with 429 and a Retry-After of the seconds until the next token is added
+func writeRateLimited(w http.ResponseWriter, rateLimiter Limiter, username string) {
+	rateLimitedTotal.Add(1)
+	writeRateLimitHeaders(w, rateLimiter, username)
+	_, resetAfter := rateLimiter.Status(username)
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(resetAfter.Seconds())), 1)))
+	writeError(w, "rate_limited", "Rate limit exceeded")
+}
+
+// writeMethodNotAllowed responds with 405 and the Allow header listing the methods the endpoint supports
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, "method_not_allowed", "Method not allowed")
+}
+
+// GetMailHandler creates an HTTP handler for sending emails. Sends that fail transiently are handed to
+// queue for background retries and async=true sends run on jobs, each when it isn't nil.
+func GetMailHandler(rateLimiter Limiter, windowLimiter *SlidingWindowLimiter, mailer Mailer, cfg *Config, usage UsageRecorder, hooks Hooks, queue *RetryQueue, jobs *JobPool) http.HandlerFunc {
+	// Messages sent with a client Message-ID, remembered to drop retries
+	var dedupe *replayCache
+	if cfg.MessageIDDedupeTTL > 0 {
+		dedupe = newReplayCache(cfg.MessageIDDedupeTTL)
+	}
+	// Responses by Idempotency-Key, so a client retrying after a timeout doesn't send twice
+	var idempotency *replayCache
+	if cfg.IdempotencyKeyTTL > 0 {
+		idempotency = newReplayCache(cfg.IdempotencyKeyTTL)
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Only accept POST requests
 		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			writeMethodNotAllowed(w, http.MethodPost)
 			return
 		}
 
-		// Parse Basic Authentication header
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" || !strings.HasPrefix(authHeader, "Basic ") {
-			http.Error(w, "Authentication required", http.StatusUnauthorized)
+		// Shed oversized requests before reading them, the bounded reader covers chunked bodies. Only a body
+		// with attachments may go past MAX_REQUEST_BYTES, which the reader of the body below enforces.
+		if !limitRequestBody(w, r, cfg.requestBytesLimit()) {
 			return
 		}
 
-		// Decode credentials
-		credentials, err := base64.StdEncoding.DecodeString(authHeader[6:])
-		if err != nil {
-			http.Error(w, "Invalid authentication format", http.StatusUnauthorized)
+		// Parse Basic Authentication header
+		username, password, authErr := parseBasicAuth(r.Header.Get("Authorization"), cfg.MaxCredentialsBytes)
+		if authErr != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mail-api"`)
+			writeError(w, authErr.code, authErr.message)
 			return
 		}
 
-		// Split username and password
-		parts := strings.SplitN(string(credentials), ":", 2)
-		if len(parts) != 2 {
-			http.Error(w, "Invalid authentication format", http.StatusUnauthorized)
+		// Without SMTP authentication the mail server can't verify the credentials, so the API does
+		if !cfg.SMTPAuth && !cfg.principal(username).CheckAPIPassword(password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mail-api"`)
+			writeError(w, "auth_invalid", "Invalid username or password")
 			return
 		}
-		username := parts[0]
-		password := parts[1]
 
-		// Check rate limit
-		if !rateLimiter.Allow(username) {
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		// A retried request is answered before it is checked or charged again
+		w, finish, ok := reserveIdempotencyKey(w, r, idempotency, username, password)
+		if !ok {
 			return
 		}
+		defer finish()
 
 		// Parse request body
 		var emailReq EmailRequest
-		if err := json.NewDecoder(r.Body).Decode(&emailReq); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		body := newAttachmentLimitReader(r.Body, cfg.MaxRequestBytes, 1)
+		if err := decodeJSONObject(body, &emailReq); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		// An attachments key without attachments doesn't earn the larger limit
+		if cfg.MaxRequestBytes > 0 && len(emailReq.Attachments) == 0 && body.n > cfg.MaxRequestBytes {
+			writeRequestTooLarge(w, cfg.MaxRequestBytes)
 			return
 		}
 
-		// Validate required fields
-		if len(emailReq.To) == 0 || emailReq.Subject == "" || emailReq.Content == "" {
-			http.Error(w, "Missing required fields (to, subject, content)", http.StatusBadRequest)
+		// A retry with the Message-ID of a message already sent gets the original response, before it is
+		// charged again. Like Idempotency-Key the key is scoped to the credentials.
+		if clientID, ok := customHeader(emailReq.Headers, "Message-ID"); ok && dedupe != nil {
+			owner := credentialsHash(username, password)
+			key := string(owner[:]) + strings.ToLower(clientID)
+			state, cached := dedupe.reserve(key)
+			switch state {
+			case replayCached:
+				w.Header().Set("X-Deduplicated", "true")
+				cached.write(w)
+				return
+			case replayPending:
+				writeError(w, "duplicate_in_progress",
+					"A message with this Message-ID is already being sent")
+				return
+			}
+			rec := &capturingWriter{ResponseWriter: w}
+			w = rec
+			defer dedupe.finish(key, rec)
+		}
+
+		// Check the principal is allowed to send at this time
+		if !cfg.principal(username).CanSendAt(time.Now()) {
+			writeError(w, "outside_send_window", "Sending is not allowed at this time")
+			return
+		}
+
+		// Check rate limit, a per recipient cost is charged once the recipients are known
+		if cfg.RateLimitCost == "request" && !rateLimiter.Allow(username) {
+			writeRateLimited(w, rateLimiter, username)
+			return
+		}
+		writeRateLimitHeaders(w, rateLimiter, username)
+
+		// Policies like "no more than 100 per hour" are counted over a sliding window. The slot is given back
+		// unless the message is sent, so rejected and failed requests don't use up the window.
+		windowCharged := false
+		if limit := cfg.windowLimit(username); limit != nil {
+			if ok, resetAfter := windowLimiter.Allow(username, limit); !ok {
+				rateLimitedTotal.Add(1)
+				seconds := max(int(math.Ceil(resetAfter.Seconds())), 1)
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				writeErrorFields(w, "window_limit_exceeded", fmt.Sprintf("At most %d messages can be sent per %s", limit.Max, limit.window), map[string]any{
+					"reset_after_seconds": seconds,
+				})
+				return
+			}
+			windowCharged = true
+			defer func() {
+				if windowCharged {
+					windowLimiter.Refund(username)
+				}
+			}()
+		}
+
+		prepared, ok := prepareMessage(w, r, &emailReq, username, cfg, rateLimiter, hooks)
+		if !ok {
 			return
 		}
+		env, data, messageID, warnings := prepared.env, prepared.data, prepared.messageID, prepared.warnings
+		sender, isHTMLContent, logger := env.From, prepared.isHTML, prepared.logger
+
+		// With async=true a worker sends the message and the caller polls /mail/jobs/{id} for the outcome
+		if r.URL.Query().Get("async") == "true" {
+			if jobs == nil {
+				writeError(w, "async_disabled", "Asynchronous sends are not enabled")
+				return
+			}
+			if emailReq.PerRecipient {
+				writeError(w, "async_unsupported", "Sends with per_recipient can't be asynchronous")
+				return
+			}
 
-		// Determine if content is HTML
-		isHTMLContent := isHTML(emailReq.Content)
+			ctx := context.WithoutCancel(r.Context())
+			submission := &Submission{
+				Username:        username,
+				Password:        password,
+				From:            env.From,
+				To:              env.Recipients,
+				Message:         data,
+				Require8BitMIME: strings.EqualFold(emailReq.Encoding, "8bit"),
+			}
+			job, ok := jobs.Submit(username, password, messageID, func() (string, error) {
+				start := time.Now()
+				result, err := mailer.Send(ctx, submission)
+				sendDurationHistogram.observeSince(start)
+				if err != nil {
+					recordSendFailure(err, len(env.Recipients))
+					logger.Error("Failed to send email", "error", err)
+					hooks.runPostSend(ctx, env, SendResult{Err: err})
+					return "", err
+				}
+				recordSend(len(env.Recipients))
+				hooks.runPostSend(ctx, env, SendResult{Response: result.Response})
+				usage.Record(UsageRecord{
+					RequestID:  requestID(ctx),
+					Principal:  username,
+					Recipients: len(env.Recipients),
+					Bytes:      len(data),
+					Timestamp:  time.Now().UTC(),
+				})
+				logger.Info("Email sent", "sender", sender, "to", emailReq.To, "cc", emailReq.Cc, "bcc", len(emailReq.Bcc),
+					"html", isHTMLContent)
+				return result.Response, nil
+			})
+			if !ok {
+				w.Header().Set("Retry-After", "1")
+				writeError(w, "queue_full", "Too many emails are waiting to be sent, retry later")
+				return
+			}
+			windowCharged = false
 
-		title := username
-		if emailReq.Title != "" {
-			// Use the provided from name
-			title = fmt.Sprintf("\"%s\" <%s>", emailReq.Title, username)
-		} else if strings.Contains(username, "@") {
-			// Extract the username part before @ symbol
-			parts := strings.Split(username, "@")
-			if len(parts) > 0 {
-				displayName := strings.Title(parts[0])
-				title = fmt.Sprintf("\"%s\" <%s>", displayName, username)
+			response := map[string]any{
+				"status":     "accepted",
+				"message":    "The email will be sent in the background",
+				"message_id": messageID,
+				"job_id":     job.ID,
 			}
+			if job.QueuePosition > 0 {
+				response["queue_position"] = job.QueuePosition
+			}
+			if job.EstimatedSendTime != nil {
+				response["estimated_send_time"] = job.EstimatedSendTime
+			}
+			if len(warnings) > 0 {
+				response["warnings"] = warnings
+			}
+			writeJSON(w, http.StatusAccepted, response)
+			return
 		}
 
-		// Build email message with proper MIME headers
-		var msg string
-		if isHTMLContent {
-			msg = fmt.Sprintf("From: %s\n"+
-				"To: %s\n"+
-				"Subject: %s\n"+
-				"MIME-Version: 1.0\n"+
-				"Content-Type: text/html; charset=UTF-8\n\n%s",
-				title,
-				strings.Join(emailReq.To, ", "),
-				emailReq.Subject,
-				emailReq.Content)
+		// Deliver to every recipient on its own so one rejected address doesn't fail the others
+		if emailReq.PerRecipient {
+			// The messages share one session, a refused recipient only resets it for the next one
+			items := make([]*batchItem, len(env.Recipients))
+			for i, recipient := range env.Recipients {
+				items[i] = &batchItem{
+					from:            env.From,
+					to:              []string{recipient},
+					msg:             data,
+					require8BitMIME: strings.EqualFold(emailReq.Encoding, "8bit"),
+				}
+			}
+			start := time.Now()
+			sessionErr := mailer.SendBatch(r.Context(), username, password, items)
+			sendDurationHistogram.observeSince(start)
+
+			statuses := make([]recipientStatus, 0, len(env.Recipients))
+			delivered := 0
+			for i, recipient := range env.Recipients {
+				single := &Envelope{Principal: env.Principal, From: env.From, Recipients: []string{recipient}, msg: env.msg}
+				// Recipients the session didn't get to share its error
+				err := items[i].err
+				if !items[i].done {
+					err = sessionErr
+				}
+				if err != nil {
+					recordSendFailure(err, 1)
+					logger.Error("Failed to send email to a recipient", "error", err)
+					hooks.runPostSend(r.Context(), single, SendResult{Err: err})
+					statuses = append(statuses, recipientStatus{Recipient: recipient, Status: "failed", Error: err.Error()})
+					continue
+				}
+				recordSend(1)
+				delivered++
+				hooks.runPostSend(r.Context(), single, SendResult{Response: items[i].response})
+				statuses = append(statuses, recipientStatus{Recipient: recipient, Status: "sent", SMTPResponse: items[i].response})
+			}
+			if delivered > 0 && delivered < len(env.Recipients) {
+				partialSendsTotal.Add(1)
+			}
+			logger.Info("Email sent to recipients separately", "sender", sender, "delivered", delivered, "html", isHTMLContent)
+
+			if delivered > 0 {
+				windowCharged = false
+				usage.Record(UsageRecord{
+					RequestID:  requestID(r.Context()),
+					Principal:  username,
+					Recipients: delivered,
+					Bytes:      len(data) * delivered,
+					Timestamp:  time.Now().UTC(),
+				})
+			}
+
+			// 207 when only some recipients got the message, 502 when the mail server took none
+			status, outcome, message := http.StatusOK, "success", "Email sent to every recipient"
+			switch {
+			case delivered == 0:
+				status, outcome, message = http.StatusBadGateway, "error", "Email could not be sent to any recipient"
+			case delivered < len(env.Recipients):
+				status, outcome, message = http.StatusMultiStatus, "partial", "Email could not be sent to some recipients"
+			}
+			response := map[string]any{
+				"status":     outcome,
+				"message":    message,
+				"message_id": messageID,
+				"results":    statuses,
+			}
+			if len(warnings) > 0 {
+				response["warnings"] = warnings
+			}
+			writeJSON(w, status, response)
+			return
+		}
+
+		// Hand the message to the mail server
+		submission := &Submission{
+			Username:        username,
+			Password:        password,
+			From:            env.From,
+			To:              env.Recipients,
+			Message:         data,
+			Require8BitMIME: strings.EqualFold(emailReq.Encoding, "8bit"),
+		}
+		start := time.Now()
+		result, err := mailer.Send(r.Context(), submission)
+		sendDurationHistogram.observeSince(start)
+		if err != nil {
+			recordSendFailure(err, len(env.Recipients))
+			logger.Error("Failed to send email", "error", err)
+			hooks.runPostSend(r.Context(), env, SendResult{Err: err})
 		} else {
-			msg = fmt.Sprintf("From: %s\n"+
-				"To: %s\n"+
-				"Subject: %s\n"+
-				"Content-Type: text/plain; charset=UTF-8\n\n%s",
-				title,
-				strings.Join(emailReq.To, ", "),
-				emailReq.Subject,
-				emailReq.Content)
-		}
-
-		// Connect to mail server and send email (using localhost since we're on the same server)
-		auth := smtp.PlainAuth("", username, password, "box.domain.com")
-		err = smtp.SendMail("box.domain.com:587", auth, username, emailReq.To, []byte(msg))
+			hooks.runPostSend(r.Context(), env, SendResult{Response: result.Response})
+		}
+
+		// A mail server that is briefly unavailable shouldn't lose the message, it is retried in the background
+		if err != nil && queue != nil && isTransientSendError(err) {
+			queueID, queueErr := queue.Enqueue(r.Context(), submission, err)
+			if queueErr == nil {
+				logger.Info("Email queued for retry", "queue_id", queueID)
+				windowCharged = false
+				response := map[string]any{
+					"status":     "queued",
+					"message":    "The mail server is unavailable, the email will be retried",
+					"message_id": messageID,
+					"queue_id":   queueID,
+				}
+				if len(warnings) > 0 {
+					response["warnings"] = warnings
+				}
+				writeJSON(w, http.StatusAccepted, response)
+				return
+			}
+			logger.Error("Failed to queue email", "error", queueErr)
+		}
+
+		// The transactions before the failed one were delivered, report every recipient instead of an error
+		var partial *partialDeliveryError
+		if errors.As(err, &partial) {
+			windowCharged = false
+			usage.Record(UsageRecord{
+				RequestID:  requestID(r.Context()),
+				Principal:  username,
+				Recipients: partial.delivered(),
+				Bytes:      len(data),
+				Timestamp:  time.Now().UTC(),
+			})
+			response := map[string]any{
+				"status":     "partial",
+				"message":    "Email could not be sent to some recipients",
+				"message_id": messageID,
+				"results":    partial.results,
+			}
+			if len(warnings) > 0 {
+				response["warnings"] = warnings
+			}
+			writeJSON(w, http.StatusMultiStatus, response)
+			return
+		}
+
+		if errors.Is(err, errSMTPUTF8Unsupported) {
+			writeError(w, "smtputf8_unsupported", err.Error())
+			return
+		}
+		if errors.Is(err, err8BitMIMEUnsupported) {
+			writeError(w, "8bitmime_unsupported", err.Error())
+			return
+		}
+		if errors.Is(err, errSMTPTimeout) {
+			writeError(w, "smtp_timeout", errSMTPTimeout.Error())
+			return
+		}
 		if err != nil {
-			log.Printf("Failed to send email: %v", err)
-			http.Error(w, "Failed to send email: "+err.Error(), http.StatusInternalServerError)
+			writeError(w, "send_failed", "Failed to send email: "+err.Error())
 			return
 		}
 
+		windowCharged = false
+		recordSend(len(env.Recipients))
+		usage.Record(UsageRecord{
+			RequestID:  requestID(r.Context()),
+			Principal:  username,
+			Recipients: len(env.Recipients),
+			Bytes:      len(data),
+			Timestamp:  time.Now().UTC(),
+		})
+
 		// Log success with content type info
-		log.Printf("Email sent from %s to %v (HTML: %v)", username, emailReq.To, isHTMLContent)
+		// Bcc recipients are only counted so the log doesn't reveal them
+		logger.Info("Email sent", "sender", sender, "to", emailReq.To, "cc", emailReq.Cc, "bcc", len(emailReq.Bcc),
+			"html", isHTMLContent)
+
+		// Some servers accept the message but note that it was e.g held for review
+		for _, keyword := range cfg.SMTPWarningKeywords {
+			if strings.Contains(strings.ToLower(result.Response), strings.ToLower(keyword)) {
+				warnings = append(warnings, fmt.Sprintf("The mail server response mentions %q", keyword))
+			}
+		}
 
 		// Return success response
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{
-			"status":  "success",
-			"message": "Email sent successfully",
+		response := map[string]any{
+			"status":        "success",
+			"message":       "Email sent successfully",
+			"smtp_response": result.Response,
+			"message_id":    messageID,
+		}
+		if cfg.DebugTimings {
+			response["timings"] = result.Timings
+		}
+		if cfg.ReportSMTPHost {
+			response["smtp_host"] = result.Host
+		}
+		if len(warnings) > 0 {
+			response["warnings"] = warnings
+		}
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+// preparedMessage is a validated and assembled message ready to be handed to the mail server
+type preparedMessage struct {
+	env       *Envelope
+	data      []byte
+	messageID string
+	warnings  []string // non-blocking issues reported back in the success response
+	isHTML    bool
+	logger    *slog.Logger
+}
+
+// prepareMessage validates the request of the authenticated user and assembles its message. It writes the
+// error response to w and reports false when the message can't be sent.
+func prepareMessage(w http.ResponseWriter, r *http.Request, emailReq *EmailRequest, username string, cfg *Config,
+	rateLimiter Limiter, hooks Hooks) (*preparedMessage, bool) {
+	// Bound the recipient entries before any of them is parsed, so thousands of tiny entries can't burn CPU
+	if count := len(emailReq.To) + len(emailReq.Cc) + len(emailReq.Bcc); cfg.MaxRecipients > 0 && count > cfg.MaxRecipients {
+		writeError(w, "too_many_recipients",
+			fmt.Sprintf("At most %d recipients are allowed across to, cc and bcc", cfg.MaxRecipients))
+		return nil, false
+	}
+
+	// Validate the fields
+	if errs := validateRequest(emailReq); len(errs) > 0 {
+		writeValidationErrors(w, errs, cfg.ReportAllValidationErrors)
+		return nil, false
+	}
+
+	// Bound the custom headers so a request can't bloat the header section
+	if cfg.MaxCustomHeaders > 0 && len(emailReq.Headers) > cfg.MaxCustomHeaders {
+		writeError(w, "too_many_headers",
+			fmt.Sprintf("At most %d custom headers are allowed", cfg.MaxCustomHeaders))
+		return nil, false
+	}
+	for _, name := range headerNames(emailReq.Headers) {
+		if value := emailReq.Headers[name]; cfg.MaxCustomHeaderBytes > 0 && len(name)+len(value) > cfg.MaxCustomHeaderBytes {
+			writeError(w, "header_too_long",
+				fmt.Sprintf("The %s header is longer than %d bytes", name, cfg.MaxCustomHeaderBytes))
+			return nil, false
+		}
+	}
+
+	// A username without a domain isn't a valid From address on its own
+	sender, ok := cfg.senderAddress(username)
+	if !ok {
+		writeError(w, "invalid_sender",
+			"The username is not an email address and no default domain is configured")
+		return nil, false
+	}
+
+	// Send as a shared mailbox while still authenticating to SMTP with the principal's own credentials
+	if emailReq.From != "" && !strings.EqualFold(emailReq.From, sender) {
+		if !cfg.canSendAs(username, emailReq.From) {
+			writeError(w, "shared_mailbox_forbidden", "Not allowed to send as "+emailReq.From)
+			return nil, false
+		}
+		sender = emailReq.From
+	}
+
+	// Only domains the operator verified may appear in From, so the API can't be used to spoof others
+	if !cfg.fromDomainVerified(sender) {
+		writeError(w, "unverified_from_domain", "The domain of "+sender+" is not a verified sending domain")
+		return nil, false
+	}
+
+	// Non-blocking issues reported back in the success response
+	var warnings []string
+	if dropped := dedupeRecipients(&emailReq.To, &emailReq.Cc, &emailReq.Bcc); dropped > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d duplicate recipient addresses were removed", dropped))
+	}
+	visible := len(emailReq.To) + len(emailReq.Cc)
+	if threshold := cfg.VisibleRecipientWarningThreshold; threshold > 0 && visible > threshold {
+		warnings = append(warnings, fmt.Sprintf(
+			"%d recipients can see each other's addresses, consider sending with BCC", visible))
+	}
+
+	// Every recipient gets an envelope RCPT, Bcc addresses are never rendered into a header
+	recipients := make([]string, 0, visible+len(emailReq.Bcc))
+	for _, list := range [][]string{emailReq.To, emailReq.Cc, emailReq.Bcc} {
+		for _, address := range list {
+			recipients = append(recipients, envelopeAddress(address))
+		}
+	}
+	logger := requestLogger(r.Context()).With("username", username, "recipients", len(recipients))
+
+	// Charge one token per recipient so large sends count for the load they cause
+	if cfg.RateLimitCost == "recipients" && !rateLimiter.AllowN(username, len(recipients)) {
+		writeRateLimited(w, rateLimiter, username)
+		return nil, false
+	}
+	writeRateLimitHeaders(w, rateLimiter, username)
+
+	// Sending to yourself is usually fine but can point to a misconfigured notification loop
+	if cfg.SelfSendMode != "allow" && containsAddress(recipients, sender) {
+		if cfg.SelfSendMode == "reject" {
+			writeError(w, "sender_in_recipients", "The sender address is one of the recipients")
+			return nil, false
+		}
+		warnings = append(warnings, "The sender address is one of the recipients")
+	}
+
+	// Determine if content is HTML, an explicit html field wins over guessing from the content.
+	// A text version makes the content the HTML version.
+	isHTMLContent := detectHTML(emailReq.Content, cfg.HTMLDetection, cfg.ContentTypeFallback) || emailReq.TextContent != ""
+	if emailReq.HTML != nil {
+		isHTMLContent = *emailReq.HTML
+	}
+	if emailReq.ContentType != "" {
+		isHTMLContent = strings.EqualFold(emailReq.ContentType, "text/html")
+	}
+
+	// Normalize the body, HTML is left untouched by default to keep pre-formatted content intact
+	if (isHTMLContent && cfg.NormalizeHTMLBody) || (!isHTMLContent && cfg.NormalizeTextBody) {
+		emailReq.Content = normalizeBody(emailReq.Content)
+	}
+	if emailReq.TextContent != "" && cfg.NormalizeTextBody {
+		emailReq.TextContent = normalizeBody(emailReq.TextContent)
+	}
+
+	// Clean up HTML according to the principal's policy
+	htmlPolicy := cfg.htmlPolicy(username)
+	if isHTMLContent && htmlPolicy.StripScripts {
+		emailReq.Content = stripScripts(emailReq.Content)
+	}
+	if isHTMLContent && htmlPolicy.StripTracking {
+		emailReq.Content = stripTracking(emailReq.Content)
+	}
+
+	// Malformed HTML renders badly and can trigger spam filters
+	if isHTMLContent && htmlPolicy.Validation != "off" {
+		if problems := checkHTML(emailReq.Content); len(problems) > 0 {
+			if htmlPolicy.Validation == "reject" {
+				writeErrorFields(w, "malformed_html", "The HTML content is malformed", map[string]any{
+					"details": problems,
+				})
+				return nil, false
+			}
+			for _, problem := range problems {
+				warnings = append(warnings, "Malformed HTML: "+problem)
+			}
+		}
+	}
+
+	title := sender
+	if emailReq.Title != "" {
+		// Use the provided from name
+		title = formatAddress(emailReq.Title, sender)
+	} else if strings.Contains(sender, "@") {
+		// Extract the username part before @ symbol
+		parts := strings.Split(sender, "@")
+		if len(parts) > 0 {
+			displayName := strings.Title(parts[0])
+			title = formatAddress(displayName, sender)
+		}
+	}
+
+	// Lightweight guard against obviously spammy messages
+	if cfg.SpamScoreThreshold > 0 {
+		if score, factors := scoreSpam(emailReq.Subject, emailReq.Content, isHTMLContent); score >= cfg.SpamScoreThreshold {
+			writeErrorFields(w, "spam_suspected", fmt.Sprintf("The message scored %.1f, the limit is %.1f", score, cfg.SpamScoreThreshold), map[string]any{
+				"score":   score,
+				"factors": factors,
+			})
+			return nil, false
+		}
+	}
+
+	// Bulk senders need a visible way to unsubscribe, added after scoring so the link isn't counted
+	if template := cfg.unsubscribeURL(username); template != "" {
+		link := unsubscribeURL(template, sender)
+		emailReq.Content = addUnsubscribeFooter(emailReq.Content, link, isHTMLContent)
+		if emailReq.TextContent != "" {
+			emailReq.TextContent = addUnsubscribeFooter(emailReq.TextContent, link, false)
+		}
+	}
+
+	// Very long address headers can exceed the mail server's header size limit
+	// The envelope keeps the bare addresses, only the headers get display names
+	toHeader := strings.Join(formatRecipients(emailReq.To, cfg.RecipientNames, cfg.DeriveRecipientNames), ", ")
+	if cfg.MaxFromHeaderBytes > 0 && len(title) > cfg.MaxFromHeaderBytes {
+		writeError(w, "header_too_long",
+			fmt.Sprintf("The From header is longer than %d bytes", cfg.MaxFromHeaderBytes))
+		return nil, false
+	}
+	if cfg.MaxRecipientHeaderBytes > 0 && len(toHeader) > cfg.MaxRecipientHeaderBytes {
+		writeError(w, "header_too_long",
+			fmt.Sprintf("The To header is longer than %d bytes", cfg.MaxRecipientHeaderBytes))
+		return nil, false
+	}
+	ccHeader := strings.Join(formatRecipients(emailReq.Cc, cfg.RecipientNames, cfg.DeriveRecipientNames), ", ")
+	if cfg.MaxRecipientHeaderBytes > 0 && len(ccHeader) > cfg.MaxRecipientHeaderBytes {
+		writeError(w, "header_too_long",
+			fmt.Sprintf("The Cc header is longer than %d bytes", cfg.MaxRecipientHeaderBytes))
+		return nil, false
+	}
+
+	// The body part with the requested transfer encoding, it is the whole message unless there are attachments
+	mediaType := "text/plain"
+	if isHTMLContent {
+		mediaType = "text/html"
+	}
+	var content *message
+	if emailReq.TextContent != "" {
+		// Both versions go in a multipart/alternative, encoded so long lines stay within SMTP limits
+		encoding := emailReq.Encoding
+		if encoding == "" {
+			encoding = "quoted-printable"
+		}
+		text, textErr := newTextPart(emailReq.TextContent, "text/plain", encoding)
+		html, htmlErr := newTextPart(emailReq.Content, "text/html", encoding)
+		if err := errors.Join(textErr, htmlErr); err != nil {
+			writeError(w, "invalid_encoding", err.Error())
+			return nil, false
+		}
+		content = &message{}
+		content.setMultipart("alternative", text, html)
+	} else {
+		var err error
+		if content, err = newTextPart(emailReq.Content, mediaType, emailReq.Encoding); err != nil {
+			writeError(w, "invalid_encoding", err.Error())
+			return nil, false
+		}
+	}
+
+	if limit := cfg.maxAttachments(username); limit > 0 && len(emailReq.Attachments) > limit {
+		writeError(w, "too_many_attachments", fmt.Sprintf("At most %d attachments are allowed", limit))
+		return nil, false
+	}
+
+	// Decode the attachments, the decoded size is capped on its own as base64 hides it in the request size
+	parts := []*message{content}
+	attachmentBytes := 0
+	for _, attachment := range emailReq.Attachments {
+		if ext, blocked := blockedExtension(attachment.Filename, cfg.BlockedExtensions); blocked {
+			writeError(w, "blocked_attachment",
+				fmt.Sprintf("Attachments with the .%s extension are not allowed", ext))
+			return nil, false
+		}
+		part, size, err := attachment.decode()
+		if err != nil {
+			writeError(w, "invalid_attachment",
+				fmt.Sprintf("Attachment %s is not valid base64", attachment.Filename))
+			return nil, false
+		}
+		attachmentBytes += size
+		parts = append(parts, part)
+	}
+	if limit := cfg.maxAttachmentBytes(username); limit > 0 && attachmentBytes > limit {
+		writeErrorFields(w, "attachments_too_large", fmt.Sprintf("The attachments are %d bytes, the limit is %d bytes", attachmentBytes, limit), map[string]any{
+			"size":  attachmentBytes,
+			"limit": limit,
 		})
+		return nil, false
+	}
+
+	// Build email message with proper MIME headers
+	msg := &message{}
+	msg.addHeader("From", title)
+	msg.addHeader("To", toHeader)
+	if ccHeader != "" {
+		msg.addHeader("Cc", ccHeader)
+	}
+	if emailReq.ReplyTo != "" {
+		msg.addHeader("Reply-To", emailReq.ReplyTo)
+	}
+	// Non-ASCII subjects are RFC 2047 encoded like display names, ASCII ones are left unchanged
+	msg.addHeader("Subject", mime.QEncoding.Encode("UTF-8", emailReq.Subject))
+
+	// Every message gets a date and an ID unless the client gave its own as custom headers
+	if _, ok := customHeader(emailReq.Headers, "Date"); !ok {
+		msg.addHeader("Date", time.Now().Format(time.RFC1123Z))
+	}
+	messageID, ok := customHeader(emailReq.Headers, "Message-ID")
+	if !ok {
+		_, domain, _ := strings.Cut(sender, "@")
+		messageID = "<" + newRequestID() + "@" + domain + ">"
+		msg.addHeader("Message-ID", messageID)
+	}
+
+	// Optional diagnostic headers
+	if cfg.XMailerEnabled {
+		msg.addHeader("X-Mailer", mailerHeader())
+	}
+	if cfg.ProcessedByHeader {
+		msg.addHeader("X-Processed-By", fmt.Sprintf("%s; request-id=%s; %s",
+			mailerHeader(), requestID(r.Context()), time.Now().Format(time.RFC1123Z)))
+	}
+
+	// RFC 2045 readers ignore Content-Type and Content-Transfer-Encoding without MIME-Version, a plain
+	// text body in base64 would show up encoded
+	if len(parts) > 1 {
+		msg.addHeader("MIME-Version", "1.0")
+		msg.setMultipart("mixed", parts...)
+	} else {
+		if content.hasMIMEHeaders() {
+			msg.addHeader("MIME-Version", "1.0")
+		}
+		msg.headers = append(msg.headers, content.headers...)
+		msg.body, msg.parts, msg.boundary = content.body, content.parts, content.boundary
+	}
+
+	// Custom headers go last, sorted so the rendering is stable
+	for _, name := range headerNames(emailReq.Headers) {
+		msg.addHeader(name, emailReq.Headers[name])
+	}
+
+	// Give the operator's hooks a last look at the message, they may change its headers
+	env := &Envelope{Principal: username, From: sender, Recipients: recipients, msg: msg}
+	if err := hooks.runPreSend(r.Context(), env); err != nil {
+		writeError(w, "pre_send_rejected", err.Error())
+		return nil, false
+	}
+	data := msg.bytes()
+
+	// Reject messages the mail server would refuse anyway
+	if cfg.MaxMessageBytes > 0 && len(data) > cfg.MaxMessageBytes {
+		writeErrorFields(w, "message_too_large", fmt.Sprintf("The message is %d bytes, the limit is %d bytes", len(data), cfg.MaxMessageBytes), map[string]any{
+			"size":  len(data),
+			"limit": cfg.MaxMessageBytes,
+		})
+		return nil, false
+	}
+
+	return &preparedMessage{
+		env:       env,
+		data:      data,
+		messageID: messageID,
+		warnings:  warnings,
+		isHTML:    isHTMLContent,
+		logger:    logger,
+	}, true
+}
+
+// withTimeout bounds the handler registered for path by its configured endpoint timeout, a request
+// running out of time gets a request_timeout error like any other
+func withTimeout(cfg *Config, path string, handler http.Handler) http.Handler {
+	timeout, ok := cfg.EndpointTimeouts[path]
+	if !ok || timeout == 0 {
+		return handler
+	}
+
+	// http.TimeoutHandler always answers 503 with a fixed body, which is the JSON writeError would write
+	body, _ := json.Marshal(map[string]any{
+		"status":  "error",
+		"code":    "request_timeout",
+		"message": fmt.Sprintf("The request took longer than %s", timeout),
+	})
+	timeoutHandler := http.TimeoutHandler(handler, timeout, string(body)+"\n")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		timeoutHandler.ServeHTTP(&timeoutResponseWriter{ResponseWriter: w, ctx: ctx}, r.WithContext(ctx))
+	})
+}
+
+// timeoutResponseWriter gives the body http.TimeoutHandler writes once ctx ran out a JSON Content-Type,
+// responses of the handler keep their own
+type timeoutResponseWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+func (w *timeoutResponseWriter) WriteHeader(status int) {
+	if status == errorStatus("request_timeout") && w.ctx.Err() != nil && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// GetHealthHandler answers OK in plain text whatever the Accept header asks for
+func GetHealthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeMethodNotAllowed(w, http.MethodGet, http.MethodHead)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
 	}
 }
 
 func main() {
+	// Load configuration from the environment
+	cfg, err := LoadConfig()
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(newLogger(cfg.LogFormat, cfg.LogLevel))
+
 	// Create a rate limiter allowing 10 emails per second per user & a burst of 20
-	rateLimiter := NewRateLimiter(10)
+	// A disabled limiter allows everyone, overrides included, and runs no cleanup goroutine
+	var rateLimiter Limiter = noopLimiter{}
+	if cfg.RateLimitEnabled {
+		rateLimiter = NewRateLimiter(cfg.RateLimitPerSec, cfg.rateLimitOverrides())
+	}
+
+	// Sliding window limits are shared by the endpoints that send
+	windowLimiter := NewSlidingWindowLimiter()
+
+	// Usage records for metering, discarded unless a recorder is configured
+	usage := newUsageRecorder(cfg)
 
-	// Register handlers
-	http.HandleFunc("/mail/send", GetMailHandler(rateLimiter))
+	// Register handlers on a dedicated mux, expvar registers /debug/vars on the default one
+	mux := http.NewServeMux()
+	mailer := NewSMTPMailer(cfg)
+
+	// Sends failing transiently are kept on disk and retried when a queue directory is configured
+	var queue *RetryQueue
+	if cfg.RetryQueueDir != "" {
+		if queue, err = NewRetryQueue(cfg.RetryQueueDir, cfg.RetryQueueKey, mailer, cfg.RetryMaxAttempts, cfg.RetryInitialBackoff, cfg.RetryMaxBackoff); err != nil {
+			slog.Error("Failed to open the retry queue", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Sends with async=true run on a pool of workers when enabled
+	var jobs *JobPool
+	if cfg.AsyncWorkers > 0 {
+		jobs = NewJobPool(cfg.AsyncWorkers, cfg.AsyncQueueSize, cfg.AsyncJobTTL)
+		mux.HandleFunc("/mail/jobs/{id}", GetJobHandler(jobs, cfg))
+	}
+	mux.Handle("/mail/send", withTimeout(cfg, "/mail/send", GetMailHandler(rateLimiter, windowLimiter, mailer, cfg, usage, sendHooks, queue, jobs)))
+	mux.Handle("/mail/send/batch", withTimeout(cfg, "/mail/send/batch", GetBatchHandler(rateLimiter, windowLimiter, mailer, cfg, usage, sendHooks)))
+	mux.Handle("/me/capabilities", withTimeout(cfg, "/me/capabilities", GetCapabilitiesHandler(rateLimiter, mailer, cfg)))
+
+	// Admin endpoints are only available when an admin token is configured
+	if cfg.AdminToken != "" {
+		mux.HandleFunc("/admin/ratelimit", requireAdmin(cfg, GetRateLimitAdminHandler(rateLimiter)))
+		mux.HandleFunc("/admin/principal/{name}/limits", requireAdmin(cfg, GetPrincipalLimitsHandler(rateLimiter, cfg)))
+		if recorder, ok := usage.(*MemoryUsageRecorder); ok {
+			mux.HandleFunc("/admin/usage", requireAdmin(cfg, GetUsageAdminHandler(recorder)))
+		}
+		if cfg.ExpvarEnabled {
+			mux.HandleFunc("/debug/vars", requireAdmin(cfg, expvar.Handler().ServeHTTP))
+		}
+	}
+
+	if cfg.MetricsEnabled {
+		mux.HandleFunc("/metrics", GetMetricsHandler(rateLimiter))
+	}
+
+	mux.HandleFunc("/errors", GetErrorsHandler())
 
 	// Health check endpoint
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+	mux.Handle("/health", withTimeout(cfg, "/health", GetHealthHandler()))
 
 	// Start server
 	port := 1112 // change port if you want
-	log.Printf("Starting mail API server on port %d", port)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	gate := &drainGate{}
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: withRequestID(gate.wrap(withInflight(withLoadShedding(int64(cfg.MaxInflightRequests), mux)))),
+
+		// Connections are accepted before authentication, so slow clients must not hold them forever
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	go func() {
+		slog.Info("Starting mail API server", "port", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Failed to start server", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Wait for a termination signal, then answer new requests with 503 while the in-flight ones finish
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	slog.Info("Shutting down, waiting for in-flight requests to finish")
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGracePeriod)
+	defer cancel()
+	if remaining := gate.drain(ctx); remaining > 0 {
+		slog.Warn("Grace period expired with requests still in flight", "grace_period", cfg.ShutdownGracePeriod.String(), "in_flight", remaining)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Shutdown did not complete cleanly", "error", err)
+	}
+	if jobs != nil {
+		if pending := jobs.Close(ctx); pending > 0 {
+			slog.Warn("Grace period expired with asynchronous sends still pending", "pending", pending)
+		}
+	}
+	rateLimiter.Close()
+	if queue != nil {
+		queue.Close()
 	}
+	slog.Info("Server stopped")
 }
@@ -0,0 +1,1909 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// newTestConfig loads the configuration from the environment with the mail server set to server when it
+// isn't nil, env adds or overrides variables for the test
+func newTestConfig(t *testing.T, server *fakeSMTP, env map[string]string) *Config {
+	t.Helper()
+	if server != nil {
+		host, port, err := net.SplitHostPort(server.addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("SMTP_HOST", host)
+		t.Setenv("SMTP_PORT", port)
+		t.Setenv("SMTP_AUTH_ORDER", "auth-first")
+	}
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	return cfg
+}
+
+// newTestRateLimiter creates a rate limiter whose cleanup goroutine is stopped when the test ends
+func newTestRateLimiter(t *testing.T, maxPerSec int, overrides map[string]RateLimitSettings) *RateLimiter {
+	t.Helper()
+	rl := NewRateLimiter(maxPerSec, overrides)
+	t.Cleanup(rl.Close)
+	return rl
+}
+
+// prepareTestMessage assembles the message of emailReq for the test user, failing the test when it is refused
+func prepareTestMessage(t *testing.T, cfg *Config, emailReq *EmailRequest) *preparedMessage {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/mail/send", nil)
+	prepared, ok := prepareMessage(rec, req, emailReq, "user@example.com", cfg, newTestRateLimiter(t, 10, nil), Hooks{})
+	if !ok {
+		t.Fatalf("prepareMessage() refused the message: %d %s", rec.Code, rec.Body)
+	}
+	return prepared
+}
+
+// messageHeaders returns the top level header section of a rendered message
+func messageHeaders(data []byte) string {
+	headers, _, _ := strings.Cut(string(data), "\r\n\r\n")
+	return headers + "\r\n"
+}
+
+func TestPrepareMessageMIMEVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		request EmailRequest
+		wantCTE string
+	}{
+		{"plain text", EmailRequest{Content: "hello"}, ""},
+		{"plain text in base64", EmailRequest{Content: "hello", Encoding: "base64"}, "base64"},
+		{"plain text in quoted-printable", EmailRequest{Content: "hello", Encoding: "quoted-printable"}, "quoted-printable"},
+		{"html", EmailRequest{Content: "<p>hello</p>", ContentType: "text/html"}, ""},
+		{"html and text", EmailRequest{Content: "<p>hello</p>", TextContent: "hello"}, ""},
+	}
+	cfg := newTestConfig(t, nil, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.request.To = []string{"to@example.com"}
+			tt.request.Subject = "hi"
+			headers := messageHeaders(prepareTestMessage(t, cfg, &tt.request).data)
+
+			if !strings.Contains(headers, "\r\nMIME-Version: 1.0\r\n") {
+				t.Errorf("MIME-Version missing from headers:\n%s", headers)
+			}
+			if tt.wantCTE != "" && !strings.Contains(headers, "\r\nContent-Transfer-Encoding: "+tt.wantCTE+"\r\n") {
+				t.Errorf("Content-Transfer-Encoding %s missing from headers:\n%s", tt.wantCTE, headers)
+			}
+		})
+	}
+}
+
+func TestPrepareMessageXMailer(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled string
+		want    bool
+	}{
+		{"enabled", "true", true},
+		{"disabled", "false", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, map[string]string{"X_MAILER_ENABLED": tt.enabled})
+			headers := messageHeaders(prepareTestMessage(t, cfg, &EmailRequest{To: []string{"to@example.com"}, Subject: "hi", Content: "hello"}).data)
+			if got := strings.Contains(headers, "\r\nX-Mailer: "+mailerHeader()+"\r\n"); got != tt.want {
+				t.Errorf("X-Mailer present = %v, want %v in headers:\n%s", got, tt.want, headers)
+			}
+		})
+	}
+}
+
+// postEmail sends body to the mail handler with the credentials, headers adds request headers
+func postEmail(t *testing.T, handler http.HandlerFunc, password, body string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/mail/send", strings.NewReader(body))
+	req.SetBasicAuth("user@example.com", password)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// A retry with the Message-ID of a sent message is replayed before any limit is charged
+func TestMailHandlerMessageIDDedupe(t *testing.T) {
+	const body = `{"to":["to@example.com"],"subject":"hi","content":"hello","headers":{"Message-ID":"<retry-1@example.com>"}}`
+	tests := []struct {
+		name string
+		env  map[string]string
+		// exhaust spends the rate limit left after the first send
+		exhaust bool
+	}{
+		{"rate limit exhausted", nil, true},
+		{"sliding window full", map[string]string{"RATE_WINDOW_MAX": "1", "RATE_WINDOW": "1h"}, false},
+		{"per recipient cost", map[string]string{"RATE_LIMIT_COST": "recipients"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t, "AUTH PLAIN")
+			env := map[string]string{"MESSAGE_ID_DEDUPE_TTL": "1h"}
+			for key, value := range tt.env {
+				env[key] = value
+			}
+			cfg := newTestConfig(t, server, env)
+			rateLimiter := newTestRateLimiter(t, 1, nil)
+			handler := GetMailHandler(rateLimiter, NewSlidingWindowLimiter(), NewSMTPMailer(cfg), cfg, nopUsageRecorder{}, Hooks{}, nil, nil)
+
+			if rec := postEmail(t, handler, "secret", body, nil); rec.Code != http.StatusOK {
+				t.Fatalf("first send got %d %s, want 200", rec.Code, rec.Body)
+			}
+			if tt.exhaust {
+				for rateLimiter.Allow("user@example.com") {
+				}
+			}
+			rec := postEmail(t, handler, "secret", body, nil)
+			if rec.Code != http.StatusOK || rec.Header().Get("X-Deduplicated") != "true" {
+				t.Errorf("retry got %d with X-Deduplicated %q, want the replayed 200", rec.Code, rec.Header().Get("X-Deduplicated"))
+			}
+			if messages, _ := server.delivered(); len(messages) != 1 {
+				t.Errorf("server got %d messages, want 1", len(messages))
+			}
+		})
+	}
+}
+
+// The stored response of a Message-ID isn't replayed to other credentials of the same username
+func TestMailHandlerMessageIDDedupeScopedToCredentials(t *testing.T) {
+	const body = `{"to":["to@example.com"],"subject":"hi","content":"hello","headers":{"Message-ID":"<retry-2@example.com>"}}`
+	server := newFakeSMTP(t, "AUTH PLAIN")
+	cfg := newTestConfig(t, server, map[string]string{"MESSAGE_ID_DEDUPE_TTL": "1h"})
+	handler := GetMailHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), NewSMTPMailer(cfg), cfg, nopUsageRecorder{}, Hooks{}, nil, nil)
+
+	postEmail(t, handler, "secret", body, nil)
+	rec := postEmail(t, handler, "guessed", body, nil)
+	if rec.Header().Get("X-Deduplicated") == "true" {
+		t.Error("the response was replayed to a different password")
+	}
+}
+
+func TestJSONKeyScanner(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		keyDepth int
+		want     bool
+	}{
+		{"top level key", `{"to":["a@example.com"],"attachments":[]}`, 1, true},
+		{"first key", `{"attachments":[{"filename":"a.txt"}]}`, 1, true},
+		{"case-insensitive", `{"Attachments":[]}`, 1, true},
+		{"no attachments", `{"to":["a@example.com"],"content":"hello"}`, 1, false},
+		{"value not a key", `{"content":"attachments"}`, 1, false},
+		{"nested object", `{"headers":{"attachments":"x"}}`, 1, false},
+		{"escaped key", `{"\u0061ttachments":[]}`, 1, false},
+		{"quote in a value", `{"content":"say \"attachments\"","x":1}`, 1, false},
+		{"longer key", `{"attachments_list":[]}`, 1, false},
+		{"email of a batch", `[{"to":["a@example.com"]},{"attachments":[]}]`, 2, true},
+		{"batch without attachments", `[{"content":"attachments"}]`, 2, false},
+		{"top level key of a batch", `{"attachments":[]}`, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Feed one byte at a time so keys are split across reads
+			s := jsonKeyScanner{keyDepth: tt.keyDepth, key: "attachments"}
+			got := false
+			for i := 0; i < len(tt.body) && !got; i++ {
+				got = s.scan([]byte{tt.body[i]})
+			}
+			if got != tt.want {
+				t.Errorf("scan(%s) = %v, want %v", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttachmentLimitReader(t *testing.T) {
+	const limit = 1 << 10
+	padding := strings.Repeat("x", 1<<20)
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{
+		{"small body", `{"content":"hello"}`, false},
+		{"large body without attachments", `{"content":"` + padding + `"}`, true},
+		{"large body with attachments", `{"attachments":[{"content":"` + padding + `"}]}`, false},
+		{"attachments key after the limit", `{"content":"` + padding + `","attachments":[]}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := strings.NewReader(tt.body)
+			_, err := io.ReadAll(newAttachmentLimitReader(source, limit, 1))
+			var maxBytesErr *http.MaxBytesError
+			if gotErr := errors.As(err, &maxBytesErr); gotErr != tt.wantErr {
+				t.Fatalf("ReadAll() error = %v, want a MaxBytesError: %v", err, tt.wantErr)
+			}
+			// The body is refused as soon as it passes the limit, not once it was read whole
+			if tt.wantErr && source.Len() == 0 {
+				t.Error("the whole body was read before it was refused")
+			}
+		})
+	}
+}
+
+func TestMailHandlerRefusesLargeBodyWithoutAttachments(t *testing.T) {
+	cfg := newTestConfig(t, nil, map[string]string{"MAX_REQUEST_BYTES": "1024", "MAX_ATTACHMENT_REQUEST_BYTES": "4194304"})
+	handler := GetMailHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), nil, cfg, nopUsageRecorder{}, Hooks{}, nil, nil)
+
+	body := `{"to":["to@example.com"],"subject":"hi","content":"` + strings.Repeat("x", 1<<20) + `"}`
+	if rec := postEmail(t, handler, "secret", body, nil); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got %d %s, want 413", rec.Code, rec.Body)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	tests := []struct {
+		name            string
+		delay           time.Duration
+		wantStatus      int
+		wantContentType string
+		wantCode        string
+	}{
+		{"timed out", 200 * time.Millisecond, http.StatusServiceUnavailable, "application/json; charset=utf-8", "request_timeout"},
+		{"in time", 0, http.StatusOK, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{EndpointTimeouts: map[string]time.Duration{"/health": 50 * time.Millisecond}}
+			handler := withTimeout(cfg, "/health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(tt.delay):
+				case <-r.Context().Done():
+				}
+				w.Write([]byte("OK"))
+			}))
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			var body struct{ Status, Code string }
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q isn't JSON: %v", rec.Body, err)
+			}
+			if body.Status != "error" || body.Code != tt.wantCode {
+				t.Errorf("body = %+v, want an error with code %s", body, tt.wantCode)
+			}
+			if errorStatus(body.Code) != rec.Code {
+				t.Errorf("code %s is registered with %d, answered with %d", body.Code, errorStatus(body.Code), rec.Code)
+			}
+		})
+	}
+}
+
+// A transaction failing after earlier ones were delivered reports every recipient and is never queued
+func TestMailHandlerPartialDelivery(t *testing.T) {
+	const body = `{"to":["a@example.com","b@example.com","c@example.com"],"subject":"hi","content":"hello"}`
+	tests := []struct {
+		name  string
+		reply string
+	}{
+		{"refused", "550 5.1.1 no such user"},
+		{"temporarily refused", "450 4.2.1 try again later"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t, "AUTH PLAIN")
+			server.rcptReplies["b@example.com"] = tt.reply
+			cfg := newTestConfig(t, server, map[string]string{"SMTP_MAX_RECIPIENTS_PER_TRANSACTION": "1"})
+			mailer := NewSMTPMailer(cfg)
+			queue, err := NewRetryQueue(t.TempDir(), nil, mailer, 3, time.Hour, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer queue.Close()
+			handler := GetMailHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), mailer, cfg, nopUsageRecorder{}, Hooks{}, queue, nil)
+
+			rec := postEmail(t, handler, "secret", body, nil)
+			if rec.Code != http.StatusMultiStatus {
+				t.Fatalf("got %d %s, want 207", rec.Code, rec.Body)
+			}
+			var response struct {
+				Status  string
+				Results []recipientStatus
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{"a@example.com": "sent", "b@example.com": "failed", "c@example.com": "failed"}
+			if response.Status != "partial" || len(response.Results) != len(want) {
+				t.Fatalf("response = %+v, want a partial status with %d results", response, len(want))
+			}
+			for _, result := range response.Results {
+				if result.Status != want[result.Recipient] {
+					t.Errorf("%s: status = %s, want %s", result.Recipient, result.Status, want[result.Recipient])
+				}
+			}
+			if queue.Len() != 0 {
+				t.Errorf("queue holds %d jobs, a partly delivered message must not be retried", queue.Len())
+			}
+		})
+	}
+}
+
+// per_recipient sends every message over one session, a refused recipient doesn't fail the others
+func TestMailHandlerPerRecipient(t *testing.T) {
+	const body = `{"to":["a@example.com","b@example.com","c@example.com"],"subject":"hi","content":"hello","per_recipient":true}`
+	tests := []struct {
+		name       string
+		refused    string
+		wantStatus int
+		wantSent   int
+	}{
+		{"every recipient accepted", "", http.StatusOK, 3},
+		{"one recipient refused", "b@example.com", http.StatusMultiStatus, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t, "AUTH PLAIN")
+			if tt.refused != "" {
+				server.rcptReplies[tt.refused] = "550 5.1.1 no such user"
+			}
+			cfg := newTestConfig(t, server, nil)
+			handler := GetMailHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), NewSMTPMailer(cfg), cfg, nopUsageRecorder{}, Hooks{}, nil, nil)
+
+			rec := postEmail(t, handler, "secret", body, nil)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			var response struct{ Results []recipientStatus }
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			for _, result := range response.Results {
+				want := "sent"
+				if result.Recipient == tt.refused {
+					want = "failed"
+				}
+				if result.Status != want {
+					t.Errorf("%s: status = %s, want %s", result.Recipient, result.Status, want)
+				}
+			}
+			if messages, _ := server.delivered(); len(messages) != tt.wantSent {
+				t.Errorf("server got %d messages, want %d", len(messages), tt.wantSent)
+			}
+			if n := server.connections(); n != 1 {
+				t.Errorf("server got %d sessions, want 1", n)
+			}
+		})
+	}
+}
+
+// A connection dropped in the middle of a per_recipient send is reopened for the remaining messages
+func TestMailHandlerPerRecipientReconnect(t *testing.T) {
+	const body = `{"to":["a@example.com","b@example.com","c@example.com","d@example.com"],"subject":"hi","content":"hello","per_recipient":true}`
+	tests := []struct {
+		name      string
+		dropAfter int
+	}{
+		{"after the first message", 1},
+		{"after the third message", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t, "AUTH PLAIN")
+			server.dropAfter = tt.dropAfter
+			cfg := newTestConfig(t, server, nil)
+			handler := GetMailHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), NewSMTPMailer(cfg), cfg, nopUsageRecorder{}, Hooks{}, nil, nil)
+
+			rec := postEmail(t, handler, "secret", body, nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got %d %s, want 200", rec.Code, rec.Body)
+			}
+			_, recipients := server.delivered()
+			var got []string
+			for _, batch := range recipients {
+				got = append(got, batch...)
+			}
+			if strings.Join(got, ",") != "a@example.com,b@example.com,c@example.com,d@example.com" {
+				t.Errorf("server got messages for %v, want every recipient once", got)
+			}
+			if n := server.connections(); n != 2 {
+				t.Errorf("server got %d sessions, want 2", n)
+			}
+		})
+	}
+}
+
+// A principal's attachment limits replace the global ones, other users keep the defaults
+func TestPrepareMessagePrincipalAttachmentLimits(t *testing.T) {
+	principals := filepath.Join(t.TempDir(), "principals.json")
+	if err := os.WriteFile(principals, []byte(`{"trusted@example.com": {"max_attachment_bytes": 4096, "max_attachments": 3}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := newTestConfig(t, nil, map[string]string{
+		"PRINCIPALS_FILE":      principals,
+		"MAX_ATTACHMENT_BYTES": "1024",
+		"MAX_ATTACHMENTS":      "1",
+	})
+	attachment := func(size int) Attachment {
+		return Attachment{Filename: "file.txt", Data: base64.StdEncoding.EncodeToString(make([]byte, size))}
+	}
+
+	tests := []struct {
+		name        string
+		username    string
+		attachments []Attachment
+		wantCode    string
+	}{
+		{"default size", "user@example.com", []Attachment{attachment(1024)}, ""},
+		{"above the default size", "user@example.com", []Attachment{attachment(2048)}, "attachments_too_large"},
+		{"above the default count", "user@example.com", []Attachment{attachment(10), attachment(10)}, "too_many_attachments"},
+		{"principal size", "trusted@example.com", []Attachment{attachment(2048)}, ""},
+		{"above the principal size", "trusted@example.com", []Attachment{attachment(8192)}, "attachments_too_large"},
+		{"principal count", "trusted@example.com", []Attachment{attachment(10), attachment(10), attachment(10)}, ""},
+		{"above the principal count", "trusted@example.com", []Attachment{attachment(1), attachment(1), attachment(1), attachment(1)}, "too_many_attachments"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			emailReq := &EmailRequest{To: []string{"to@example.com"}, Subject: "hi", Content: "hello", Attachments: tt.attachments}
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/mail/send", nil)
+			_, ok := prepareMessage(rec, req, emailReq, tt.username, cfg, newTestRateLimiter(t, 10, nil), Hooks{})
+			if tt.wantCode == "" {
+				if !ok {
+					t.Errorf("prepareMessage() refused the message: %d %s", rec.Code, rec.Body)
+				}
+				return
+			}
+			var body struct{ Code string }
+			json.Unmarshal(rec.Body.Bytes(), &body)
+			if ok || body.Code != tt.wantCode || rec.Code != errorStatus(tt.wantCode) {
+				t.Errorf("got ok = %v, %d %s, want %s", ok, rec.Code, rec.Body, tt.wantCode)
+			}
+		})
+	}
+}
+
+// The recipient entries are counted before any of them is parsed
+func TestPrepareMessageRecipientBound(t *testing.T) {
+	entries := func(n int, address string) []string {
+		list := make([]string, n)
+		for i := range list {
+			list[i] = address
+		}
+		return list
+	}
+	tests := []struct {
+		name     string
+		to       []string
+		cc       []string
+		bcc      []string
+		wantCode string
+	}{
+		{"at the limit", entries(3, "to@example.com"), entries(1, "cc@example.com"), entries(1, "bcc@example.com"), ""},
+		{"over the limit combined", entries(3, "to@example.com"), entries(2, "cc@example.com"), entries(1, "bcc@example.com"), "too_many_recipients"},
+		{"thousands of invalid entries", entries(100000, "x"), nil, nil, "too_many_recipients"},
+		{"invalid entries under the limit", entries(2, "x"), nil, nil, "validation_failed"},
+	}
+	cfg := newTestConfig(t, nil, map[string]string{"MAX_RECIPIENTS": "5"})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			emailReq := &EmailRequest{To: tt.to, Cc: tt.cc, Bcc: tt.bcc, Subject: "hi", Content: "hello"}
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/mail/send", nil)
+			_, ok := prepareMessage(rec, req, emailReq, "user@example.com", cfg, newTestRateLimiter(t, 10, nil), Hooks{})
+			var body struct{ Code string }
+			json.Unmarshal(rec.Body.Bytes(), &body)
+			if ok != (tt.wantCode == "") || body.Code != tt.wantCode {
+				t.Errorf("got ok = %v, %d %s, want code %q", ok, rec.Code, rec.Body, tt.wantCode)
+			}
+			if tt.wantCode != "" && rec.Code != errorStatus(tt.wantCode) {
+				t.Errorf("status = %d, want %d", rec.Code, errorStatus(tt.wantCode))
+			}
+		})
+	}
+}
+
+// fakeMailer records the submissions of the handler instead of sending them
+type fakeMailer struct {
+	submissions []*Submission
+	err         error
+}
+
+func (m *fakeMailer) Send(ctx context.Context, submission *Submission) (*sendResult, error) {
+	m.submissions = append(m.submissions, submission)
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &sendResult{Response: "2.0.0 Ok: queued"}, nil
+}
+
+func (m *fakeMailer) SendBatch(ctx context.Context, username, password string, items []*batchItem) error {
+	for _, item := range items {
+		item.done = true
+		item.response, item.err = "2.0.0 Ok: queued", m.err
+	}
+	return nil
+}
+
+// No endpoint negotiates, a missing Accept header and */* get the default content type of the endpoint
+func TestHandlersDefaultContentType(t *testing.T) {
+	cfg := newTestConfig(t, nil, nil)
+	mailHandler := GetMailHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), &fakeMailer{}, cfg, nopUsageRecorder{}, Hooks{}, nil, nil)
+	tests := []struct {
+		name       string
+		path       string
+		method     string
+		accept     string
+		wantStatus int
+		wantType   string
+	}{
+		{"send without Accept", "/mail/send", http.MethodPost, "", http.StatusOK, "application/json; charset=utf-8"},
+		{"send accepting anything", "/mail/send", http.MethodPost, "*/*", http.StatusOK, "application/json; charset=utf-8"},
+		{"health without Accept", "/health", http.MethodGet, "", http.StatusOK, "text/plain; charset=utf-8"},
+		{"health accepting anything", "/health", http.MethodGet, "*/*", http.StatusOK, "text/plain; charset=utf-8"},
+		{"health head", "/health", http.MethodHead, "", http.StatusOK, "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req *http.Request
+			handler := GetHealthHandler()
+			if tt.path == "/mail/send" {
+				req = httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"to":["to@example.com"],"subject":"hi","content":"hello"}`))
+				req.SetBasicAuth("user@example.com", "secret")
+				handler = mailHandler
+			} else {
+				req = httptest.NewRequest(tt.method, tt.path, nil)
+			}
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.wantStatus || rec.Header().Get("Content-Type") != tt.wantType {
+				t.Errorf("got %d with Content-Type %q, want %d %q: %s", rec.Code, rec.Header().Get("Content-Type"), tt.wantStatus, tt.wantType, rec.Body)
+			}
+		})
+	}
+}
+
+func TestMailHandlerWithFakeMailer(t *testing.T) {
+	const body = `{"to":["to@example.com"],"cc":["cc@example.com"],"bcc":["hidden@example.com"],"subject":"hi","content":"hello"}`
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+	}{
+		{"accepted", nil, http.StatusOK},
+		{"refused", &textproto.Error{Code: 554, Msg: "5.7.1 rejected"}, errorStatus("send_failed")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, nil)
+			mailer := &fakeMailer{err: tt.err}
+			handler := GetMailHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), mailer, cfg, nopUsageRecorder{}, Hooks{}, nil, nil)
+
+			rec := postEmail(t, handler, "secret", body, nil)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			if len(mailer.submissions) != 1 {
+				t.Fatalf("mailer got %d submissions, want 1", len(mailer.submissions))
+			}
+			submission := mailer.submissions[0]
+			if submission.Username != "user@example.com" || submission.Password != "secret" || submission.From != "user@example.com" {
+				t.Errorf("submission is from %s:%s as %s, want the authenticated user", submission.Username, submission.Password, submission.From)
+			}
+			if got, want := strings.Join(submission.To, ","), "to@example.com,cc@example.com,hidden@example.com"; got != want {
+				t.Errorf("envelope recipients = %s, want %s", got, want)
+			}
+			headers := messageHeaders(submission.Message)
+			if !strings.Contains(headers, "\r\nTo: to@example.com\r\n") || !strings.Contains(headers, "\r\nCc: cc@example.com\r\n") {
+				t.Errorf("To and Cc missing from headers:\n%s", headers)
+			}
+			if strings.Contains(string(submission.Message), "hidden@example.com") {
+				t.Errorf("the message reveals the Bcc recipient:\n%s", submission.Message)
+			}
+		})
+	}
+}
+
+func TestMethodNotAllowedAllowHeader(t *testing.T) {
+	cfg := newTestConfig(t, nil, nil)
+	limiter := newTestRateLimiter(t, 10, nil)
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		method    string
+		wantAllow string
+	}{
+		{"send", GetMailHandler(limiter, NewSlidingWindowLimiter(), &fakeMailer{}, cfg, nopUsageRecorder{}, Hooks{}, nil, nil), http.MethodGet, "POST"},
+		{"batch", GetBatchHandler(limiter, NewSlidingWindowLimiter(), &fakeMailer{}, cfg, nopUsageRecorder{}, Hooks{}), http.MethodPut, "POST"},
+		{"rate limit admin", GetRateLimitAdminHandler(limiter), http.MethodPost, "GET, PUT"},
+		{"errors", GetErrorsHandler(), http.MethodDelete, "GET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tt.handler(rec, httptest.NewRequest(tt.method, "/", nil))
+			if rec.Code != http.StatusMethodNotAllowed || !strings.Contains(rec.Body.String(), "method_not_allowed") {
+				t.Errorf("got %d %s, want 405 method_not_allowed", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestParseBasicAuth(t *testing.T) {
+	basic := func(credentials string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+	tests := []struct {
+		name         string
+		header       string
+		maxBytes     int
+		wantUsername string
+		wantPassword string
+		wantCode     string
+	}{
+		{"valid", basic("user@example.com:pa:ss"), 0, "user@example.com", "pa:ss", ""},
+		{"lower case scheme", "basic " + base64.StdEncoding.EncodeToString([]byte("user@example.com:secret")), 0, "user@example.com", "secret", ""},
+		{"missing", "", 0, "", "", "auth_missing"},
+		{"bearer", "Bearer token", 0, "", "", "auth_unsupported_scheme"},
+		{"too large", basic("user@example.com:" + strings.Repeat("x", 100)), 64, "", "", "auth_too_large"},
+		{"not base64", "Basic !!!", 0, "", "", "auth_malformed"},
+		{"no colon", basic("user@example.com"), 0, "", "", "auth_malformed"},
+		{"header injection", basic("user@example.com\r\nBcc: victim@example.com:secret"), 0, "", "", "auth_malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			username, password, authErr := parseBasicAuth(tt.header, tt.maxBytes)
+			var code string
+			if authErr != nil {
+				code = authErr.code
+			}
+			if username != tt.wantUsername || password != tt.wantPassword || code != tt.wantCode {
+				t.Errorf("parseBasicAuth() = %q, %q, %q, want %q, %q, %q", username, password, code, tt.wantUsername, tt.wantPassword, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestMailHandlerRateLimitHeaders(t *testing.T) {
+	const body = `{"to":["to@example.com"],"subject":"hi","content":"hello"}`
+	type response struct {
+		status     int
+		limit      string
+		remaining  string
+		retryAfter string
+	}
+	tests := []struct {
+		name    string
+		limiter Limiter
+		want    []response
+	}{
+		{"limited", newTestRateLimiter(t, 1, nil), []response{
+			{http.StatusOK, "2", "1", ""},
+			{http.StatusOK, "2", "0", ""},
+			{http.StatusTooManyRequests, "2", "0", "1"},
+		}},
+		{"disabled", noopLimiter{}, []response{
+			{http.StatusOK, "unlimited", "unlimited", ""},
+			{http.StatusOK, "unlimited", "unlimited", ""},
+			{http.StatusOK, "unlimited", "unlimited", ""},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, nil)
+			handler := GetMailHandler(tt.limiter, NewSlidingWindowLimiter(), &fakeMailer{}, cfg, nopUsageRecorder{}, Hooks{}, nil, nil)
+			for i, want := range tt.want {
+				rec := postEmail(t, handler, "secret", body, nil)
+				got := response{rec.Code, rec.Header().Get("X-RateLimit-Limit"), rec.Header().Get("X-RateLimit-Remaining"), rec.Header().Get("Retry-After")}
+				if got != want {
+					t.Errorf("request %d got %+v, want %+v", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterOverrides(t *testing.T) {
+	principals := filepath.Join(t.TempDir(), "principals.json")
+	if err := os.WriteFile(principals, []byte(`{
+		"vip@example.com": {"rate_limit": {"max_per_sec": 5, "burst": 10}},
+		"free@example.com": {"rate_limit": {"max_per_sec": 0}}
+	}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := newTestConfig(t, nil, map[string]string{"PRINCIPALS_FILE": principals, "RATE_LIMIT_PER_SEC": "1"})
+	limiter := newTestRateLimiter(t, cfg.RateLimitPerSec, cfg.rateLimitOverrides())
+
+	tests := []struct {
+		user          string
+		wantMaxPerSec int
+		wantBurst     int
+		wantAllowed   int
+	}{
+		{"user@example.com", 1, 2, 2},
+		{"vip@example.com", 5, 10, 10},
+		{"free@example.com", 0, 0, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			if maxPerSec, burst := limiter.UserLimits(tt.user); maxPerSec != tt.wantMaxPerSec || burst != tt.wantBurst {
+				t.Errorf("UserLimits() = %d, %d, want %d, %d", maxPerSec, burst, tt.wantMaxPerSec, tt.wantBurst)
+			}
+			allowed := 0
+			for range 20 {
+				if limiter.Allow(tt.user) {
+					allowed++
+				}
+			}
+			if allowed != tt.wantAllowed {
+				t.Errorf("allowed %d of 20 requests, want %d", allowed, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestPrepareMessageSubjectEncoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		subject string
+		encoded bool
+	}{
+		{"ascii", "Meeting at 10", false},
+		{"accents", "Café menu", true},
+		{"emoji", "Launch 🚀", true},
+		{"long", strings.Repeat("Grüße ", 20), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, nil)
+			prepared := prepareTestMessage(t, cfg, &EmailRequest{To: []string{"to@example.com"}, Subject: tt.subject, Content: "hello"})
+			msg, err := mail.ReadMessage(strings.NewReader(string(prepared.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw := msg.Header.Get("Subject")
+			if isEncoded := strings.HasPrefix(raw, "=?UTF-8?"); isEncoded != tt.encoded {
+				t.Errorf("Subject = %q, want it encoded: %v", raw, tt.encoded)
+			}
+			decoded, err := new(mime.WordDecoder).DecodeHeader(raw)
+			if err != nil || decoded != tt.subject {
+				t.Errorf("Subject decodes to %q, %v, want %q", decoded, err, tt.subject)
+			}
+		})
+	}
+}
+
+func TestPrepareMessageDateAndMessageID(t *testing.T) {
+	tests := []struct {
+		name          string
+		headers       map[string]string
+		wantDate      string
+		wantMessageID string
+	}{
+		{"generated", nil, "", ""},
+		{"client given", map[string]string{"Date": "Mon, 02 Jan 2006 15:04:05 +0000", "Message-Id": "<order-7@shop.example>"},
+			"Mon, 02 Jan 2006 15:04:05 +0000", "<order-7@shop.example>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, nil)
+			prepared := prepareTestMessage(t, cfg, &EmailRequest{To: []string{"to@example.com"}, Subject: "hi", Content: "hello", Headers: tt.headers})
+			msg, err := mail.ReadMessage(strings.NewReader(string(prepared.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(msg.Header["Date"]); n != 1 {
+				t.Errorf("message has %d Date headers, want 1", n)
+			}
+			if n := len(msg.Header["Message-Id"]); n != 1 {
+				t.Errorf("message has %d Message-ID headers, want 1", n)
+			}
+			if _, err := msg.Header.Date(); err != nil {
+				t.Errorf("Date header doesn't parse: %v", err)
+			}
+
+			messageID := msg.Header.Get("Message-ID")
+			if messageID != prepared.messageID {
+				t.Errorf("Message-ID = %s, want the one returned to the client %s", messageID, prepared.messageID)
+			}
+			if tt.wantDate != "" && msg.Header.Get("Date") != tt.wantDate {
+				t.Errorf("Date = %s, want %s", msg.Header.Get("Date"), tt.wantDate)
+			}
+			if tt.wantMessageID != "" && messageID != tt.wantMessageID {
+				t.Errorf("Message-ID = %s, want %s", messageID, tt.wantMessageID)
+			}
+			if tt.wantMessageID == "" && !strings.HasSuffix(messageID, "@example.com>") {
+				t.Errorf("Message-ID = %s, want one at the sender's domain", messageID)
+			}
+		})
+	}
+}
+
+func TestPrepareMessageFromDisplayName(t *testing.T) {
+	tests := []struct {
+		name  string
+		title string
+		want  string
+	}{
+		{"derived from the username", "", "User"},
+		{"plain", "Support Team", "Support Team"},
+		{"quotes", `The "Best" Shop`, `The "Best" Shop`},
+		{"backslash", `Sales \ Billing`, `Sales \ Billing`},
+		{"non-ascii", "Café Zoë", "Café Zoë"},
+	}
+	cfg := newTestConfig(t, nil, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prepared := prepareTestMessage(t, cfg, &EmailRequest{To: []string{"to@example.com"}, Subject: "hi", Content: "hello", Title: tt.title})
+			msg, err := mail.ReadMessage(strings.NewReader(string(prepared.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			from, err := msg.Header.AddressList("From")
+			if err != nil || len(from) != 1 {
+				t.Fatalf("From %q doesn't parse: %v", msg.Header.Get("From"), err)
+			}
+			if from[0].Name != tt.want || from[0].Address != "user@example.com" {
+				t.Errorf("From = %q <%s>, want %q <user@example.com>", from[0].Name, from[0].Address, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		value  any
+		want   string
+	}{
+		{"object", http.StatusOK, map[string]string{"status": "success"}, `{"status":"success"}` + "\n"},
+		{"non-ascii", http.StatusCreated, map[string]string{"name": "Zoë"}, `{"name":"Zoë"}` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeJSON(rec, tt.status, tt.value)
+			if got := rec.Header().Get("Content-Type"); got != "application/json; charset=utf-8" {
+				t.Errorf("Content-Type = %q, want application/json with the charset", got)
+			}
+			if rec.Code != tt.status || rec.Body.String() != tt.want {
+				t.Errorf("got %d %q, want %d %q", rec.Code, rec.Body, tt.status, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"unchanged", "hello\nworld", "hello\nworld"},
+		{"byte order mark", "\uFEFFhello", "hello"},
+		{"trailing whitespace", "hello \r\n\t\n", "hello"},
+		{"leading whitespace kept", "  hello", "  hello"},
+		{"both", "\uFEFF  hello\n\n", "  hello"},
+		{"only whitespace", " \n ", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeBody(tt.content); got != tt.want {
+				t.Errorf("normalizeBody(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareMessageNormalizesBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		content string
+		want    string
+	}{
+		{"text by default", nil, "\uFEFFhello  \n\n", "hello"},
+		{"text disabled", map[string]string{"NORMALIZE_TEXT_BODY": "false"}, "hello  \n\n", "hello  \r\n\r\n"},
+		{"html kept by default", nil, "<p>hello</p>  \n\n", "<p>hello</p>  \r\n\r\n"},
+		{"html enabled", map[string]string{"NORMALIZE_HTML_BODY": "true"}, "<p>hello</p>  \n\n", "<p>hello</p>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, tt.env)
+			prepared := prepareTestMessage(t, cfg, &EmailRequest{To: []string{"to@example.com"}, Subject: "hi", Content: tt.content})
+			_, body, _ := strings.Cut(string(prepared.data), "\r\n\r\n")
+			if body != tt.want {
+				t.Errorf("body = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareMessageVisibleRecipientWarning(t *testing.T) {
+	addresses := func(n int, domain string) []string {
+		var list []string
+		for i := range n {
+			list = append(list, fmt.Sprintf("r%d@%s", i, domain))
+		}
+		return list
+	}
+	tests := []struct {
+		name        string
+		threshold   string
+		to, cc, bcc []string
+		wantWarning bool
+	}{
+		{"at the threshold", "3", addresses(2, "to.example"), addresses(1, "cc.example"), nil, false},
+		{"to and cc over", "3", addresses(2, "to.example"), addresses(2, "cc.example"), nil, true},
+		{"bcc not counted", "3", addresses(1, "to.example"), nil, addresses(5, "bcc.example"), false},
+		{"disabled", "0", addresses(20, "to.example"), nil, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, map[string]string{"VISIBLE_RECIPIENT_WARNING_THRESHOLD": tt.threshold})
+			prepared := prepareTestMessage(t, cfg, &EmailRequest{To: tt.to, Cc: tt.cc, Bcc: tt.bcc, Subject: "hi", Content: "hello"})
+			warned := strings.Contains(strings.Join(prepared.warnings, "\n"), "can see each other")
+			if warned != tt.wantWarning {
+				t.Errorf("warnings = %q, want the visible recipients warning: %v", prepared.warnings, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestRateLimiterStats(t *testing.T) {
+	limiter := newTestRateLimiter(t, 10, nil)
+	for _, user := range []string{"idle@example.com", "busy@example.com", "new@example.com"} {
+		limiter.Allow(user)
+	}
+	limiter.mutex.Lock()
+	limiter.lastRefill["idle@example.com"] = time.Now().Add(-2 * time.Hour)
+	limiter.mutex.Unlock()
+
+	tests := []struct {
+		name    string
+		cleanup bool
+		want    RateLimiterStats
+	}{
+		{"new users are tracked", false, RateLimiterStats{TrackedUsers: 3}},
+		{"first cleanup evicts the idle user", true, RateLimiterStats{TrackedUsers: 2, Cleanups: 1, Evicted: 1}},
+		{"second cleanup evicts nothing", true, RateLimiterStats{TrackedUsers: 2, Cleanups: 2, Evicted: 1}},
+	}
+	for _, tt := range tests {
+		if tt.cleanup {
+			limiter.cleanupInactiveBuckets()
+		}
+		if got := limiter.Stats(); got != tt.want {
+			t.Errorf("%s: Stats() = %+v, want %+v", tt.name, got, tt.want)
+		}
+		rec := httptest.NewRecorder()
+		GetMetricsHandler(limiter)(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if sample := fmt.Sprintf("\nratelimit_tracked_users %d\n", tt.want.TrackedUsers); !strings.Contains(rec.Body.String(), sample) {
+			t.Errorf("%s: /metrics is missing %q", tt.name, strings.TrimSpace(sample))
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	GetRateLimitAdminHandler(limiter)(rec, httptest.NewRequest(http.MethodGet, "/admin/ratelimit", nil))
+	var status rateLimitStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.RateLimiterStats != limiter.Stats() || status.MaxPerSec != 10 {
+		t.Errorf("/admin/ratelimit = %s, want the limits and the stats", rec.Body)
+	}
+}
+
+func TestPrepareMessageSelfSendMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		to          string
+		wantCode    string
+		wantWarning bool
+	}{
+		{"allowed", "allow", "user@example.com", "", false},
+		{"warned", "warn", "User@Example.com", "", true},
+		{"rejected", "reject", "user@example.com", "sender_in_recipients", false},
+		{"someone else", "reject", "to@example.com", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, map[string]string{"SELF_SEND_MODE": tt.mode})
+			emailReq := &EmailRequest{To: []string{tt.to}, Subject: "hi", Content: "hello"}
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/mail/send", nil)
+			prepared, ok := prepareMessage(rec, req, emailReq, "user@example.com", cfg, newTestRateLimiter(t, 10, nil), Hooks{})
+			if tt.wantCode != "" {
+				if ok || rec.Code != errorStatus(tt.wantCode) || !strings.Contains(rec.Body.String(), tt.wantCode) {
+					t.Errorf("got %d %s, want %s", rec.Code, rec.Body, tt.wantCode)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("prepareMessage() refused the message: %d %s", rec.Code, rec.Body)
+			}
+			warned := strings.Contains(strings.Join(prepared.warnings, "\n"), "sender address is one of the recipients")
+			if warned != tt.wantWarning {
+				t.Errorf("warnings = %q, want the self send warning: %v", prepared.warnings, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestPrepareMessageMaxMessageBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    string
+		content  string
+		wantCode string
+	}{
+		{"under the limit", "2048", "hello", ""},
+		{"over the limit", "2048", strings.Repeat("a", 4096), "message_too_large"},
+		{"no limit", "0", strings.Repeat("a", 1<<20), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, map[string]string{"MAX_MESSAGE_BYTES": tt.limit})
+			emailReq := &EmailRequest{To: []string{"to@example.com"}, Subject: "hi", Content: tt.content}
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/mail/send", nil)
+			_, ok := prepareMessage(rec, req, emailReq, "user@example.com", cfg, newTestRateLimiter(t, 10, nil), Hooks{})
+			if ok != (tt.wantCode == "") || !strings.Contains(rec.Body.String(), tt.wantCode) {
+				t.Errorf("got %v %d %s, want %q", ok, rec.Code, rec.Body, tt.wantCode)
+			}
+			if tt.wantCode != "" && !strings.Contains(rec.Body.String(), `"limit":2048`) {
+				t.Errorf("response %s doesn't report the limit", rec.Body)
+			}
+		})
+	}
+}
+
+func TestMailHandlerSMTPWarningKeywords(t *testing.T) {
+	const body = `{"to":["to@example.com"],"subject":"hi","content":"hello"}`
+	tests := []struct {
+		name         string
+		keywords     string
+		dataResponse string
+		wantWarnings int
+	}{
+		{"no keywords", "", "2.0.0 Ok: queued for review", 0},
+		{"no match", "quarantine,review", "2.0.0 Ok: queued as ABC", 0},
+		{"case-insensitive match", "quarantine,review", "2.0.0 Ok: held for REVIEW", 1},
+		{"every keyword", "quarantine,review", "2.0.0 quarantined pending review", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t, "AUTH PLAIN")
+			server.dataResponse = tt.dataResponse
+			cfg := newTestConfig(t, server, map[string]string{"SMTP_WARNING_KEYWORDS": tt.keywords})
+			handler := GetMailHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), NewSMTPMailer(cfg), cfg, nopUsageRecorder{}, Hooks{}, nil, nil)
+
+			rec := postEmail(t, handler, "secret", body, nil)
+			var response struct {
+				SMTPResponse string   `json:"smtp_response"`
+				Warnings     []string `json:"warnings"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusOK || response.SMTPResponse != tt.dataResponse {
+				t.Fatalf("got %d %s, want 200 with the 250 reply", rec.Code, rec.Body)
+			}
+			if len(response.Warnings) != tt.wantWarnings {
+				t.Errorf("warnings = %q, want %d", response.Warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestPrepareMessageSharedMailbox(t *testing.T) {
+	principals := filepath.Join(t.TempDir(), "principals.json")
+	if err := os.WriteFile(principals, []byte(`{"user@example.com": {"shared_mailboxes": ["billing@example.com"]}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := newTestConfig(t, nil, map[string]string{"PRINCIPALS_FILE": principals, "SHARED_MAILBOXES": "support@example.com"})
+
+	tests := []struct {
+		name     string
+		from     string
+		wantFrom string
+		wantCode string
+	}{
+		{"own address", "", "user@example.com", ""},
+		{"own address given", "User@Example.com", "user@example.com", ""},
+		{"shared with everyone", "Support@example.com", "Support@example.com", ""},
+		{"shared with the principal", "billing@example.com", "billing@example.com", ""},
+		{"not shared", "ceo@example.com", "", "shared_mailbox_forbidden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			emailReq := &EmailRequest{To: []string{"to@example.com"}, Subject: "hi", Content: "hello", From: tt.from}
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/mail/send", nil)
+			prepared, ok := prepareMessage(rec, req, emailReq, "user@example.com", cfg, newTestRateLimiter(t, 10, nil), Hooks{})
+			if tt.wantCode != "" {
+				if ok || rec.Code != errorStatus(tt.wantCode) || !strings.Contains(rec.Body.String(), tt.wantCode) {
+					t.Errorf("got %d %s, want %s", rec.Code, rec.Body, tt.wantCode)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("prepareMessage() refused the message: %d %s", rec.Code, rec.Body)
+			}
+			if prepared.env.From != tt.wantFrom || !strings.Contains(messageHeaders(prepared.data), "<"+tt.wantFrom+">") {
+				t.Errorf("From = %s, want %s in the envelope and the header:\n%s", prepared.env.From, tt.wantFrom, messageHeaders(prepared.data))
+			}
+		})
+	}
+}
+
+func TestPrepareMessageUsernameWithoutDomain(t *testing.T) {
+	tests := []struct {
+		name          string
+		defaultDomain string
+		wantFrom      string
+		wantCode      string
+	}{
+		{"default domain", "example.com", "user@example.com", ""},
+		{"no default domain", "", "", "invalid_sender"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, map[string]string{"DEFAULT_DOMAIN": tt.defaultDomain})
+			emailReq := &EmailRequest{To: []string{"to@example.com"}, Subject: "hi", Content: "hello"}
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/mail/send", nil)
+			prepared, ok := prepareMessage(rec, req, emailReq, "user", cfg, newTestRateLimiter(t, 10, nil), Hooks{})
+			if tt.wantCode != "" {
+				if ok || rec.Code != errorStatus(tt.wantCode) || !strings.Contains(rec.Body.String(), tt.wantCode) {
+					t.Errorf("got %d %s, want %s", rec.Code, rec.Body, tt.wantCode)
+				}
+				return
+			}
+			if !ok || prepared.env.From != tt.wantFrom {
+				t.Fatalf("got %d %s, want a message from %s", rec.Code, rec.Body, tt.wantFrom)
+			}
+		})
+	}
+}
+
+func TestRateLimiterClose(t *testing.T) {
+	limiter := NewRateLimiter(10, nil)
+	limiter.Close()
+	limiter.Close()
+
+	select {
+	case <-limiter.done:
+	default:
+		t.Fatal("Close() didn't stop the cleanup goroutine")
+	}
+	if !limiter.Allow("user@example.com") {
+		t.Error("a closed limiter stopped allowing requests")
+	}
+}
+
+func TestPrepareMessageHeaderLength(t *testing.T) {
+	recipients := func(n int) []string {
+		var list []string
+		for i := range n {
+			list = append(list, fmt.Sprintf("recipient%02d@example.com", i))
+		}
+		return list
+	}
+	tests := []struct {
+		name     string
+		title    string
+		to, cc   []string
+		wantCode string
+	}{
+		{"under the limits", "Support", recipients(2), recipients(2), ""},
+		{"long from", strings.Repeat("a", 120), recipients(1), nil, "header_too_long"},
+		{"long to", "", recipients(10), nil, "header_too_long"},
+		{"long cc", "", recipients(1), recipients(10), "header_too_long"},
+	}
+	cfg := newTestConfig(t, nil, map[string]string{"MAX_FROM_HEADER_BYTES": "100", "MAX_RECIPIENT_HEADER_BYTES": "200"})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			emailReq := &EmailRequest{To: tt.to, Cc: tt.cc, Subject: "hi", Content: "hello", Title: tt.title}
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/mail/send", nil)
+			_, ok := prepareMessage(rec, req, emailReq, "user@example.com", cfg, newTestRateLimiter(t, 10, nil), Hooks{})
+			if ok != (tt.wantCode == "") || !strings.Contains(rec.Body.String(), tt.wantCode) {
+				t.Errorf("got ok = %v, %d %s, want code %q", ok, rec.Code, rec.Body, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestMailHandlerReportSMTPHost(t *testing.T) {
+	const body = `{"to":["to@example.com"],"subject":"hi","content":"hello"}`
+	tests := []struct {
+		name   string
+		report string
+		// failover lists a server that is down before the fake one in SMTP_HOSTS
+		failover bool
+		want     bool
+	}{
+		{"reported", "true", false, true},
+		{"hidden by default", "", false, false},
+		{"server used under failover", "true", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t, "AUTH PLAIN")
+			env := map[string]string{"REPORT_SMTP_HOST": tt.report}
+			if tt.failover {
+				env["SMTP_HOSTS"] = unusedAddr(t) + "," + server.addr()
+			}
+			cfg := newTestConfig(t, server, env)
+			handler := GetMailHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), NewSMTPMailer(cfg), cfg, nopUsageRecorder{}, Hooks{}, nil, nil)
+
+			rec := postEmail(t, handler, "secret", body, nil)
+			var response map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			host, reported := response["smtp_host"]
+			if rec.Code != http.StatusOK || reported != tt.want {
+				t.Fatalf("got %d %s, want smtp_host reported: %v", rec.Code, rec.Body, tt.want)
+			}
+			if wantHost, _, _ := net.SplitHostPort(server.addr()); reported && host != wantHost {
+				t.Errorf("smtp_host = %v, want %s", host, wantHost)
+			}
+		})
+	}
+}
+
+func TestMailHandlerUnauthenticatedRelay(t *testing.T) {
+	const body = `{"to":["to@example.com"],"subject":"hi","content":"hello"}`
+	secretHash := sha256.Sum256([]byte("secret"))
+	principals := filepath.Join(t.TempDir(), "principals.json")
+	if err := os.WriteFile(principals, []byte(`{"user@example.com": {"api_password_sha256": "`+hex.EncodeToString(secretHash[:])+`"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		password     string
+		wantStatus   int
+		wantMessages int
+	}{
+		{"api password", "secret", http.StatusOK, 1},
+		{"wrong password", "guessed", errorStatus("auth_invalid"), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := newFakeSMTP(t)
+			cfg := newTestConfig(t, nil, map[string]string{"SMTP_AUTH": "false", "SMTP_RELAY_ADDR": relay.addr(), "PRINCIPALS_FILE": principals})
+			handler := GetMailHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), NewSMTPMailer(cfg), cfg, nopUsageRecorder{}, Hooks{}, nil, nil)
+
+			rec := postEmail(t, handler, tt.password, body, nil)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			messages, _ := relay.delivered()
+			if len(messages) != tt.wantMessages {
+				t.Errorf("relay got %d messages, want %d", len(messages), tt.wantMessages)
+			}
+			relay.mutex.Lock()
+			defer relay.mutex.Unlock()
+			for _, command := range relay.commands {
+				if strings.HasPrefix(command, "AUTH") {
+					t.Errorf("the relay session authenticated: %s", command)
+				}
+			}
+		})
+	}
+
+	t.Run("requires api passwords", func(t *testing.T) {
+		t.Setenv("SMTP_AUTH", "false")
+		t.Setenv("PRINCIPALS_FILE", "")
+		if _, err := LoadConfig(); err == nil {
+			t.Error("LoadConfig() accepted SMTP_AUTH=false without any api_password_sha256")
+		}
+	})
+}
+
+func TestMailHandlerDebugTimings(t *testing.T) {
+	const body = `{"to":["to@example.com"],"subject":"hi","content":"hello"}`
+	tests := []struct {
+		name  string
+		debug string
+		want  bool
+	}{
+		{"reported", "true", true},
+		{"hidden by default", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t, "AUTH PLAIN")
+			cfg := newTestConfig(t, server, map[string]string{"DEBUG_TIMINGS": tt.debug})
+			handler := GetMailHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), NewSMTPMailer(cfg), cfg, nopUsageRecorder{}, Hooks{}, nil, nil)
+
+			rec := postEmail(t, handler, "secret", body, nil)
+			var response struct {
+				Timings map[string]float64 `json:"timings"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusOK || (response.Timings != nil) != tt.want {
+				t.Fatalf("got %d %s, want timings reported: %v", rec.Code, rec.Body, tt.want)
+			}
+			if tt.want && len(response.Timings) != 4 {
+				t.Errorf("timings = %v, want the four phases", response.Timings)
+			}
+		})
+	}
+}
+
+func TestPrepareMessageHTMLField(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name    string
+		html    *bool
+		content string
+		want    string
+	}{
+		{"guessed html", nil, "<p>hello</p>", "text/html"},
+		{"guessed text", nil, "hello", "text/plain"},
+		{"html forced", &yes, "hello", "text/html"},
+		{"text forced", &no, "<p>hello</p>", "text/plain"},
+	}
+	cfg := newTestConfig(t, nil, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prepared := prepareTestMessage(t, cfg, &EmailRequest{To: []string{"to@example.com"}, Subject: "hi", Content: tt.content, HTML: tt.html})
+			if prepared.isHTML != (tt.want == "text/html") || !strings.Contains(messageHeaders(prepared.data), "Content-Type: "+tt.want) {
+				t.Errorf("isHTML = %v, want Content-Type %s:\n%s", prepared.isHTML, tt.want, messageHeaders(prepared.data))
+			}
+		})
+	}
+}
+
+func TestMailHandlerExpectedObject(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantCode string
+	}{
+		{"array", `[{"to":["to@example.com"]}]`, "expected_object"},
+		{"string", `"hello"`, "expected_object"},
+		{"null", `null`, "expected_object"},
+		{"number with spaces", "  \n42", "expected_object"},
+		{"malformed", `{"to":`, "invalid_body"},
+		{"empty", ``, "invalid_body"},
+	}
+	cfg := newTestConfig(t, nil, nil)
+	handler := GetMailHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), &fakeMailer{}, cfg, nopUsageRecorder{}, Hooks{}, nil, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := postEmail(t, handler, "secret", tt.body, nil)
+			if rec.Code != errorStatus(tt.wantCode) || !strings.Contains(rec.Body.String(), `"code":"`+tt.wantCode+`"`) {
+				t.Errorf("got %d %s, want %s", rec.Code, rec.Body, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestLimitRequestBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		max           int64
+		body          string
+		contentLength int64
+		wantOK        bool
+		wantReadErr   bool
+	}{
+		{"under the limit", 10, "hello", 5, true, false},
+		{"declared over the limit", 10, "hello world!", 12, false, false},
+		{"undeclared over the limit", 10, "hello world!", -1, true, true},
+		{"no limit", 0, strings.Repeat("x", 100), 100, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/mail/send", strings.NewReader(tt.body))
+			req.ContentLength = tt.contentLength
+			rec := httptest.NewRecorder()
+			if ok := limitRequestBody(rec, req, tt.max); ok != tt.wantOK {
+				t.Fatalf("limitRequestBody() = %v, want %v", ok, tt.wantOK)
+			}
+			if !tt.wantOK {
+				if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), "request_too_large") {
+					t.Errorf("got %d %s, want 413 request_too_large", rec.Code, rec.Body)
+				}
+				return
+			}
+			if _, err := io.ReadAll(req.Body); (err != nil) != tt.wantReadErr {
+				t.Errorf("reading the body error = %v, want an error: %v", err, tt.wantReadErr)
+			}
+		})
+	}
+}
+
+func TestPrepareMessageCcAndBcc(t *testing.T) {
+	tests := []struct {
+		name           string
+		cc, bcc        []string
+		wantCc         string
+		wantRecipients string
+	}{
+		{"to only", nil, nil, "", "to@example.com"},
+		{"cc", []string{"cc1@example.com", "cc2@example.com"}, nil, "cc1@example.com, cc2@example.com", "to@example.com,cc1@example.com,cc2@example.com"},
+		{"bcc", nil, []string{"hidden@example.com"}, "", "to@example.com,hidden@example.com"},
+		{"both", []string{"cc@example.com"}, []string{"hidden@example.com"}, "cc@example.com", "to@example.com,cc@example.com,hidden@example.com"},
+	}
+	cfg := newTestConfig(t, nil, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prepared := prepareTestMessage(t, cfg, &EmailRequest{To: []string{"to@example.com"}, Cc: tt.cc, Bcc: tt.bcc, Subject: "hi", Content: "hello"})
+			msg, err := mail.ReadMessage(strings.NewReader(string(prepared.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := msg.Header.Get("Cc"); got != tt.wantCc {
+				t.Errorf("Cc = %q, want %q", got, tt.wantCc)
+			}
+			if _, ok := msg.Header["Bcc"]; ok || strings.Contains(string(prepared.data), "hidden@example.com") {
+				t.Errorf("the message reveals the Bcc recipients:\n%s", prepared.data)
+			}
+			if got := strings.Join(prepared.env.Recipients, ","); got != tt.wantRecipients {
+				t.Errorf("envelope recipients = %s, want %s", got, tt.wantRecipients)
+			}
+		})
+	}
+}
+
+func TestPrepareMessageMultipartAlternative(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		wantCTE  string
+	}{
+		{"quoted-printable by default", "", "quoted-printable"},
+		{"base64", "base64", "base64"},
+	}
+	cfg := newTestConfig(t, nil, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prepared := prepareTestMessage(t, cfg, &EmailRequest{To: []string{"to@example.com"}, Subject: "hi",
+				Content: "<p>Grüße</p>", TextContent: "Grüße", Encoding: tt.encoding})
+			msg, err := mail.ReadMessage(strings.NewReader(string(prepared.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+			if err != nil || mediaType != "multipart/alternative" {
+				t.Fatalf("Content-Type = %q, want multipart/alternative", msg.Header.Get("Content-Type"))
+			}
+
+			want := []struct{ contentType, body string }{{"text/plain", "Grüße"}, {"text/html", "<p>Grüße</p>"}}
+			reader := multipart.NewReader(msg.Body, params["boundary"])
+			for i := 0; ; i++ {
+				part, err := reader.NextRawPart()
+				if err == io.EOF {
+					if i != len(want) {
+						t.Errorf("message has %d parts, want %d", i, len(want))
+					}
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i >= len(want) {
+					t.Fatalf("unexpected part %d", i)
+				}
+				body, err := decodeTestPart(part.Header.Get("Content-Transfer-Encoding"), part)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.HasPrefix(part.Header.Get("Content-Type"), want[i].contentType) || part.Header.Get("Content-Transfer-Encoding") != tt.wantCTE {
+					t.Errorf("part %d is %s in %s, want %s in %s", i, part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), want[i].contentType, tt.wantCTE)
+				}
+				if strings.TrimRight(body, "\r\n") != want[i].body {
+					t.Errorf("part %d body = %q, want %q", i, body, want[i].body)
+				}
+			}
+		})
+	}
+}
+
+// decodeTestPart reads a MIME part body in the given Content-Transfer-Encoding
+func decodeTestPart(encoding string, r io.Reader) (string, error) {
+	switch encoding {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	data, err := io.ReadAll(r)
+	return string(data), err
+}
+
+func TestPrepareMessageContentType(t *testing.T) {
+	yes := true
+	tests := []struct {
+		name        string
+		contentType string
+		html        *bool
+		content     string
+		want        string
+	}{
+		{"html", "text/html", nil, "hello", "text/html"},
+		{"plain", "text/plain", nil, "<p>hello</p>", "text/plain"},
+		{"case-insensitive", "Text/HTML", nil, "hello", "text/html"},
+		{"agrees with html", "text/html", &yes, "hello", "text/html"},
+	}
+	cfg := newTestConfig(t, nil, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prepared := prepareTestMessage(t, cfg, &EmailRequest{To: []string{"to@example.com"}, Subject: "hi", Content: tt.content, ContentType: tt.contentType, HTML: tt.html})
+			if !strings.Contains(messageHeaders(prepared.data), "Content-Type: "+tt.want) {
+				t.Errorf("Content-Type isn't %s:\n%s", tt.want, messageHeaders(prepared.data))
+			}
+		})
+	}
+}
+
+func TestPrepareMessageReplyTo(t *testing.T) {
+	tests := []struct {
+		name    string
+		replyTo string
+	}{
+		{"set", "Support <replies@example.com>"},
+		{"omitted", ""},
+	}
+	cfg := newTestConfig(t, nil, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prepared := prepareTestMessage(t, cfg, &EmailRequest{To: []string{"to@example.com"}, Subject: "hi", Content: "hello", ReplyTo: tt.replyTo})
+			msg, err := mail.ReadMessage(strings.NewReader(string(prepared.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := msg.Header.Get("Reply-To"); got != tt.replyTo {
+				t.Errorf("Reply-To = %q, want %q", got, tt.replyTo)
+			}
+		})
+	}
+}
+
+func TestMailHandlerRecipientRateLimitCost(t *testing.T) {
+	send := func(recipients int) string {
+		var to []string
+		for i := range recipients {
+			to = append(to, fmt.Sprintf(`"r%d@example.com"`, i))
+		}
+		return `{"to":[` + strings.Join(to, ",") + `],"subject":"hi","content":"hello"}`
+	}
+	type step struct {
+		recipients int
+		wantStatus int
+	}
+	tests := []struct {
+		name  string
+		cost  string
+		steps []step
+	}{
+		{"per recipient", "recipients", []step{{3, http.StatusOK}, {2, http.StatusTooManyRequests}, {1, http.StatusOK}}},
+		{"larger than the burst", "recipients", []step{{10, http.StatusOK}, {1, http.StatusTooManyRequests}}},
+		{"per request", "request", []step{{3, http.StatusOK}, {3, http.StatusOK}, {3, http.StatusOK}, {3, http.StatusOK}, {3, http.StatusTooManyRequests}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, map[string]string{"RATE_LIMIT_COST": tt.cost})
+			limiter := newTestRateLimiter(t, 2, nil)
+			handler := GetMailHandler(limiter, NewSlidingWindowLimiter(), &fakeMailer{}, cfg, nopUsageRecorder{}, Hooks{}, nil, nil)
+			for i, step := range tt.steps {
+				if rec := postEmail(t, handler, "secret", send(step.recipients), nil); rec.Code != step.wantStatus {
+					t.Errorf("send %d to %d recipients got %d %s, want %d", i+1, step.recipients, rec.Code, rec.Body, step.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+func TestPrepareMessageCustomHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		headers  map[string]string
+		wantCode string
+	}{
+		{"rendered", nil, map[string]string{"X-Tenant": "acme", "X-Campaign-Id": "fall"}, ""},
+		{"too many", map[string]string{"MAX_CUSTOM_HEADERS": "1"}, map[string]string{"X-Tenant": "acme", "X-Campaign-Id": "fall"}, "too_many_headers"},
+		{"too long", map[string]string{"MAX_CUSTOM_HEADER_BYTES": "16"}, map[string]string{"X-Campaign-Id": "a-long-campaign-name"}, "header_too_long"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, tt.env)
+			emailReq := &EmailRequest{To: []string{"to@example.com"}, Subject: "hi", Content: "hello", Headers: tt.headers}
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/mail/send", nil)
+			prepared, ok := prepareMessage(rec, req, emailReq, "user@example.com", cfg, newTestRateLimiter(t, 10, nil), Hooks{})
+			if tt.wantCode != "" {
+				if ok || rec.Code != errorStatus(tt.wantCode) || !strings.Contains(rec.Body.String(), tt.wantCode) {
+					t.Errorf("got %d %s, want %s", rec.Code, rec.Body, tt.wantCode)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("prepareMessage() refused the message: %d %s", rec.Code, rec.Body)
+			}
+			// Custom headers follow the standard ones in name order
+			headers := messageHeaders(prepared.data)
+			campaign, tenant, subject := strings.Index(headers, "\r\nX-Campaign-Id: fall\r\n"), strings.Index(headers, "\r\nX-Tenant: acme\r\n"), strings.Index(headers, "\r\nSubject: ")
+			if campaign < 0 || tenant < campaign || subject > campaign {
+				t.Errorf("custom headers aren't rendered after the standard ones in order:\n%s", headers)
+			}
+		})
+	}
+}
+
+func TestDetectHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		mode     string
+		fallback string
+		want     bool
+	}{
+		{"loose tag", "<p>hello</p>", "loose", "text/plain", true},
+		{"loose text", "a < b and c > d", "loose", "text/plain", false},
+		{"loose ignores fallback", "x <b>bold</b>", "loose", "text/html", false},
+		{"strict document", "<!DOCTYPE html><html><body>hi</body></html>", "strict", "text/plain", true},
+		{"strict body only", "<BODY class=\"x\">hi</BODY>", "strict", "text/plain", true},
+		{"strict text", "Price < 5 and > 2", "strict", "text/html", false},
+		{"strict stray tag plain fallback", "see <p>here</p>", "strict", "text/plain", false},
+		{"strict stray tag html fallback", "see <br/> here", "strict", "text/html", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectHTML(tt.content, tt.mode, tt.fallback); got != tt.want {
+				t.Errorf("detectHTML(%q, %s, %s) = %v, want %v", tt.content, tt.mode, tt.fallback, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBasicAuthLengthCap(t *testing.T) {
+	tests := []struct {
+		name     string
+		length   int
+		wantCode string
+	}{
+		{"under the cap", 63, ""},
+		{"at the cap", 64, ""},
+		{"one byte over", 65, "auth_too_large"},
+		{"two bytes over", 66, "auth_too_large"},
+		{"far over", 1000, "auth_too_large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			credentials := "u:" + strings.Repeat("x", tt.length-2)
+			_, _, authErr := parseBasicAuth("Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)), 64)
+			var code string
+			if authErr != nil {
+				code = authErr.code
+			}
+			if code != tt.wantCode {
+				t.Errorf("parseBasicAuth() of %d bytes = %q, want %q", tt.length, code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestPrepareMessageVerifiedFromDomains(t *testing.T) {
+	tests := []struct {
+		name     string
+		domains  string
+		from     string
+		wantCode string
+	}{
+		{"any domain when unset", "", "", ""},
+		{"own domain verified", "example.com", "", ""},
+		{"case insensitive", "EXAMPLE.com", "", ""},
+		{"shared mailbox in a verified domain", "example.com, other.example", "billing@other.example", ""},
+		{"own domain not verified", "other.example", "", "unverified_from_domain"},
+		{"shared mailbox outside the verified domains", "example.com", "billing@other.example", "unverified_from_domain"},
+		{"subdomain not verified", "example.com", "billing@mail.example.com", "unverified_from_domain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, map[string]string{
+				"VERIFIED_FROM_DOMAINS": tt.domains,
+				"SHARED_MAILBOXES":      "billing@other.example,billing@mail.example.com",
+			})
+			emailReq := &EmailRequest{To: []string{"to@example.com"}, Subject: "hi", Content: "hello", From: tt.from}
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/mail/send", nil)
+			_, ok := prepareMessage(rec, req, emailReq, "user@example.com", cfg, newTestRateLimiter(t, 10, nil), Hooks{})
+			if tt.wantCode == "" {
+				if !ok {
+					t.Errorf("prepareMessage() refused the message: %d %s", rec.Code, rec.Body)
+				}
+				return
+			}
+			if ok || rec.Code != errorStatus(tt.wantCode) || !strings.Contains(rec.Body.String(), tt.wantCode) {
+				t.Errorf("got %d %s, want %s", rec.Code, rec.Body, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestRateLimiterZeroRate(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxPerSec int
+		overrides map[string]RateLimitSettings
+		user      string
+		wantAllow int // sends allowed out of 100
+	}{
+		{"zero rate", 0, nil, "user@example.com", 100},
+		{"limited", 1, nil, "user@example.com", 2},
+		{"override disables", 1, map[string]RateLimitSettings{"vip@example.com": {MaxPerSec: 0}}, "vip@example.com", 100},
+		{"override limits", 0, map[string]RateLimitSettings{"bulk@example.com": {MaxPerSec: 1, Burst: 3}}, "bulk@example.com", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := newTestRateLimiter(t, tt.maxPerSec, tt.overrides)
+			allowed := 0
+			for range 100 {
+				if rl.AllowN(tt.user, 1) {
+					allowed++
+				}
+			}
+			if allowed != tt.wantAllow {
+				t.Errorf("allowed %d of 100 sends, want %d", allowed, tt.wantAllow)
+			}
+			if maxPerSec, _ := rl.UserLimits(tt.user); maxPerSec == 0 && rl.Stats().TrackedUsers != 0 {
+				t.Errorf("an unlimited user is tracked: %+v", rl.Stats())
+			}
+		})
+	}
+}
+
+func TestMailHandlerPerRecipientOutcome(t *testing.T) {
+	const body = `{"to":["a@example.com"],"cc":["b@example.com"],"bcc":["c@example.com"],"subject":"hi","content":"hello","per_recipient":true}`
+	tests := []struct {
+		name        string
+		err         error
+		wantStatus  int
+		wantOutcome string
+		wantResult  string
+	}{
+		{"all sent", nil, http.StatusOK, "success", "sent"},
+		{"none sent", &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}, http.StatusBadGateway, "error", "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, nil)
+			handler := GetMailHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), &fakeMailer{err: tt.err}, cfg, nopUsageRecorder{}, Hooks{}, nil, nil)
+			rec := postEmail(t, handler, "secret", body, nil)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			var response struct {
+				Status    string            `json:"status"`
+				MessageID string            `json:"message_id"`
+				Results   []recipientStatus `json:"results"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Status != tt.wantOutcome || response.MessageID == "" {
+				t.Errorf("status = %q with message_id %q, want %q and an ID", response.Status, response.MessageID, tt.wantOutcome)
+			}
+			var recipients []string
+			for _, result := range response.Results {
+				recipients = append(recipients, result.Recipient)
+				if result.Status != tt.wantResult {
+					t.Errorf("%s: status = %s, want %s", result.Recipient, result.Status, tt.wantResult)
+				}
+				if (result.SMTPResponse != "") != (tt.err == nil) || (result.Error != "") != (tt.err != nil) {
+					t.Errorf("%s: smtp_response %q and error %q don't match the outcome", result.Recipient, result.SMTPResponse, result.Error)
+				}
+			}
+			if strings.Join(recipients, ",") != "a@example.com,b@example.com,c@example.com" {
+				t.Errorf("results for %v, want To, Cc and Bcc", recipients)
+			}
+		})
+	}
+}
+
+// Only sent messages count toward the sliding window, rejected and failed ones give their slot back
+func TestMailHandlerWindowCountsSentOnly(t *testing.T) {
+	const valid = `{"to":["to@example.com"],"subject":"hi","content":"hello"}`
+	tests := []struct {
+		name      string
+		body      string
+		mailerErr error
+		wantCode  string
+	}{
+		{"invalid", `{"to":["to@example.com"],"subject":"","content":"hello"}`, nil, "validation_failed"},
+		{"too many recipients", `{"to":["a@example.com","b@example.com","c@example.com"],"subject":"hi","content":"hello"}`, nil, "too_many_recipients"},
+		{"send failed", valid, &textproto.Error{Code: 554, Msg: "rejected"}, "send_failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, map[string]string{"RATE_WINDOW_MAX": "1", "RATE_WINDOW": "1h", "MAX_RECIPIENTS": "2"})
+			mailer := &fakeMailer{err: tt.mailerErr}
+			handler := GetMailHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), mailer, cfg, nopUsageRecorder{}, Hooks{}, nil, nil)
+
+			for range 3 {
+				if rec := postEmail(t, handler, "secret", tt.body, nil); !strings.Contains(rec.Body.String(), tt.wantCode) {
+					t.Fatalf("got %d %s, want %s", rec.Code, rec.Body, tt.wantCode)
+				}
+			}
+			mailer.err = nil
+			if rec := postEmail(t, handler, "secret", valid, nil); rec.Code != http.StatusOK {
+				t.Fatalf("valid send after the refused ones got %d %s, want 200", rec.Code, rec.Body)
+			}
+			if rec := postEmail(t, handler, "secret", valid, nil); rec.Code != errorStatus("window_limit_exceeded") {
+				t.Errorf("send beyond the window got %d %s, want window_limit_exceeded", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+// Of several custom headers over the limit the first in sorted order is always the one reported
+func TestPrepareMessageCustomHeaderLength(t *testing.T) {
+	cfg := newTestConfig(t, nil, map[string]string{"MAX_CUSTOM_HEADER_BYTES": "20"})
+	headers := map[string]string{"X-Short": "1", "X-Zulu": strings.Repeat("z", 30), "X-Alpha": strings.Repeat("a", 30), "X-Mike": strings.Repeat("m", 30)}
+	for range 20 {
+		emailReq := &EmailRequest{To: []string{"to@example.com"}, Subject: "hi", Content: "hello", Headers: headers}
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/mail/send", nil)
+		if _, ok := prepareMessage(rec, req, emailReq, "user@example.com", cfg, newTestRateLimiter(t, 10, nil), Hooks{}); ok {
+			t.Fatal("prepareMessage() accepted headers over the limit")
+		}
+		if !strings.Contains(rec.Body.String(), "header_too_long") || !strings.Contains(rec.Body.String(), "The X-Alpha header") {
+			t.Fatalf("got %d %s, want header_too_long for X-Alpha", rec.Code, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+// header is a single header field of a message
+type header struct {
+	name  string
+	value string
+}
+
+// message is an email or a MIME part being assembled, it renders with the CRLF line endings RFC 5322 requires
+type message struct {
+	headers []header
+	body    string
+
+	// parts are rendered after the body, separated by boundary, when the message is multipart
+	parts    []*message
+	boundary string
+}
+
+// addHeader appends a header field, fields are rendered in the order they were added
+func (m *message) addHeader(name, value string) {
+	m.headers = append(m.headers, header{name, value})
+}
+
+// setMultipart makes the message a multipart/subtype container of the parts with a random boundary
+func (m *message) setMultipart(subtype string, parts ...*message) {
+	// "=_" can't occur in base64 or quoted-printable content, the random hex makes a clash with other bodies unlikely
+	m.boundary = "=_" + newRequestID()
+	m.parts = parts
+	m.addHeader("Content-Type", "multipart/"+subtype+`; boundary="`+m.boundary+`"`)
+}
+
+// newTextPart creates a text part of the media type with the content in the transfer encoding,
+// an empty encoding leaves the content unchanged
+func newTextPart(content, mediaType, encoding string) (*message, error) {
+	body, err := encodeBody(content, encoding)
+	if err != nil {
+		return nil, err
+	}
+	part := &message{body: body}
+	part.addHeader("Content-Type", mediaType+"; charset=UTF-8")
+	if encoding != "" {
+		part.addHeader("Content-Transfer-Encoding", strings.ToLower(encoding))
+	}
+	return part, nil
+}
+
+// hasMIMEHeaders reports whether the message has a Content-Type or Content-Transfer-Encoding header
+func (m *message) hasMIMEHeaders() bool {
+	for _, h := range m.headers {
+		if strings.EqualFold(h.name, "Content-Type") || strings.EqualFold(h.name, "Content-Transfer-Encoding") {
+			return true
+		}
+	}
+	return false
+}
+
+// bytes renders the headers, body and parts of the message
+func (m *message) bytes() []byte {
+	var b bytes.Buffer
+	m.writeTo(&b)
+	return b.Bytes()
+}
+
+func (m *message) writeTo(b *bytes.Buffer) {
+	for _, h := range m.headers {
+		b.WriteString(h.name)
+		b.WriteString(": ")
+		b.WriteString(h.value)
+		b.WriteString("\r\n")
+	}
+	b.WriteString("\r\n")
+	b.WriteString(normalizeNewlines(m.body))
+
+	if len(m.parts) == 0 {
+		return
+	}
+	for _, part := range m.parts {
+		b.WriteString("\r\n--" + m.boundary + "\r\n")
+		part.writeTo(b)
+	}
+	b.WriteString("\r\n--" + m.boundary + "--\r\n")
+}
+
+// normalizeNewlines converts LF, CR and CRLF line endings to CRLF, so mixed endings never produce CRCRLF
+func normalizeNewlines(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
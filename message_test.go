@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeNewlines(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"LF", "a\nb\n", "a\r\nb\r\n"},
+		{"CRLF", "a\r\nb\r\n", "a\r\nb\r\n"},
+		{"CR", "a\rb\r", "a\r\nb\r\n"},
+		{"mixed", "a\r\nb\nc\rd", "a\r\nb\r\nc\r\nd"},
+		{"CR before CRLF", "a\r\r\nb", "a\r\n\r\nb"},
+		{"no newline", "abc", "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeNewlines(tt.in); got != tt.want {
+				t.Errorf("normalizeNewlines(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageBytesCRLF(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"LF body", "line one\nline two\n"},
+		{"CR body", "line one\rline two"},
+		{"CRLF body", "line one\r\nline two\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := &message{body: tt.body}
+			text.addHeader("Content-Type", "text/plain; charset=UTF-8")
+			html := &message{body: "<p>" + tt.body + "</p>"}
+			html.addHeader("Content-Type", "text/html; charset=UTF-8")
+			msg := &message{}
+			msg.addHeader("Subject", "hi")
+			msg.setMultipart("alternative", text, html)
+
+			rendered := string(msg.bytes())
+			if strings.Count(rendered, "\n") != strings.Count(rendered, "\r\n") {
+				t.Errorf("message has a bare LF:\n%q", rendered)
+			}
+			if strings.Count(rendered, "\r") != strings.Count(rendered, "\r\n") {
+				t.Errorf("message has a bare CR:\n%q", rendered)
+			}
+			if !strings.HasSuffix(rendered, "\r\n--"+msg.boundary+"--\r\n") {
+				t.Errorf("message doesn't end with the closing boundary:\n%q", rendered)
+			}
+		})
+	}
+}
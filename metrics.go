@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters published with expvar on /debug/vars
+var (
+	sendsTotal            = expvar.NewInt("mail_sends_total")
+	sendsByStatus         = expvar.NewMap("mail_send_by_status")
+	sendFailuresTotal     = expvar.NewInt("mail_send_failures_total")
+	sendFailuresByReason  = expvar.NewMap("mail_send_failures_by_reason")
+	partialSendsTotal     = expvar.NewInt("mail_partial_sends_total")
+	recipientsAccepted    = expvar.NewInt("mail_recipients_accepted_total")
+	recipientsRejected    = expvar.NewInt("mail_recipients_rejected_total")
+	rateLimitedTotal      = expvar.NewInt("mail_rate_limited_total")
+	inflightRequests      = expvar.NewInt("http_inflight_requests")
+	sendDurationHistogram = newHistogram(0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30)
+)
+
+// recordSend counts a message the mail server accepted for all of its recipients
+func recordSend(recipients int) {
+	sendsTotal.Add(1)
+	sendsByStatus.Add("sent", 1)
+	recipientsAccepted.Add(int64(recipients))
+}
+
+// recordSendFailure counts a failed send to the recipients under the reason derived from its error. The
+// recipients a partial delivery reached are counted as accepted.
+func recordSendFailure(err error, recipients int) {
+	sendFailuresTotal.Add(1)
+	sendFailuresByReason.Add(failureReason(err), 1)
+
+	var partial *partialDeliveryError
+	if errors.As(err, &partial) {
+		sendsByStatus.Add("partial", 1)
+		partialSendsTotal.Add(1)
+		recipientsAccepted.Add(int64(partial.delivered()))
+		recipients -= partial.delivered()
+	} else {
+		sendsByStatus.Add("failed", 1)
+	}
+	recipientsRejected.Add(int64(recipients))
+}
+
+// sendStatusCount returns the number of sends counted under the status, 0 before the first one
+func sendStatusCount(status string) int64 {
+	if v, ok := sendsByStatus.Get(status).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// sendStatuses are the values of the status label of mail_send_total, all of them are always reported
+var sendStatuses = []string{"sent", "partial", "failed"}
+
+// failureReason classifies a send error into a short label with few distinct values
+func failureReason(err error) string {
+	var reply *textproto.Error
+	var netErr net.Error
+	var partial *partialDeliveryError
+	switch {
+	case errors.As(err, &partial):
+		return "partial"
+	case errors.Is(err, errSMTPUTF8Unsupported):
+		return "smtputf8_unsupported"
+	case errors.Is(err, err8BitMIMEUnsupported):
+		return "8bitmime_unsupported"
+	case errors.Is(err, errSMTPTimeout):
+		return "timeout"
+	case errors.As(err, &reply) && reply.Code == 535:
+		return "auth_failed"
+	case errors.As(err, &reply):
+		return "rejected"
+	case errors.As(err, &netErr):
+		return "unavailable"
+	default:
+		return "error"
+	}
+}
+
+// histogram counts observations into cumulative buckets like a Prometheus histogram
+type histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// newHistogram returns a histogram with the given ascending upper bounds, +Inf is implied
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+// observe records one value
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// observeSince records the seconds elapsed since start
+func (h *histogram) observeSince(start time.Time) {
+	h.observe(time.Since(start).Seconds())
+}
+
+// writeTo renders the histogram in the Prometheus text format
+func (h *histogram) writeTo(w *strings.Builder, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", name, h.count, name, h.sum, name, h.count)
+}
+
+// GetMetricsHandler serves the counters and the state of the rate limiter in the Prometheus text exposition format
+func GetMetricsHandler(rateLimiter Limiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+
+		var b strings.Builder
+		b.WriteString("# HELP mail_send_total Emails handed to the mail server, by whether every recipient, some or none got them\n")
+		b.WriteString("# TYPE mail_send_total counter\n")
+		for _, status := range sendStatuses {
+			fmt.Fprintf(&b, "mail_send_total{status=%q} %d\n", status, sendStatusCount(status))
+		}
+		writeMetric(&b, "mail_sends_total", "counter", "Deprecated, use mail_send_total{status=\"sent\"}", sendsTotal.Value())
+		writeMetric(&b, "mail_partial_sends_total", "counter", "Deprecated, use mail_send_total{status=\"partial\"}", partialSendsTotal.Value())
+		writeMetric(&b, "mail_recipients_accepted_total", "counter", "Recipients the mail server accepted a message for", recipientsAccepted.Value())
+		writeMetric(&b, "mail_recipients_rejected_total", "counter", "Recipients the mail server did not accept a message for", recipientsRejected.Value())
+		writeMetric(&b, "mail_rate_limited_total", "counter", "Requests rejected by a rate limit", rateLimitedTotal.Value())
+		writeMetric(&b, "http_inflight_requests", "gauge", "Requests currently being served", inflightRequests.Value())
+
+		var stats RateLimiterStats
+		if admin, ok := rateLimiter.(LimiterAdmin); ok {
+			stats = admin.Stats()
+		}
+		writeMetric(&b, "ratelimit_tracked_users", "gauge", "Users the rate limiter keeps a bucket for", int64(stats.TrackedUsers))
+		writeMetric(&b, "ratelimit_cleanups_total", "counter", "Runs of the rate limiter cleanup of idle buckets", stats.Cleanups)
+		writeMetric(&b, "ratelimit_evicted_total", "counter", "Idle buckets removed by the rate limiter cleanup", stats.Evicted)
+
+		// Reasons are sorted so scrapes are stable
+		b.WriteString("# HELP mail_send_failures_total Emails the mail server did not accept, by reason\n")
+		b.WriteString("# TYPE mail_send_failures_total counter\n")
+		var reasons []string
+		sendFailuresByReason.Do(func(kv expvar.KeyValue) { reasons = append(reasons, kv.Key) })
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Fprintf(&b, "mail_send_failures_total{reason=%q} %s\n", reason, sendFailuresByReason.Get(reason))
+		}
+
+		sendDurationHistogram.writeTo(&b, "mail_send_duration_seconds", "Time taken to hand a message to the mail server")
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write([]byte(b.String()))
+	}
+}
+
+// writeMetric renders a single unlabeled sample with its help and type
+func writeMetric(w *strings.Builder, name, kind, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+// withInflight tracks the number of requests currently being served
+func withInflight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inflightRequests.Add(1)
+		defer inflightRequests.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shedExemptPaths are never rejected by withLoadShedding so monitoring keeps working under load
+var shedExemptPaths = map[string]bool{
+	"/health":  true,
+	"/metrics": true,
+}
+
+// withLoadShedding rejects requests with 503 while max requests are already in flight, 0 disables it
+func withLoadShedding(max int64, next http.Handler) http.Handler {
+	if max == 0 {
+		return next
+	}
+
+	var inflight atomic.Int64
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if shedExemptPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if inflight.Add(1) > max {
+			inflight.Add(-1)
+			w.Header().Set("Retry-After", "1")
+			writeError(w, "overloaded", "Too many requests in flight, retry later")
+			return
+		}
+		defer inflight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordSendCounters(t *testing.T) {
+	partial := &partialDeliveryError{
+		results: []recipientStatus{
+			{Recipient: "a@example.com", Status: "sent"},
+			{Recipient: "b@example.com", Status: "sent"},
+			{Recipient: "c@example.com", Status: "failed"},
+		},
+		err: &textproto.Error{Code: 550, Msg: "no such user"},
+	}
+	tests := []struct {
+		name         string
+		err          error
+		recipients   int
+		wantReason   string
+		wantAccepted int64
+		wantRejected int64
+		wantPartial  int64
+		wantStatus   string // status label of mail_send_total counted
+	}{
+		{"sent", nil, 3, "", 3, 0, 0, "sent"},
+		{"rejected", &textproto.Error{Code: 550, Msg: "no such user"}, 2, "rejected", 0, 2, 0, "failed"},
+		{"partial delivery", partial, 3, "partial", 2, 1, 1, "partial"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accepted, rejected, partials := recipientsAccepted.Value(), recipientsRejected.Value(), partialSendsTotal.Value()
+			statuses := make(map[string]int64)
+			for _, status := range sendStatuses {
+				statuses[status] = sendStatusCount(status)
+			}
+			if tt.err == nil {
+				recordSend(tt.recipients)
+			} else {
+				recordSendFailure(tt.err, tt.recipients)
+				if reason := failureReason(tt.err); reason != tt.wantReason {
+					t.Errorf("failureReason() = %q, want %q", reason, tt.wantReason)
+				}
+			}
+			if got := recipientsAccepted.Value() - accepted; got != tt.wantAccepted {
+				t.Errorf("accepted recipients grew by %d, want %d", got, tt.wantAccepted)
+			}
+			if got := recipientsRejected.Value() - rejected; got != tt.wantRejected {
+				t.Errorf("rejected recipients grew by %d, want %d", got, tt.wantRejected)
+			}
+			if got := partialSendsTotal.Value() - partials; got != tt.wantPartial {
+				t.Errorf("partial sends grew by %d, want %d", got, tt.wantPartial)
+			}
+			for _, status := range sendStatuses {
+				want := int64(0)
+				if status == tt.wantStatus {
+					want = 1
+				}
+				if got := sendStatusCount(status) - statuses[status]; got != want {
+					t.Errorf("mail_send_total{status=%q} grew by %d, want %d", status, got, want)
+				}
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	GetMetricsHandler(noopLimiter{})(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, name := range []string{"mail_partial_sends_total", "mail_recipients_accepted_total", "mail_recipients_rejected_total"} {
+		if !strings.Contains(rec.Body.String(), "\n"+name+" ") {
+			t.Errorf("/metrics doesn't report %s:\n%s", name, rec.Body)
+		}
+	}
+	if !strings.Contains(rec.Body.String(), `mail_send_failures_total{reason="partial"}`) {
+		t.Errorf("/metrics doesn't report the partial failure reason:\n%s", rec.Body)
+	}
+	for _, status := range sendStatuses {
+		sample := fmt.Sprintf("mail_send_total{status=%q} %d\n", status, sendStatusCount(status))
+		if !strings.Contains(rec.Body.String(), sample) {
+			t.Errorf("/metrics doesn't report %s", sample)
+		}
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"smtputf8", errSMTPUTF8Unsupported, "smtputf8_unsupported"},
+		{"8bitmime", fmt.Errorf("send: %w", err8BitMIMEUnsupported), "8bitmime_unsupported"},
+		{"timeout", errSMTPTimeout, "timeout"},
+		{"wrong credentials", &textproto.Error{Code: 535, Msg: "authentication failed"}, "auth_failed"},
+		{"refused", &textproto.Error{Code: 554, Msg: "rejected"}, "rejected"},
+		{"connection", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, "unavailable"},
+		{"other", errors.New("boom"), "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failureReason(tt.err); got != tt.want {
+				t.Errorf("failureReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpvarRequiresAdmin(t *testing.T) {
+	handler := requireAdmin(&Config{AdminToken: "token"}, expvar.Handler().ServeHTTP)
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{"admin", "token", http.StatusOK},
+		{"wrong token", "guessed", errorStatus("admin_auth_required")},
+		{"no token", "", errorStatus("admin_auth_required")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && !strings.Contains(rec.Body.String(), `"mail_sends_total"`) {
+				t.Errorf("/debug/vars doesn't publish the send counters:\n%s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestWithLoadShedding(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	handler := withLoadShedding(1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("block") == "true" {
+			started <- struct{}{}
+			<-release
+		}
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/mail/send?block=true", nil))
+		close(done)
+	}()
+	<-started
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{"shed while busy", "/mail/send", errorStatus("overloaded")},
+		{"health exempt", "/health", http.StatusOK},
+		{"metrics exempt", "/metrics", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK && rec.Header().Get("Retry-After") != "1" {
+				t.Errorf("Retry-After = %q, want 1", rec.Header().Get("Retry-After"))
+			}
+		})
+	}
+
+	close(release)
+	<-done
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/mail/send", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("after the busy request finished got %d, want 200", rec.Code)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram(0.5, 1, 5)
+	for _, v := range []float64{0.1, 0.5, 0.7, 3, 60} {
+		h.observe(v)
+	}
+	var b strings.Builder
+	h.writeTo(&b, "send_seconds", "Send time")
+
+	tests := []struct {
+		sample string
+		want   string
+	}{
+		{`send_seconds_bucket{le="0.5"}`, "2"},
+		{`send_seconds_bucket{le="1"}`, "3"},
+		{`send_seconds_bucket{le="5"}`, "4"},
+		{`send_seconds_bucket{le="+Inf"}`, "5"},
+		{"send_seconds_sum", "64.3"},
+		{"send_seconds_count", "5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sample, func(t *testing.T) {
+			if !strings.Contains(b.String(), "\n"+tt.sample+" "+tt.want+"\n") {
+				t.Errorf("want %s %s in:\n%s", tt.sample, tt.want, b.String())
+			}
+		})
+	}
+	if !strings.HasPrefix(b.String(), "# HELP send_seconds Send time\n# TYPE send_seconds histogram\n") {
+		t.Errorf("missing the help and type lines:\n%s", b.String())
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		wantStatus int
+	}{
+		{"get", http.MethodGet, http.StatusOK},
+		{"post", http.MethodPost, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			GetMetricsHandler(noopLimiter{})(rec, httptest.NewRequest(tt.method, "/metrics", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+				t.Errorf("Content-Type = %q, want the Prometheus text format", contentType)
+			}
+			for _, line := range []string{
+				"# TYPE mail_sends_total counter",
+				"# TYPE http_inflight_requests gauge",
+				"# TYPE mail_send_failures_total counter",
+				"# TYPE mail_send_duration_seconds histogram",
+			} {
+				if !strings.Contains(rec.Body.String(), line+"\n") {
+					t.Errorf("/metrics is missing %q:\n%s", line, rec.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricsHandlerRateLimiterStats(t *testing.T) {
+	limiter := newTestRateLimiter(t, 10, nil)
+	for _, user := range []string{"idle@example.com", "busy@example.com"} {
+		limiter.Allow(user)
+	}
+	limiter.mutex.Lock()
+	limiter.lastRefill["idle@example.com"] = time.Now().Add(-2 * time.Hour)
+	limiter.mutex.Unlock()
+	limiter.cleanupInactiveBuckets()
+
+	tests := []struct {
+		name    string
+		limiter Limiter
+		want    []string
+	}{
+		{"disabled", noopLimiter{}, []string{"ratelimit_tracked_users 0", "ratelimit_cleanups_total 0", "ratelimit_evicted_total 0"}},
+		{"after a cleanup", limiter, []string{"ratelimit_tracked_users 1", "ratelimit_cleanups_total 1", "ratelimit_evicted_total 1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			GetMetricsHandler(tt.limiter)(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			for _, sample := range append(tt.want, "# TYPE ratelimit_tracked_users gauge", "# TYPE ratelimit_evicted_total counter") {
+				if !strings.Contains(rec.Body.String(), "\n"+sample+"\n") {
+					t.Errorf("/metrics is missing %q:\n%s", sample, rec.Body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// PrincipalConfig holds the settings of a single authenticated user, loaded from PRINCIPALS_FILE
+type PrincipalConfig struct {
+	// SendWindows restricts when the principal may send, sending is always allowed when empty
+	SendWindows []*SendWindow `json:"send_windows,omitempty"`
+
+	// SharedMailboxes are the addresses the principal may send as, in addition to its own
+	SharedMailboxes []string `json:"shared_mailboxes,omitempty"`
+
+	// HTMLPolicy names the policy from HTML_POLICIES_FILE applied to the principal's HTML bodies
+	HTMLPolicy string `json:"html_policy,omitempty"`
+
+	// RateLimit replaces RATE_LIMIT_PER_SEC and its burst for the principal, a max_per_sec of 0 is unlimited
+	RateLimit *RateLimitSettings `json:"rate_limit,omitempty"`
+
+	// WindowLimit caps the principal's sends over a sliding window instead of RATE_WINDOW_MAX
+	WindowLimit *WindowLimit `json:"window_limit,omitempty"`
+
+	// UnsubscribeURL overrides UNSUBSCRIBE_URL for the principal's messages
+	UnsubscribeURL string `json:"unsubscribe_url,omitempty"`
+
+	// MaxAttachmentBytes replaces MAX_ATTACHMENT_BYTES for the principal's messages, e.g for a trusted tenant
+	MaxAttachmentBytes int `json:"max_attachment_bytes,omitempty"`
+
+	// MaxAttachments replaces MAX_ATTACHMENTS for the principal's messages
+	MaxAttachments int `json:"max_attachments,omitempty"`
+
+	// EHLOHostname overrides SMTP_EHLO_HOSTNAME for the principal's sessions, e.g to match a tenant's reverse DNS
+	EHLOHostname string `json:"ehlo_hostname,omitempty"`
+
+	// APIPasswordSHA256 is the hex SHA-256 of the password accepted by the API itself. It is required when
+	// SMTP_AUTH=false, because the mail server no longer verifies the credentials.
+	APIPasswordSHA256 string `json:"api_password_sha256,omitempty"`
+}
+
+// CheckAPIPassword reports whether password matches the principal's API password hash
+func (p *PrincipalConfig) CheckAPIPassword(password string) bool {
+	if p.APIPasswordSHA256 == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(password))
+	expected := strings.ToLower(p.APIPasswordSHA256)
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(expected)) == 1
+}
+
+// SendWindow is a range of hours on some days of the week in a timezone
+type SendWindow struct {
+	Days     []string `json:"days,omitempty"`     // e.g ["mon", "tue"], every day when empty
+	Start    string   `json:"start"`              // e.g "09:00"
+	End      string   `json:"end"`                // e.g "17:00", a window ending before it starts runs past midnight
+	Timezone string   `json:"timezone,omitempty"` // IANA name e.g "Asia/Dhaka", UTC when empty
+
+	days     map[time.Weekday]bool
+	start    int // minutes after midnight
+	end      int // minutes after midnight
+	location *time.Location
+}
+
+// weekdays maps the accepted day names to their weekday
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// LoadPrincipals reads the per principal settings from a JSON file mapping usernames to their config
+func LoadPrincipals(path string) (map[string]*PrincipalConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read principals file: %w", err)
+	}
+
+	var principals map[string]*PrincipalConfig
+	if err := json.Unmarshal(data, &principals); err != nil {
+		return nil, fmt.Errorf("failed to parse principals file: %w", err)
+	}
+
+	for name, principal := range principals {
+		if principal == nil {
+			principals[name] = &PrincipalConfig{}
+			continue
+		}
+		if hash := principal.APIPasswordSHA256; hash != "" {
+			if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("principal %s: api_password_sha256 must be a hex encoded SHA-256", name)
+			}
+		}
+		if principal.EHLOHostname != "" && !isHostname(principal.EHLOHostname) {
+			return nil, fmt.Errorf("principal %s: ehlo_hostname %q is not a valid hostname", name, principal.EHLOHostname)
+		}
+		if limit := principal.RateLimit; limit != nil {
+			if limit.MaxPerSec == 0 || limit.Burst == 0 {
+				limit.Burst = limit.MaxPerSec * 2
+			}
+			if limit.MaxPerSec < 0 || (limit.MaxPerSec > 0 && limit.Burst < 1) {
+				return nil, fmt.Errorf("principal %s: rate_limit max_per_sec can't be negative and burst must be positive", name)
+			}
+		}
+		if principal.WindowLimit != nil {
+			if err := principal.WindowLimit.init(); err != nil {
+				return nil, fmt.Errorf("principal %s: %w", name, err)
+			}
+		}
+		for _, window := range principal.SendWindows {
+			if err := window.init(); err != nil {
+				return nil, fmt.Errorf("principal %s: %w", name, err)
+			}
+		}
+	}
+	return principals, nil
+}
+
+// init parses and validates the window settings
+func (sw *SendWindow) init() error {
+	var err error
+	if sw.start, err = parseClock(sw.Start); err != nil {
+		return err
+	}
+	if sw.end, err = parseClock(sw.End); err != nil {
+		return err
+	}
+	if sw.location, err = time.LoadLocation(sw.Timezone); err != nil {
+		return fmt.Errorf("invalid send window timezone %q: %w", sw.Timezone, err)
+	}
+
+	sw.days = make(map[time.Weekday]bool)
+	for _, day := range sw.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("invalid send window day %q", day)
+		}
+		sw.days[weekday] = true
+	}
+	return nil
+}
+
+// parseClock converts an HH:MM time of day to minutes after midnight
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid send window time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// onDay reports whether the window applies to the given weekday
+func (sw *SendWindow) onDay(day time.Weekday) bool {
+	return len(sw.days) == 0 || sw.days[day]
+}
+
+// Contains reports whether t falls inside the window
+func (sw *SendWindow) Contains(t time.Time) bool {
+	local := t.In(sw.location)
+	minute := local.Hour()*60 + local.Minute()
+
+	if sw.start <= sw.end {
+		return sw.onDay(local.Weekday()) && minute >= sw.start && minute < sw.end
+	}
+
+	// The window runs past midnight, the early hours belong to the previous day's window
+	yesterday := (local.Weekday() + 6) % 7
+	return (sw.onDay(local.Weekday()) && minute >= sw.start) || (sw.onDay(yesterday) && minute < sw.end)
+}
+
+// CanSendAt reports whether the principal is allowed to send at t
+func (p *PrincipalConfig) CanSendAt(t time.Time) bool {
+	if len(p.SendWindows) == 0 {
+		return true
+	}
+	for _, window := range p.SendWindows {
+		if window.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSendWindowContains(t *testing.T) {
+	// 2026-10-12 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, time.October, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name   string
+		window SendWindow
+		at     time.Time
+		want   bool
+	}{
+		{"inside", SendWindow{Start: "09:00", End: "17:00"}, at(12, 9, 0), true},
+		{"end excluded", SendWindow{Start: "09:00", End: "17:00"}, at(12, 17, 0), false},
+		{"before", SendWindow{Start: "09:00", End: "17:00"}, at(12, 8, 59), false},
+		{"weekday listed", SendWindow{Days: []string{"mon"}, Start: "09:00", End: "17:00"}, at(12, 10, 0), true},
+		{"weekday not listed", SendWindow{Days: []string{"tue"}, Start: "09:00", End: "17:00"}, at(12, 10, 0), false},
+		{"timezone", SendWindow{Start: "09:00", End: "17:00", Timezone: "Asia/Dhaka"}, at(12, 3, 0), true},
+		{"timezone outside", SendWindow{Start: "09:00", End: "17:00", Timezone: "Asia/Dhaka"}, at(12, 12, 0), false},
+		{"past midnight late", SendWindow{Start: "22:00", End: "06:00"}, at(12, 23, 0), true},
+		{"past midnight early", SendWindow{Start: "22:00", End: "06:00"}, at(12, 5, 59), true},
+		{"past midnight outside", SendWindow{Start: "22:00", End: "06:00"}, at(12, 12, 0), false},
+		// Tuesday 01:00 belongs to Monday's window
+		{"past midnight previous day", SendWindow{Days: []string{"mon"}, Start: "22:00", End: "06:00"}, at(13, 1, 0), true},
+		{"past midnight previous day not listed", SendWindow{Days: []string{"tue"}, Start: "22:00", End: "06:00"}, at(13, 1, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.window.init(); err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.window.Contains(tt.at); got != tt.want {
+				t.Errorf("Contains(%v) = %v, want %v", tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPrincipals(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"valid", `{"user@example.com": {"send_windows": [{"start": "09:00", "end": "17:00"}], "rate_limit": {"max_per_sec": 5}}}`, false},
+		{"empty entry", `{"user@example.com": null}`, false},
+		{"invalid time", `{"user@example.com": {"send_windows": [{"start": "9am", "end": "17:00"}]}}`, true},
+		{"invalid day", `{"user@example.com": {"send_windows": [{"days": ["someday"], "start": "09:00", "end": "17:00"}]}}`, true},
+		{"invalid timezone", `{"user@example.com": {"send_windows": [{"start": "09:00", "end": "17:00", "timezone": "Mars/Olympus"}]}}`, true},
+		{"invalid password hash", `{"user@example.com": {"api_password_sha256": "abc"}}`, true},
+		{"invalid ehlo hostname", `{"user@example.com": {"ehlo_hostname": "-bad-"}}`, true},
+		{"negative rate", `{"user@example.com": {"rate_limit": {"max_per_sec": -1}}}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "principals.json")
+			if err := os.WriteFile(path, []byte(tt.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			principals, err := LoadPrincipals(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadPrincipals() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			if err == nil && principals["user@example.com"] == nil {
+				t.Error("the user's entry is missing")
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// queuedJob is a send waiting to be retried, persisted as one JSON file in the queue directory
+type queuedJob struct {
+	ID          string      `json:"id"`
+	RequestID   string      `json:"request_id"`
+	Submission  *Submission `json:"submission"`
+	Attempts    int         `json:"attempts"`
+	NextAttempt time.Time   `json:"next_attempt"`
+	LastError   string      `json:"last_error"`
+	Created     time.Time   `json:"created"`
+
+	// Password holds the submission's password sealed with RETRY_QUEUE_KEY, the file never has it in clear
+	Password string `json:"encrypted_password,omitempty"`
+}
+
+// RetryQueue persists sends that failed transiently and retries them in the background with exponential
+// backoff. Jobs are files in dir, so they survive a restart. Jobs that fail permanently or run out of
+// attempts are moved to the failed subdirectory.
+type RetryQueue struct {
+	dir            string
+	key            cipher.AEAD // seals the passwords of the jobs, nil drops them for the local relay
+	mailer         Mailer
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	mutex sync.Mutex
+	jobs  map[string]*queuedJob
+
+	done      chan struct{}
+	finished  chan struct{}
+	closeOnce sync.Once
+}
+
+// NewRetryQueue opens the queue in dir, loading the jobs left by a previous run, and starts its worker.
+// The passwords of the jobs are encrypted with key, without a key they aren't written at all.
+func NewRetryQueue(dir string, key []byte, mailer Mailer, maxAttempts int, initialBackoff, maxBackoff time.Duration) (*RetryQueue, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "failed"), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create retry queue directory: %w", err)
+	}
+	var aead cipher.AEAD
+	if len(key) > 0 {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retry queue key: %w", err)
+		}
+		if aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+
+	q := &RetryQueue{
+		dir:            dir,
+		key:            aead,
+		mailer:         mailer,
+		maxAttempts:    maxAttempts,
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+		jobs:           make(map[string]*queuedJob),
+		done:           make(chan struct{}),
+		finished:       make(chan struct{}),
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		job, err := q.load(path)
+		if err != nil {
+			// A single corrupt job must not keep the service from starting, it is set aside with the failures
+			slog.Error("Moving unreadable queued email to the failed directory", "path", path, "error", err)
+			if err := os.Rename(path, filepath.Join(dir, "failed", filepath.Base(path))); err != nil {
+				slog.Error("Failed to move queued email", "path", path, "error", err)
+			}
+			continue
+		}
+		q.jobs[job.ID] = job
+	}
+	if len(q.jobs) > 0 {
+		slog.Info("Loaded queued emails", "jobs", len(q.jobs))
+	}
+
+	go q.run()
+	return q, nil
+}
+
+// load reads a queued job from its file and decrypts its password
+func (q *RetryQueue) load(path string) (*queuedJob, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queued job: %w", err)
+	}
+	var job queuedJob
+	if err := json.Unmarshal(data, &job); err != nil || job.Submission == nil {
+		return nil, fmt.Errorf("failed to parse queued job: %v", err)
+	}
+	if job.Password != "" {
+		if job.Submission.Password, err = q.open(job.ID, job.Password); err != nil {
+			return nil, fmt.Errorf("failed to decrypt the password of queued job: %v", err)
+		}
+		job.Password = ""
+	}
+	return &job, nil
+}
+
+// Enqueue persists the submission for a retry after the first backoff and returns the job ID
+func (q *RetryQueue) Enqueue(ctx context.Context, submission *Submission, cause error) (string, error) {
+	now := time.Now().UTC()
+	job := &queuedJob{
+		ID:          newRequestID(),
+		RequestID:   requestID(ctx),
+		Submission:  submission,
+		Attempts:    1,
+		NextAttempt: now.Add(q.backoff(1)),
+		LastError:   cause.Error(),
+		Created:     now,
+	}
+	if err := q.save(job); err != nil {
+		return "", err
+	}
+
+	q.mutex.Lock()
+	q.jobs[job.ID] = job
+	q.mutex.Unlock()
+	return job.ID, nil
+}
+
+// Len returns the number of jobs waiting to be retried
+func (q *RetryQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.jobs)
+}
+
+// Close stops the worker after the retry in progress, if any. Pending jobs stay on disk for the next run.
+func (q *RetryQueue) Close() {
+	q.closeOnce.Do(func() {
+		close(q.done)
+	})
+	<-q.finished
+}
+
+// run retries the due jobs once a second until the queue is closed
+func (q *RetryQueue) run() {
+	defer close(q.finished)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, job := range q.due(time.Now()) {
+				select {
+				case <-q.done:
+					return
+				default:
+				}
+				q.retry(job)
+			}
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// due returns the jobs whose next attempt has come, oldest first
+func (q *RetryQueue) due(now time.Time) []*queuedJob {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var jobs []*queuedJob
+	for _, job := range q.jobs {
+		if !job.NextAttempt.After(now) {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+	return jobs
+}
+
+// retry sends the job again, then removes it, schedules the next attempt or gives up on it
+func (q *RetryQueue) retry(job *queuedJob) {
+	logger := slog.Default().With("request_id", job.RequestID, "queue_id", job.ID,
+		"username", job.Submission.Username, "recipients", len(job.Submission.To))
+
+	start := time.Now()
+	_, err := q.mailer.Send(context.Background(), job.Submission)
+	sendDurationHistogram.observeSince(start)
+	if err == nil {
+		recordSend(len(job.Submission.To))
+		logger.Info("Queued email sent", "attempts", job.Attempts+1)
+		q.remove(job, "")
+		return
+	}
+
+	recordSendFailure(err, len(job.Submission.To))
+	job.Attempts++
+	job.LastError = err.Error()
+	if !isTransientSendError(err) || job.Attempts >= q.maxAttempts {
+		logger.Error("Giving up on queued email", "attempts", job.Attempts, "error", err)
+		q.remove(job, filepath.Join(q.dir, "failed", job.ID+".json"))
+		return
+	}
+
+	job.NextAttempt = time.Now().UTC().Add(q.backoff(job.Attempts))
+	logger.Warn("Queued email failed again", "attempts", job.Attempts, "next_attempt", job.NextAttempt, "error", err)
+	if err := q.save(job); err != nil {
+		logger.Error("Failed to persist queued email", "error", err)
+	}
+}
+
+// remove drops the job from the queue, moving its file to failedPath when set and deleting it otherwise
+func (q *RetryQueue) remove(job *queuedJob, failedPath string) {
+	q.mutex.Lock()
+	delete(q.jobs, job.ID)
+	q.mutex.Unlock()
+
+	path := q.path(job.ID)
+	if failedPath != "" {
+		if err := q.save(job); err == nil {
+			if err := os.Rename(path, failedPath); err == nil {
+				return
+			}
+		}
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Failed to remove queued email", "queue_id", job.ID, "error", err)
+	}
+}
+
+// save writes the job to a temporary file first so a crash never leaves a truncated job behind
+func (q *RetryQueue) save(job *queuedJob) error {
+	stored, submission := *job, *job.Submission
+	submission.Password = ""
+	stored.Submission = &submission
+	if q.key != nil {
+		stored.Password = q.seal(job.ID, job.Submission.Password)
+	}
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return err
+	}
+	tmp := q.path(job.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write queued job: %w", err)
+	}
+	return os.Rename(tmp, q.path(job.ID))
+}
+
+// seal encrypts the password of the job, its ID is authenticated along so sealed passwords can't be swapped
+func (q *RetryQueue) seal(id, password string) string {
+	nonce := make([]byte, q.key.NonceSize())
+	rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(q.key.Seal(nonce, nonce, []byte(password), []byte(id)))
+}
+
+// open decrypts the password seal returned for the job
+func (q *RetryQueue) open(id, sealed string) (string, error) {
+	if q.key == nil {
+		return "", errors.New("RETRY_QUEUE_KEY is not set")
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < q.key.NonceSize() {
+		return "", errors.New("malformed password")
+	}
+	password, err := q.key.Open(nil, data[:q.key.NonceSize()], data[q.key.NonceSize():], []byte(id))
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
+
+// path returns the file of the job in the queue directory
+func (q *RetryQueue) path(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+// backoff returns the delay before the attempt after the given number of attempts, doubling each time
+func (q *RetryQueue) backoff(attempts int) time.Duration {
+	delay := q.initialBackoff
+	for i := 1; i < attempts && delay < q.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > q.maxBackoff {
+		return q.maxBackoff
+	}
+	return delay
+}
+
+// isTransientSendError reports whether a failed send may succeed later: the server couldn't be reached or
+// didn't answer in time, or it replied with a 4xx code. A partial delivery is never retried as a whole,
+// the recipients already served would get the message twice, and neither is a message the server may have
+// accepted before the session broke.
+func isTransientSendError(err error) bool {
+	var partial *partialDeliveryError
+	var unconfirmed *unconfirmedDeliveryError
+	if errors.As(err, &partial) || errors.As(err, &unconfirmed) {
+		return false
+	}
+	if errors.Is(err, errSMTPTimeout) {
+		return true
+	}
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return reply.Code >= 400 && reply.Code < 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The password of a queued send is never written in clear, and comes back when the queue is reopened
+func TestRetryQueuePassword(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	tests := []struct {
+		name         string
+		key          []byte
+		reopenKey    []byte
+		wantPassword string
+		// wantFailed is set when the password can't be decrypted and the job is set aside
+		wantFailed bool
+	}{
+		{"encrypted", key, key, "secret", false},
+		{"no key for the relay", nil, nil, "", false},
+		{"other key", key, bytes.Repeat([]byte{2}, 32), "", true},
+		{"key removed", key, nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			queue, err := NewRetryQueue(dir, tt.key, nil, 3, time.Hour, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, err := queue.Enqueue(context.Background(), &Submission{
+				Username: "user@example.com",
+				Password: "secret",
+				From:     "user@example.com",
+				To:       []string{"to@example.com"},
+				Message:  []byte("Subject: hi\r\n\r\nhi\r\n"),
+			}, errors.New("unavailable"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			queue.Close()
+
+			data, err := os.ReadFile(filepath.Join(dir, id+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(data, []byte("secret")) {
+				t.Fatalf("the queued file holds the password in clear: %s", data)
+			}
+
+			reopened, err := NewRetryQueue(dir, tt.reopenKey, nil, 3, time.Hour, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+			if tt.wantFailed {
+				if reopened.Len() != 0 {
+					t.Errorf("Len() = %d, want the undecryptable job left out", reopened.Len())
+				}
+				if _, err := os.Stat(filepath.Join(dir, "failed", id+".json")); err != nil {
+					t.Errorf("the undecryptable job wasn't moved to failed: %v", err)
+				}
+				return
+			}
+			reopened.mutex.Lock()
+			defer reopened.mutex.Unlock()
+			if got := reopened.jobs[id].Submission.Password; got != tt.wantPassword {
+				t.Errorf("Password = %q, want %q", got, tt.wantPassword)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRetryQueueKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"smtp auth without a key", map[string]string{"SMTP_AUTH": "true"}, true},
+		{"smtp auth with a key", map[string]string{"SMTP_AUTH": "true", "RETRY_QUEUE_KEY": "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}, false},
+		{"short key", map[string]string{"SMTP_AUTH": "true", "RETRY_QUEUE_KEY": "AQEBAQ=="}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RETRY_QUEUE_DIR", t.TempDir())
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			if _, err := LoadConfig(); (err != nil) != tt.wantErr {
+				t.Errorf("LoadConfig() error = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewRetryQueueSkipsCorruptJobs(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := NewRetryQueue(dir, nil, nil, 3, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := queue.Enqueue(context.Background(), &Submission{
+		Username: "user@example.com",
+		From:     "user@example.com",
+		To:       []string{"to@example.com"},
+		Message:  []byte("Subject: hi\r\n\r\nhi\r\n"),
+	}, errors.New("unavailable"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Close()
+
+	corrupt := map[string]string{
+		"truncated.json":     `{"id": "truncated", "submission": {`,
+		"no-submission.json": `{"id": "no-submission"}`,
+	}
+	for name, data := range corrupt {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reopened, err := NewRetryQueue(dir, nil, nil, 3, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("NewRetryQueue() error = %v, want the corrupt jobs skipped", err)
+	}
+	defer reopened.Close()
+	if reopened.Len() != 1 {
+		t.Errorf("Len() = %d, want only the valid job", reopened.Len())
+	}
+	if _, err := os.Stat(filepath.Join(dir, id+".json")); err != nil {
+		t.Errorf("the valid job was moved: %v", err)
+	}
+	for name := range corrupt {
+		if _, err := os.Stat(filepath.Join(dir, "failed", name)); err != nil {
+			t.Errorf("%s wasn't moved to failed: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+)
+
+// LoadRecipientNames reads the JSON object mapping recipient addresses to their display names
+func LoadRecipientNames(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recipient names file: %w", err)
+	}
+
+	var names map[string]string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return nil, fmt.Errorf("failed to parse recipient names file: %w", err)
+	}
+
+	// Addresses are matched case-insensitively
+	lowered := make(map[string]string, len(names))
+	for address, name := range names {
+		lowered[strings.ToLower(address)] = name
+	}
+	return lowered, nil
+}
+
+// formatRecipients renders bare addresses as Name <address> for the recipient headers, using the known
+// names and, when derive is set, a name derived from the local part e.g john.doe becomes John Doe.
+// Addresses that already have a display name or can't be parsed are kept as they are.
+func formatRecipients(addresses []string, names map[string]string, derive bool) []string {
+	formatted := make([]string, len(addresses))
+	for i, address := range addresses {
+		formatted[i] = address
+		parsed, err := mail.ParseAddress(address)
+		if err != nil || parsed.Name != "" {
+			continue
+		}
+
+		name, ok := names[strings.ToLower(parsed.Address)]
+		if !ok && derive {
+			localPart, _, _ := strings.Cut(parsed.Address, "@")
+			name = strings.Title(strings.Join(strings.FieldsFunc(localPart, func(r rune) bool {
+				return r == '.' || r == '_' || r == '-'
+			}), " "))
+		}
+		if name != "" {
+			formatted[i] = formatAddress(name, parsed.Address)
+		}
+	}
+	return formatted
+}
+
+// dedupeRecipients drops addresses already given earlier in the same or a previous list, compared
+// case-insensitively, so a recipient in To and Bcc gets one copy. It returns how many were dropped.
+func dedupeRecipients(lists ...*[]string) int {
+	seen := make(map[string]bool)
+	var dropped int
+	for _, list := range lists {
+		kept := (*list)[:0:0]
+		for _, address := range *list {
+			key := strings.ToLower(envelopeAddress(address))
+			if seen[key] {
+				dropped++
+				continue
+			}
+			seen[key] = true
+			kept = append(kept, address)
+		}
+		*list = kept
+	}
+	return dropped
+}
+
+// envelopeAddress returns the bare address of a recipient for the SMTP envelope, dropping any display name
+func envelopeAddress(address string) string {
+	if parsed, err := mail.ParseAddress(address); err == nil {
+		return parsed.Address
+	}
+	return strings.TrimSpace(address)
+}
+
+// recipientDomain is the recipients of a message sharing a domain
+type recipientDomain struct {
+	domain    string
+	addresses []string
+}
+
+// groupByDomain groups the recipients by their lowercased domain, the groups and the addresses in them
+// keep the order they first appear in
+func groupByDomain(addresses []string) []recipientDomain {
+	var groups []recipientDomain
+	index := make(map[string]int)
+	for _, address := range addresses {
+		_, domain, _ := strings.Cut(envelopeAddress(address), "@")
+		domain = strings.ToLower(domain)
+		i, ok := index[domain]
+		if !ok {
+			i = len(groups)
+			index[domain] = i
+			groups = append(groups, recipientDomain{domain: domain})
+		}
+		groups[i].addresses = append(groups[i].addresses, address)
+	}
+	return groups
+}
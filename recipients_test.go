@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatRecipients(t *testing.T) {
+	names := map[string]string{"ceo@example.com": "Jane Roe"}
+	tests := []struct {
+		name    string
+		address string
+		derive  bool
+		want    string
+	}{
+		{"known name", "CEO@example.com", false, `"Jane Roe" <CEO@example.com>`},
+		{"unknown kept", "john.doe@example.com", false, "john.doe@example.com"},
+		{"derived", "john.doe@example.com", true, `"John Doe" <john.doe@example.com>`},
+		{"derived from separators", "mary_ann-lee@example.com", true, `"Mary Ann Lee" <mary_ann-lee@example.com>`},
+		{"known name before derived", "ceo@example.com", true, `"Jane Roe" <ceo@example.com>`},
+		{"display name kept", "Boss <ceo@example.com>", true, "Boss <ceo@example.com>"},
+		{"unparsable kept", "not an address", true, "not an address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatRecipients([]string{tt.address}, names, tt.derive); got[0] != tt.want {
+				t.Errorf("formatRecipients(%q) = %q, want %q", tt.address, got[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestDedupeRecipients(t *testing.T) {
+	to := []string{"a@example.com", "A@Example.com", "Bee <b@example.com>"}
+	cc := []string{"b@example.com", "c@example.com"}
+	bcc := []string{"C@example.com", "d@example.com", "a@example.com"}
+	if dropped := dedupeRecipients(&to, &cc, &bcc); dropped != 4 {
+		t.Errorf("dropped %d, want 4", dropped)
+	}
+
+	tests := []struct {
+		list string
+		got  []string
+		want string
+	}{
+		{"to", to, "a@example.com,Bee <b@example.com>"},
+		{"cc", cc, "c@example.com"},
+		{"bcc", bcc, "d@example.com"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(tt.got, ","); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestGroupByDomain(t *testing.T) {
+	groups := groupByDomain([]string{"a@one.example", "Bee <b@Two.example>", "c@ONE.example", "d@two.example"})
+	var got []string
+	for _, group := range groups {
+		got = append(got, group.domain+"="+strings.Join(group.addresses, ","))
+	}
+	want := "one.example=a@one.example,c@ONE.example|two.example=Bee <b@Two.example>,d@two.example"
+	if strings.Join(got, "|") != want {
+		t.Errorf("groupByDomain() = %s, want %s", strings.Join(got, "|"), want)
+	}
+}
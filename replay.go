@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxIdempotencyKeyLength is the longest Idempotency-Key header accepted
+const maxIdempotencyKeyLength = 255
+
+// replayState is the outcome of reserving a key in a replayCache
+type replayState int
+
+const (
+	replayNew     replayState = iota // first request with the key, the caller sends and finishes it
+	replayCached                     // an earlier request succeeded, its response is replayed
+	replayPending                    // an earlier request with the key is still being processed
+)
+
+// cachedResponse is a successful response kept for replaying
+type cachedResponse struct {
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time     // zero while the request is still pending
+	done        chan struct{} // closed once the pending request finished
+}
+
+// replayCache remembers the successful responses to requests by key for a while, so a retried
+// request gets the original response instead of sending the message again
+type replayCache struct {
+	mutex     sync.Mutex
+	ttl       time.Duration
+	entries   map[string]*cachedResponse
+	lastSweep time.Time
+}
+
+// newReplayCache creates a cache keeping responses for ttl
+func newReplayCache(ttl time.Duration) *replayCache {
+	return &replayCache{ttl: ttl, entries: make(map[string]*cachedResponse)}
+}
+
+// reserve claims the key for a new request, or returns the cached response of an earlier one.
+// A pending request is returned as well, so the caller can wait on its done channel.
+func (c *replayCache) reserve(key string) (replayState, *cachedResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	c.sweep(now)
+	if entry, ok := c.entries[key]; ok {
+		if entry.expires.IsZero() {
+			return replayPending, entry
+		}
+		if now.Before(entry.expires) {
+			return replayCached, entry
+		}
+	}
+	c.entries[key] = &cachedResponse{done: make(chan struct{})}
+	return replayNew, nil
+}
+
+// wait reserves the key like reserve, but waits for a pending request with the key to finish first.
+// It returns replayPending when ctx is done before that.
+func (c *replayCache) wait(ctx context.Context, key string) (replayState, *cachedResponse) {
+	for {
+		state, entry := c.reserve(key)
+		if state != replayPending {
+			return state, entry
+		}
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return replayPending, nil
+		}
+	}
+}
+
+// finish stores the captured response of a reserved key when it succeeded, otherwise it releases
+// the key so a retry is processed again
+func (c *replayCache) finish(key string, rec *capturingWriter) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if pending, ok := c.entries[key]; ok && pending.done != nil {
+		defer close(pending.done)
+	}
+	if rec.status < 200 || rec.status > 299 {
+		delete(c.entries, key)
+		return
+	}
+	c.entries[key] = &cachedResponse{
+		status:      rec.status,
+		contentType: rec.Header().Get("Content-Type"),
+		body:        rec.body.Bytes(),
+		expires:     time.Now().Add(c.ttl),
+	}
+}
+
+// sweep drops expired responses at most once a minute. The caller must hold the mutex.
+func (c *replayCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	c.lastSweep = now
+	for key, entry := range c.entries {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// reserveIdempotencyKey handles the Idempotency-Key header of a send. A request repeating the key of an
+// earlier successful one gets its response replayed and false is returned, one arriving while the first is
+// still processed waits for it. Otherwise it returns the writer to respond through and finish, which
+// stores the response once the request is done. Keys are scoped to the credentials.
+func reserveIdempotencyKey(w http.ResponseWriter, r *http.Request, cache *replayCache, username, password string) (http.ResponseWriter, func(), bool) {
+	key := r.Header.Get("Idempotency-Key")
+	if cache == nil || key == "" {
+		return w, func() {}, true
+	}
+	if len(key) > maxIdempotencyKeyLength || sanitizeHeaderValue(key) != nil {
+		writeError(w, "invalid_idempotency_key",
+			fmt.Sprintf("The Idempotency-Key header must be at most %d characters without control characters", maxIdempotencyKeyLength))
+		return w, nil, false
+	}
+
+	owner := credentialsHash(username, password)
+	cacheKey := string(owner[:]) + key
+	state, cached := cache.wait(r.Context(), cacheKey)
+	switch state {
+	case replayCached:
+		w.Header().Set("Idempotent-Replayed", "true")
+		cached.write(w)
+		return w, nil, false
+	case replayPending:
+		writeError(w, "idempotency_key_in_progress", "A request with this Idempotency-Key is still being processed")
+		return w, nil, false
+	}
+	rec := &capturingWriter{ResponseWriter: w}
+	return rec, func() { cache.finish(cacheKey, rec) }, true
+}
+
+// write replays the cached response
+func (r *cachedResponse) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", r.contentType)
+	w.WriteHeader(r.status)
+	w.Write(r.body)
+}
+
+// capturingWriter records the status and body written through it
+type capturingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *capturingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *capturingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
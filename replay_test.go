@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// idempotentRequest runs a request with the Idempotency-Key through the cache, answering status when it is
+// processed, and reports whether it was
+func idempotentRequest(cache *replayCache, password, key string, status int) (*httptest.ResponseRecorder, bool) {
+	req := httptest.NewRequest(http.MethodPost, "/mail/send", nil)
+	req.Header.Set("Idempotency-Key", key)
+	rec := httptest.NewRecorder()
+	w, finish, ok := reserveIdempotencyKey(rec, req, cache, "user@example.com", password)
+	if !ok {
+		return rec, false
+	}
+	writeJSON(w, status, map[string]any{"status": http.StatusText(status)})
+	finish()
+	return rec, true
+}
+
+func TestReserveIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name          string
+		firstStatus   int
+		retryPassword string
+		retryKey      string
+		wantProcessed bool
+		wantReplayed  bool
+	}{
+		{"success replayed", http.StatusOK, "secret", "key-1", false, true},
+		{"partial batch replayed", http.StatusMultiStatus, "secret", "key-1", false, true},
+		{"failure processed again", http.StatusBadGateway, "secret", "key-1", true, false},
+		{"rate limited processed again", http.StatusTooManyRequests, "secret", "key-1", true, false},
+		{"other credentials", http.StatusOK, "guessed", "key-1", true, false},
+		{"other key", http.StatusOK, "secret", "key-2", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newReplayCache(time.Hour)
+			first, _ := idempotentRequest(cache, "secret", "key-1", tt.firstStatus)
+
+			rec, processed := idempotentRequest(cache, tt.retryPassword, tt.retryKey, http.StatusOK)
+			if processed != tt.wantProcessed {
+				t.Errorf("retry processed = %v, want %v", processed, tt.wantProcessed)
+			}
+			if replayed := rec.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.wantReplayed {
+				t.Errorf("retry replayed = %v, want %v", replayed, tt.wantReplayed)
+			}
+			if tt.wantReplayed && (rec.Code != first.Code || rec.Body.String() != first.Body.String()) {
+				t.Errorf("replayed %d %s, want the original %d %s", rec.Code, rec.Body, first.Code, first.Body)
+			}
+		})
+	}
+}
+
+func TestReserveIdempotencyKeyInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"too long", strings.Repeat("k", maxIdempotencyKeyLength+1)},
+		{"control characters", "key\r\nX-Injected: 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, processed := idempotentRequest(newReplayCache(time.Hour), "secret", tt.key, http.StatusOK)
+			if processed || rec.Code != errorStatus("invalid_idempotency_key") {
+				t.Errorf("got processed = %v, %d %s, want invalid_idempotency_key", processed, rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+// A retry arriving while the first request is processed waits for its response, or gives up with its context
+func TestReplayCacheWait(t *testing.T) {
+	tests := []struct {
+		name      string
+		timeout   time.Duration
+		wantState replayState
+	}{
+		{"first request finishes", time.Second, replayCached},
+		{"retry gives up", 10 * time.Millisecond, replayPending},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newReplayCache(time.Hour)
+			if state, _ := cache.reserve("key"); state != replayNew {
+				t.Fatalf("reserve() = %v, want replayNew", state)
+			}
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				rec := &capturingWriter{ResponseWriter: httptest.NewRecorder()}
+				writeJSON(rec, http.StatusOK, map[string]any{"status": "success"})
+				cache.finish("key", rec)
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			if state, _ := cache.wait(ctx, "key"); state != tt.wantState {
+				t.Errorf("wait() = %v, want %v", state, tt.wantState)
+			}
+		})
+	}
+}
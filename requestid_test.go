@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithRequestID(t *testing.T) {
+	var seen []string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, requestID(r.Context()))
+	}))
+
+	var headers []string
+	for range 2 {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		headers = append(headers, rec.Header().Get("X-Request-Id"))
+	}
+
+	for i, header := range headers {
+		if len(header) != 32 || header != seen[i] {
+			t.Errorf("request %d: header %q, context %q, want the same 32 hex characters", i, header, seen[i])
+		}
+	}
+	if headers[0] == headers[1] {
+		t.Errorf("both requests got the ID %s", headers[0])
+	}
+	if id := requestID(context.Background()); id != "" {
+		t.Errorf("requestID() outside a request = %q, want none", id)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "sync/atomic"
+
+// Router picks the mail servers of SMTP_HOSTS a message is submitted to. The first one returned is tried
+// first, the next ones in order when the previous couldn't take the message.
+type Router interface {
+	Route(from string, to []string) []string
+}
+
+// failoverRouter always tries the hosts in the configured order, the first one is the primary
+type failoverRouter struct {
+	hosts []string
+}
+
+func (r *failoverRouter) Route(string, []string) []string {
+	return r.hosts
+}
+
+// roundRobinRouter starts every send at the host after the one the previous send started at, the
+// others follow in order to fail over to
+type roundRobinRouter struct {
+	hosts []string
+	next  atomic.Uint64
+}
+
+func (r *roundRobinRouter) Route(string, []string) []string {
+	start := int((r.next.Add(1) - 1) % uint64(len(r.hosts)))
+	return append(append(make([]string, 0, len(r.hosts)), r.hosts[start:]...), r.hosts[:start]...)
+}
+
+// newRouter returns the router of an SMTP_ROUTING strategy for the hosts
+func newRouter(strategy string, hosts []string) Router {
+	if strategy == "round-robin" {
+		return &roundRobinRouter{hosts: hosts}
+	}
+	return &failoverRouter{hosts: hosts}
+}
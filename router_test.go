@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	hosts := []string{"a:587", "b:587", "c:587"}
+	tests := []struct {
+		strategy string
+		want     []string // the order of every Route call
+	}{
+		{"failover", []string{"a:587,b:587,c:587", "a:587,b:587,c:587", "a:587,b:587,c:587"}},
+		{"round-robin", []string{"a:587,b:587,c:587", "b:587,c:587,a:587", "c:587,a:587,b:587", "a:587,b:587,c:587"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			router := newRouter(tt.strategy, hosts)
+			for i, want := range tt.want {
+				if got := strings.Join(router.Route("user@example.com", []string{"to@example.com"}), ","); got != want {
+					t.Errorf("call %d routed to %s, want %s", i, got, want)
+				}
+			}
+			if strings.Join(hosts, ",") != "a:587,b:587,c:587" {
+				t.Errorf("Route() changed the configured hosts to %v", hosts)
+			}
+		})
+	}
+}
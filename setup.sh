@@ -24,6 +24,7 @@ After=network.target
 
 [Service]
 ExecStart=$GO_BINARY_PATH
+EnvironmentFile=-/etc/default/$SERVICE_NAME
 Restart=always
 WorkingDirectory=$WORKING_DIR
 
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// drainGate rejects new requests with 503 once shutdown begins, while the requests already in flight finish
+type drainGate struct {
+	draining atomic.Bool
+	inflight atomic.Int64
+}
+
+// wrap passes requests through the gate
+func (g *drainGate) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.inflight.Add(1)
+		defer g.inflight.Add(-1)
+
+		if g.draining.Load() {
+			w.Header().Set("Retry-After", "5")
+			w.Header().Set("Connection", "close")
+			writeError(w, "shutting_down", "The server is shutting down, retry later")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// drain stops accepting new requests and waits until the in-flight ones finish or ctx is done.
+// It returns the number of requests still in flight.
+func (g *drainGate) drain(ctx context.Context) int64 {
+	g.draining.Store(true)
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if n := g.inflight.Load(); n == 0 {
+			return 0
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return g.inflight.Load()
+		}
+	}
+}
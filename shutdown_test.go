@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDrainGate(t *testing.T) {
+	var gate drainGate
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := gate.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	inflight := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		inflight <- rec.Code
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if n := gate.drain(ctx); n != 1 {
+		t.Errorf("drain() with a request in flight = %d, want 1", n)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("new request while draining got %d with Retry-After %q, want 503 and a Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	close(release)
+	if code := <-inflight; code != http.StatusOK {
+		t.Errorf("in-flight request got %d, want it to finish", code)
+	}
+	if n := gate.drain(context.Background()); n != 0 {
+		t.Errorf("drain() once the requests finished = %d, want 0", n)
+	}
+}
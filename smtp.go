@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// errSMTPUTF8Unsupported is returned when an address needs SMTPUTF8 but the server doesn't advertise it
+var errSMTPUTF8Unsupported = errors.New("the mail server does not support SMTPUTF8, which non-ASCII addresses require")
+
+// err8BitMIMEUnsupported is returned when an 8bit body is sent to a server that doesn't advertise 8BITMIME
+var err8BitMIMEUnsupported = errors.New("the mail server does not support 8BITMIME, which the 8bit encoding requires")
+
+// errSMTPTimeout is returned when the mail server doesn't complete the session in time
+var errSMTPTimeout = errors.New("the mail server did not respond in time")
+
+// sendOptions adjusts how sendMail delivers a message
+type sendOptions struct {
+	// require8BitMIME rejects the send when the server doesn't advertise 8BITMIME
+	require8BitMIME bool
+
+	// skipStartTLS doesn't upgrade the connection even when the server offers STARTTLS
+	skipStartTLS bool
+
+	// authBeforeStartTLS authenticates before upgrading the connection, for servers that demand it.
+	// The credentials then travel unencrypted.
+	authBeforeStartTLS bool
+
+	// ehloHostname is sent with EHLO instead of "localhost" when set
+	ehloHostname string
+
+	// maxRecipientsPerTransaction splits the recipients into several transactions of at most this many
+	// for servers limiting RCPT commands, 0 sends to everyone in one transaction
+	maxRecipientsPerTransaction int
+
+	// groupByDomain gives every domain of the recipients its own transactions, so the mail server can hand
+	// each transaction to a single destination
+	groupByDomain bool
+}
+
+// partialDeliveryError reports a failed transaction after earlier batches of recipients were delivered,
+// results holds the outcome for every recipient
+type partialDeliveryError struct {
+	results []recipientStatus
+	err     error
+}
+
+func (e *partialDeliveryError) Error() string {
+	return fmt.Sprintf("%v (already delivered to %d recipients)", e.err, e.delivered())
+}
+
+// delivered returns the number of recipients that got the message
+func (e *partialDeliveryError) delivered() int {
+	n := 0
+	for _, result := range e.results {
+		if result.Status == "sent" {
+			n++
+		}
+	}
+	return n
+}
+
+func (e *partialDeliveryError) Unwrap() error {
+	return e.err
+}
+
+// unconfirmedDeliveryError reports a session that broke after the whole message was sent but before the
+// server replied to it. The server may have accepted the message, so it must not be sent again.
+type unconfirmedDeliveryError struct {
+	err error
+}
+
+func (e *unconfirmedDeliveryError) Error() string {
+	return fmt.Sprintf("%v (the mail server may have accepted the message)", e.err)
+}
+
+func (e *unconfirmedDeliveryError) Unwrap() error {
+	return e.err
+}
+
+// sendResult describes a message accepted by the mail server
+type sendResult struct {
+	// Response is the text of the server's final 250 reply, which may note e.g that the message was queued
+	Response string
+	Host     string // mail server that accepted the message
+	Timings  sendTimings
+}
+
+// sendTimings breaks down how long each phase of a send took
+type sendTimings struct {
+	Dial time.Duration // connecting, the greeting and EHLO
+	TLS  time.Duration // STARTTLS handshake
+	Auth time.Duration // AUTH exchange
+	Data time.Duration // MAIL, RCPT and DATA
+}
+
+// MarshalJSON reports the timings in milliseconds
+func (t sendTimings) MarshalJSON() ([]byte, error) {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return json.Marshal(map[string]float64{
+		"dial_ms": ms(t.Dial),
+		"tls_ms":  ms(t.TLS),
+		"auth_ms": ms(t.Auth),
+		"data_ms": ms(t.Data),
+	})
+}
+
+// needsSMTPUTF8 reports whether any of the addresses has a non-ASCII local part
+func needsSMTPUTF8(addresses ...string) bool {
+	for _, address := range addresses {
+		localPart := address
+		if at := strings.LastIndex(address, "@"); at >= 0 {
+			localPart = address[:at]
+		}
+		if !isASCII(localPart) {
+			return true
+		}
+	}
+	return false
+}
+
+// isASCII reports whether s only contains ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// sendMail works like smtp.SendMail but inspects the server extensions before sending, so messages
+// the server can't handle are rejected up front. SMTPUTF8 and 8BITMIME are requested automatically when offered.
+// The session is abandoned with errSMTPTimeout when ctx expires.
+func sendMail(ctx context.Context, addr string, auth smtp.Auth, from string, to []string, msg []byte, opts sendOptions) (result *sendResult, err error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	result = &sendResult{Host: host}
+	c, err := openSession(ctx, addr, host, auth, opts, &result.Timings)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer c.Close()
+	defer func() { err = timeoutError(ctx, err) }()
+
+	if err = checkExtensions(c, from, to, opts.require8BitMIME); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	if result.Response, err = deliver(c, from, to, msg, opts); err != nil {
+		return nil, err
+	}
+	result.Timings.Data = time.Since(start)
+	quit(ctx, c)
+	return result, nil
+}
+
+// quit ends a session whose messages the server already accepted. A failed QUIT doesn't undo their
+// delivery, so it is only logged, reporting it would get a delivered message retried.
+func quit(ctx context.Context, c *smtp.Client) {
+	if err := c.Quit(); err != nil {
+		requestLogger(ctx).Warn("Mail server failed to end the session after accepting the message", "error", err)
+	}
+}
+
+// deliver sends the same message in one transaction per batch of at most size recipients
+func deliver(c *smtp.Client, from string, to []string, msg []byte, opts sendOptions) (string, error) {
+	var responses []string
+	var results []recipientStatus
+	batches := transactionRecipients(to, opts)
+	for i, batch := range batches {
+		response, err := transaction(c, from, batch, msg)
+		if err != nil {
+			if len(results) == 0 {
+				return "", err
+			}
+			for _, recipient := range batch {
+				results = append(results, recipientStatus{Recipient: recipient, Status: "failed", Error: err.Error()})
+			}
+			for _, rest := range batches[i+1:] {
+				for _, recipient := range rest {
+					results = append(results, recipientStatus{Recipient: recipient, Status: "failed",
+						Error: "Not sent, an earlier transaction failed"})
+				}
+			}
+			return "", &partialDeliveryError{results: results, err: err}
+		}
+		responses = append(responses, response)
+		for _, recipient := range batch {
+			results = append(results, recipientStatus{Recipient: recipient, Status: "sent", SMTPResponse: response})
+		}
+	}
+	return strings.Join(responses, "; "), nil
+}
+
+// batchItem is one message of a sendBatch, with the outcome of its transaction
+type batchItem struct {
+	from            string
+	to              []string
+	msg             []byte
+	require8BitMIME bool
+
+	done     bool // the message was tried, response or err holds the outcome
+	response string
+	err      error
+}
+
+// sendBatch delivers several messages over a single session, one transaction each. A message the server
+// refuses only fails its own item, the session is reset and the next message is sent. When the connection
+// breaks a new session is opened for the remaining messages. An error returned means the mail server
+// couldn't be reached again, items without an outcome weren't sent.
+func sendBatch(ctx context.Context, addr string, auth smtp.Auth, items []*batchItem, opts sendOptions) (err error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	var timings sendTimings
+	c, err := openSession(ctx, addr, host, auth, opts, &timings)
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	// c is replaced when the session is reopened and nil when that failed
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+	defer func() { err = timeoutError(ctx, err) }()
+
+	for _, item := range items {
+		item.done = true
+		for attempt := 0; ; attempt++ {
+			if item.err = checkExtensions(c, item.from, item.to, item.require8BitMIME); item.err != nil {
+				break
+			}
+			item.response, item.err = deliver(c, item.from, item.to, item.msg, opts)
+			if item.err == nil {
+				break
+			}
+			item.err = timeoutError(ctx, item.err)
+
+			// A refused transaction leaves the session usable after RSET, a broken connection doesn't
+			if c.Reset() == nil {
+				break
+			}
+			c.Close()
+			if c, err = openSession(ctx, addr, host, auth, opts, &timings); err != nil {
+				return err
+			}
+
+			// A message lost with the connection before the server got all of it is sent again, once
+			if attempt > 0 || !lostWithConnection(item.err) {
+				break
+			}
+		}
+	}
+	quit(ctx, c)
+	return nil
+}
+
+// lostWithConnection reports whether a send failed because the connection broke before the server could
+// accept the message, rather than because the server refused it or may have accepted it
+func lostWithConnection(err error) bool {
+	var reply *textproto.Error
+	var partial *partialDeliveryError
+	var unconfirmed *unconfirmedDeliveryError
+	return !errors.As(err, &reply) && !errors.As(err, &partial) && !errors.As(err, &unconfirmed) &&
+		!errors.Is(err, errSMTPTimeout)
+}
+
+// openSession connects to the mail server and authenticates, upgrading to TLS when the server offers it
+func openSession(ctx context.Context, addr, host string, auth smtp.Auth, opts sendOptions, timings *sendTimings) (_ *smtp.Client, err error) {
+	start := time.Now()
+	c, err := dial(ctx, addr, host, opts.ehloHostname)
+	if err != nil {
+		return nil, err
+	}
+	// c is a local so the failure paths returning nil still close the session
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
+
+	// The first extension lookup sends EHLO
+	ok, _ := c.Extension("STARTTLS")
+	timings.Dial = time.Since(start)
+
+	if opts.authBeforeStartTLS && auth != nil {
+		if err = authenticate(c, cleartextAuth{auth}, timings); err != nil {
+			return nil, err
+		}
+	}
+
+	// Upgrade to TLS when the server offers it
+	if ok && !opts.skipStartTLS {
+		start = time.Now()
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return nil, err
+		}
+		timings.TLS = time.Since(start)
+	}
+
+	if !opts.authBeforeStartTLS && auth != nil {
+		if err = authenticate(c, auth, timings); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// checkExtensions rejects a message the server can't carry: non-ASCII addresses without SMTPUTF8, or an
+// 8bit body without 8BITMIME when require8BitMIME is set
+func checkExtensions(c *smtp.Client, from string, to []string, require8BitMIME bool) error {
+	if needsSMTPUTF8(append([]string{from}, to...)...) {
+		if ok, _ := c.Extension("SMTPUTF8"); !ok {
+			return errSMTPUTF8Unsupported
+		}
+	}
+	if require8BitMIME {
+		if ok, _ := c.Extension("8BITMIME"); !ok {
+			return err8BitMIMEUnsupported
+		}
+	}
+	return nil
+}
+
+// checkAuth opens a session only to check the mail server accepts the credentials
+func checkAuth(ctx context.Context, addr string, auth smtp.Auth, opts sendOptions) (err error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	c, err := dial(ctx, addr, host, opts.ehloHostname)
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	defer c.Close()
+	defer func() { err = timeoutError(ctx, err) }()
+
+	var timings sendTimings
+	ok, _ := c.Extension("STARTTLS")
+	if opts.authBeforeStartTLS {
+		auth = cleartextAuth{auth}
+	} else if ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if err = authenticate(c, auth, &timings); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// dial connects to the mail server, reads its greeting and introduces itself as ehloHostname when set.
+// The connection is closed when ctx is done, which unblocks any command waiting on a hung server.
+func dial(ctx context.Context, addr, host, ehloHostname string) (*smtp.Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	conn = newSessionConn(ctx, conn)
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ehloHostname != "" {
+		if err := c.Hello(ehloHostname); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// sessionConn is the connection of a session, closed early when its context ends
+type sessionConn struct {
+	net.Conn
+	stop func() bool
+}
+
+// newSessionConn closes conn once ctx ends, unless the session closed it first
+func newSessionConn(ctx context.Context, conn net.Conn) *sessionConn {
+	return &sessionConn{Conn: conn, stop: context.AfterFunc(ctx, func() { conn.Close() })}
+}
+
+// Close closes the connection and unregisters it from the context, which may outlive the session
+func (c *sessionConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+// timeoutError replaces the error of a session cut short by its deadline with errSMTPTimeout
+func timeoutError(ctx context.Context, err error) error {
+	if err == nil || errors.Is(err, errSMTPTimeout) {
+		return err
+	}
+	// The recipients already delivered must stay visible, or the message would be retried as a whole
+	var partial *partialDeliveryError
+	if errors.As(err, &partial) {
+		partial.err = timeoutError(ctx, partial.err)
+		return err
+	}
+	var unconfirmed *unconfirmedDeliveryError
+	if errors.As(err, &unconfirmed) {
+		unconfirmed.err = timeoutError(ctx, unconfirmed.err)
+		return err
+	}
+	var netErr net.Error
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return fmt.Errorf("%w: %v", errSMTPTimeout, err)
+	}
+	return err
+}
+
+// authenticate runs the AUTH exchange and records how long it took
+func authenticate(c *smtp.Client, auth smtp.Auth, timings *sendTimings) error {
+	if ok, _ := c.Extension("AUTH"); !ok {
+		return errors.New("smtp: server doesn't support AUTH")
+	}
+	start := time.Now()
+	if err := c.Auth(auth); err != nil {
+		return err
+	}
+	timings.Auth = time.Since(start)
+	return nil
+}
+
+// cleartextAuth lets an authentication mechanism run before STARTTLS, smtp.PlainAuth refuses to
+// send credentials over an unencrypted connection to anything but localhost otherwise
+type cleartextAuth struct {
+	smtp.Auth
+}
+
+func (a cleartextAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	unencrypted := *server
+	unencrypted.TLS = true
+	return a.Auth.Start(&unencrypted)
+}
+
+// transaction sends msg to the recipients with MAIL, RCPT and DATA, returning the text of the final reply
+func transaction(c *smtp.Client, from string, to []string, msg []byte) (string, error) {
+	if err := c.Mail(from); err != nil {
+		return "", err
+	}
+	for _, recipient := range to {
+		if err := c.Rcpt(recipient); err != nil {
+			return "", err
+		}
+	}
+
+	// smtp.Client.Data discards the final reply, so DATA is sent through the underlying connection
+	id, err := c.Text.Cmd("DATA")
+	if err != nil {
+		return "", err
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(354)
+	c.Text.EndResponse(id)
+	if err != nil {
+		return "", err
+	}
+
+	w := c.Text.DotWriter()
+	if _, err = w.Write(msg); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	_, response, err := c.Text.ReadResponse(250)
+	var reply *textproto.Error
+	if err != nil && !errors.As(err, &reply) {
+		return "", &unconfirmedDeliveryError{err: err}
+	}
+	return response, err
+}
+
+// transactionRecipients returns the recipients of every transaction of a message. When grouping by domain
+// each domain is split on its own, recipients that all share one domain are split as usual.
+func transactionRecipients(to []string, opts sendOptions) [][]string {
+	if !opts.groupByDomain {
+		return batchRecipients(to, opts.maxRecipientsPerTransaction)
+	}
+	groups := groupByDomain(to)
+	if len(groups) < 2 {
+		return batchRecipients(to, opts.maxRecipientsPerTransaction)
+	}
+
+	var batches [][]string
+	for _, group := range groups {
+		batches = append(batches, batchRecipients(group.addresses, opts.maxRecipientsPerTransaction)...)
+	}
+	return batches
+}
+
+// batchRecipients splits the recipients into batches of at most size, a size of 0 keeps a single batch
+func batchRecipients(to []string, size int) [][]string {
+	if size <= 0 || len(to) <= size {
+		return [][]string{to}
+	}
+
+	var batches [][]string
+	for len(to) > size {
+		batches = append(batches, to[:size])
+		to = to[size:]
+	}
+	return append(batches, to)
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is a minimal SMTP server recording the sessions it serves
+type fakeSMTP struct {
+	listener   net.Listener
+	extensions []string
+
+	// dataResponse is the text of the 250 reply to the end of DATA
+	dataResponse string
+	// rcptReplies replaces the 250 reply to RCPT of an address, e.g "550 no such user"
+	rcptReplies map[string]string
+	// dropQuit closes the connection on QUIT without replying
+	dropQuit bool
+	// dataDelay holds back the reply to the end of DATA, like a slow server
+	dataDelay time.Duration
+	// dropAfter closes the connection once this many messages were accepted in total, 0 never does
+	dropAfter int
+
+	mutex      sync.Mutex
+	conns      int
+	ehlo       []string
+	messages   []string
+	recipients [][]string
+	commands   []string
+}
+
+// newFakeSMTP starts a fake server advertising the extensions, it is stopped when the test ends
+func newFakeSMTP(t *testing.T, extensions ...string) *fakeSMTP {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSMTP{
+		listener:     listener,
+		extensions:   extensions,
+		dataResponse: "2.0.0 Ok: queued as ABC",
+		rcptReplies:  make(map[string]string),
+	}
+	go f.serve()
+	t.Cleanup(func() { listener.Close() })
+	return f
+}
+
+func (f *fakeSMTP) addr() string {
+	return f.listener.Addr().String()
+}
+
+// delivered returns the messages accepted so far and their recipients
+func (f *fakeSMTP) delivered() ([]string, [][]string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.messages...), append([][]string{}, f.recipients...)
+}
+
+// connections returns the number of sessions opened so far
+func (f *fakeSMTP) connections() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.conns
+}
+
+func (f *fakeSMTP) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mutex.Lock()
+		f.conns++
+		f.mutex.Unlock()
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeSMTP) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 fake ESMTP")
+
+	var recipients []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+		f.mutex.Lock()
+		f.commands = append(f.commands, line)
+		if strings.HasPrefix(command, "EHLO ") {
+			f.ehlo = append(f.ehlo, line[len("EHLO "):])
+		}
+		rcptReply, rcptRefused := "", false
+		if strings.HasPrefix(command, "RCPT") {
+			rcptReply, rcptRefused = f.rcptReplies[between(line, "<", ">")]
+		}
+		f.mutex.Unlock()
+
+		switch {
+		case strings.HasPrefix(command, "EHLO"):
+			lines := append([]string{"fake"}, f.extensions...)
+			for i, l := range lines {
+				if i == len(lines)-1 {
+					reply("250 " + l)
+				} else {
+					reply("250-" + l)
+				}
+			}
+		case strings.HasPrefix(command, "AUTH"):
+			reply("235 2.7.0 Authentication successful")
+		case strings.HasPrefix(command, "MAIL"):
+			recipients = nil
+			reply("250 ok")
+		case strings.HasPrefix(command, "RCPT"):
+			if rcptRefused {
+				reply(rcptReply)
+				continue
+			}
+			recipients = append(recipients, between(line, "<", ">"))
+			reply("250 ok")
+		case command == "DATA":
+			reply("354 go ahead")
+			var message strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				message.WriteString(l)
+			}
+			f.mutex.Lock()
+			f.messages = append(f.messages, message.String())
+			f.recipients = append(f.recipients, recipients)
+			drop := f.dropAfter > 0 && len(f.messages) == f.dropAfter
+			f.mutex.Unlock()
+			time.Sleep(f.dataDelay)
+			reply("250 " + f.dataResponse)
+			if drop {
+				return
+			}
+		case command == "RSET":
+			recipients = nil
+			reply("250 ok")
+		case command == "NOOP":
+			reply("250 ok")
+		case command == "QUIT":
+			if !f.dropQuit {
+				reply("221 bye")
+			}
+			return
+		default:
+			reply("502 unknown command")
+		}
+	}
+}
+
+// between returns the part of s between the first open and the following close
+func between(s, open, close string) string {
+	_, rest, _ := strings.Cut(s, open)
+	inner, _, _ := strings.Cut(rest, close)
+	return inner
+}
+
+func TestSendMailIgnoresQuitFailureAfterDelivery(t *testing.T) {
+	tests := []struct {
+		name     string
+		dropQuit bool
+	}{
+		{"quit answered", false},
+		{"connection closed on quit", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t)
+			server.dropQuit = tt.dropQuit
+
+			result, err := sendMail(context.Background(), server.addr(), nil, "from@example.com",
+				[]string{"to@example.com"}, []byte("Subject: hi\r\n\r\nhi\r\n"), sendOptions{skipStartTLS: true})
+			if err != nil {
+				t.Fatalf("sendMail() error = %v, want nil once DATA was accepted", err)
+			}
+			if result.Response != server.dataResponse {
+				t.Errorf("Response = %q, want %q", result.Response, server.dataResponse)
+			}
+			if isTransientSendError(err) {
+				t.Error("a delivered message must not be retried")
+			}
+			if messages, _ := server.delivered(); len(messages) != 1 {
+				t.Errorf("server got %d messages, want 1", len(messages))
+			}
+		})
+	}
+}
+
+func TestSendBatchIgnoresQuitFailureAfterDelivery(t *testing.T) {
+	server := newFakeSMTP(t)
+	server.dropQuit = true
+
+	items := []*batchItem{
+		{from: "from@example.com", to: []string{"a@example.com"}, msg: []byte("Subject: a\r\n\r\na\r\n")},
+		{from: "from@example.com", to: []string{"b@example.com"}, msg: []byte("Subject: b\r\n\r\nb\r\n")},
+	}
+	if err := sendBatch(context.Background(), server.addr(), nil, items, sendOptions{skipStartTLS: true}); err != nil {
+		t.Fatalf("sendBatch() error = %v, want nil", err)
+	}
+	for i, item := range items {
+		if !item.done || item.err != nil {
+			t.Errorf("item %d: done = %v, err = %v, want done without error", i, item.done, item.err)
+		}
+	}
+}
+
+func TestTimeoutErrorKeepsPartialDelivery(t *testing.T) {
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now())
+	defer cancelExpired()
+
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		wantTimeout bool
+	}{
+		{"in time", context.Background(), false},
+		{"deadline exceeded", expired, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := timeoutError(tt.ctx, &partialDeliveryError{
+				results: []recipientStatus{{Recipient: "a@example.com", Status: "sent"}},
+				err:     errors.New("broken pipe"),
+			})
+			var partial *partialDeliveryError
+			if !errors.As(err, &partial) {
+				t.Fatalf("timeoutError() = %v, lost the partial delivery", err)
+			}
+			if errors.Is(err, errSMTPTimeout) != tt.wantTimeout {
+				t.Errorf("errors.Is(err, errSMTPTimeout) = %v, want %v", !tt.wantTimeout, tt.wantTimeout)
+			}
+			if isTransientSendError(err) {
+				t.Error("a partial delivery must not be retried")
+			}
+		})
+	}
+}
+
+func TestSessionConn(t *testing.T) {
+	tests := []struct {
+		name string
+		// cancel ends the context before the session closes the connection
+		cancel bool
+	}{
+		{"closed by the session", false},
+		{"context ended", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			client, server := net.Pipe()
+			defer server.Close()
+			conn := newSessionConn(ctx, client)
+
+			if tt.cancel {
+				cancel()
+			} else {
+				conn.Close()
+			}
+			server.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := server.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+				t.Errorf("Read() error = %v, want io.EOF from the closed connection", err)
+			}
+			if stopped := conn.stop(); stopped {
+				t.Error("the context still held the connection after it was closed")
+			}
+		})
+	}
+}
+
+func TestBatchRecipients(t *testing.T) {
+	tests := []struct {
+		name string
+		to   []string
+		size int
+		want string
+	}{
+		{"no limit", []string{"a", "b", "c"}, 0, "a,b,c"},
+		{"under the limit", []string{"a", "b"}, 3, "a,b"},
+		{"exact multiple", []string{"a", "b", "c", "d"}, 2, "a,b|c,d"},
+		{"remainder", []string{"a", "b", "c"}, 2, "a,b|c"},
+		{"one per transaction", []string{"a", "b", "c"}, 1, "a|b|c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := joinBatches(batchRecipients(tt.to, tt.size)); got != tt.want {
+				t.Errorf("batchRecipients() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// joinBatches renders the transactions as "a,b|c" for comparing in tests
+func joinBatches(batches [][]string) string {
+	parts := make([]string, len(batches))
+	for i, batch := range batches {
+		parts[i] = strings.Join(batch, ",")
+	}
+	return strings.Join(parts, "|")
+}
+
+func TestTransactionRecipients(t *testing.T) {
+	to := []string{"a@one.example", "b@two.example", "c@one.example", "d@one.example"}
+	tests := []struct {
+		name string
+		to   []string
+		opts sendOptions
+		want string
+	}{
+		{"not grouped", to, sendOptions{maxRecipientsPerTransaction: 3}, "a@one.example,b@two.example,c@one.example|d@one.example"},
+		{"grouped", to, sendOptions{groupByDomain: true}, "a@one.example,c@one.example,d@one.example|b@two.example"},
+		{"grouped and split", to, sendOptions{groupByDomain: true, maxRecipientsPerTransaction: 2}, "a@one.example,c@one.example|d@one.example|b@two.example"},
+		{"one domain", []string{"a@one.example", "b@one.example", "c@one.example"}, sendOptions{groupByDomain: true, maxRecipientsPerTransaction: 2}, "a@one.example,b@one.example|c@one.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := joinBatches(transactionRecipients(tt.to, tt.opts)); got != tt.want {
+				t.Errorf("transactionRecipients() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendMailSMTPUTF8(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions []string
+		from       string
+		to         string
+		wantErr    error
+	}{
+		{"ascii without the extension", nil, "from@example.com", "to@example.com", nil},
+		{"non-ascii domain without the extension", nil, "from@example.com", "to@bücher.example", nil},
+		{"non-ascii recipient without the extension", nil, "from@example.com", "zoë@example.com", errSMTPUTF8Unsupported},
+		{"non-ascii sender without the extension", nil, "zoë@example.com", "to@example.com", errSMTPUTF8Unsupported},
+		{"non-ascii recipient with the extension", []string{"SMTPUTF8"}, "from@example.com", "zoë@example.com", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t, tt.extensions...)
+			_, err := sendMail(context.Background(), server.addr(), nil, tt.from, []string{tt.to},
+				[]byte("Subject: hi\r\n\r\nhi\r\n"), sendOptions{skipStartTLS: true})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("sendMail() error = %v, want %v", err, tt.wantErr)
+			}
+			messages, _ := server.delivered()
+			if tt.wantErr != nil && len(messages) != 0 {
+				t.Errorf("server got %d messages, want the send refused before MAIL", len(messages))
+			}
+			if tt.wantErr == nil && len(messages) != 1 {
+				t.Errorf("server got %d messages, want 1", len(messages))
+			}
+		})
+	}
+}
+
+func TestSendTimingsJSON(t *testing.T) {
+	timings := sendTimings{Dial: 1500 * time.Microsecond, TLS: 0, Auth: 2 * time.Millisecond, Data: time.Second}
+	data, err := json.Marshal(timings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]float64
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"dial_ms": 1.5, "tls_ms": 0, "auth_ms": 2, "data_ms": 1000}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %v, want %v", key, got[key], value)
+		}
+	}
+}
+
+func TestSendMailTimings(t *testing.T) {
+	server := newFakeSMTP(t, "AUTH PLAIN")
+	server.dataDelay = 20 * time.Millisecond
+	auth := cleartextAuth{smtp.PlainAuth("", "user@example.com", "secret", "127.0.0.1")}
+	result, err := sendMail(context.Background(), server.addr(), auth, "from@example.com",
+		[]string{"to@example.com"}, []byte("Subject: hi\r\n\r\nhi\r\n"), sendOptions{skipStartTLS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Timings.Dial <= 0 || result.Timings.Auth <= 0 || result.Timings.Data < server.dataDelay || result.Timings.TLS != 0 {
+		t.Errorf("Timings = %+v, want the dial, auth and data phases measured and no TLS", result.Timings)
+	}
+}
+
+// A session failing after the connection was made must not close a nil client
+func TestSendSessionSetupFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(addr string) error
+	}{
+		{"send mail", func(addr string) error {
+			_, err := sendMail(context.Background(), addr, nil, "from@example.com", []string{"to@example.com"}, []byte("hi\r\n"), sendOptions{})
+			return err
+		}},
+		{"send batch", func(addr string) error {
+			items := []*batchItem{{from: "from@example.com", to: []string{"to@example.com"}, msg: []byte("hi\r\n")}}
+			return sendBatch(context.Background(), addr, nil, items, sendOptions{})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the fake refuses STARTTLS after advertising it
+			server := newFakeSMTP(t, "STARTTLS")
+			if err := tt.send(server.addr()); err == nil {
+				t.Fatal("send succeeded although STARTTLS failed")
+			}
+			if messages, _ := server.delivered(); len(messages) != 0 {
+				t.Errorf("delivered %d messages, want none", len(messages))
+			}
+		})
+	}
+}
+
+// The fake server can't complete a TLS handshake, the order of the commands shows which came first
+func TestOpenSessionAuthOrder(t *testing.T) {
+	tests := []struct {
+		name               string
+		authBeforeStartTLS bool
+		want               []string
+	}{
+		{"starttls first", false, []string{"EHLO", "STARTTLS"}},
+		{"auth first", true, []string{"EHLO", "AUTH", "STARTTLS"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t, "STARTTLS", "AUTH PLAIN")
+			auth := smtp.PlainAuth("", "user@example.com", "secret", "mail.example.com")
+			_, err := openSession(context.Background(), server.addr(), "mail.example.com", auth,
+				sendOptions{authBeforeStartTLS: tt.authBeforeStartTLS}, &sendTimings{})
+			if err == nil {
+				t.Fatal("openSession() succeeded without a TLS handshake")
+			}
+
+			server.mutex.Lock()
+			defer server.mutex.Unlock()
+			var got []string
+			for _, command := range server.commands {
+				verb, _, _ := strings.Cut(command, " ")
+				got = append(got, verb)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("commands = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleartextAuth(t *testing.T) {
+	auth := smtp.PlainAuth("", "user@example.com", "secret", "mail.example.com")
+	server := &smtp.ServerInfo{Name: "mail.example.com", TLS: false, Auth: []string{"PLAIN"}}
+	tests := []struct {
+		name    string
+		auth    smtp.Auth
+		wantErr bool
+	}{
+		{"plain auth refuses an unencrypted connection", auth, true},
+		{"cleartext auth allows it", cleartextAuth{auth}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := tt.auth.Start(server); (err != nil) != tt.wantErr {
+				t.Errorf("Start() error = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// A timeout before the message was sent may be retried, one while waiting for the reply to the final dot
+// may follow a delivery and is reported instead
+func TestSendMailTimeoutRetry(t *testing.T) {
+	// silent accepts connections but never greets
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	slow := newFakeSMTP(t)
+	slow.dataDelay = 500 * time.Millisecond
+
+	tests := []struct {
+		name            string
+		addr            string
+		wantTransient   bool
+		wantUnconfirmed bool
+	}{
+		{"no greeting", silent.Addr().String(), true, false},
+		{"no reply to the message", slow.addr(), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := sendMail(ctx, tt.addr, nil, "from@example.com", []string{"to@example.com"}, []byte("hi\r\n"), sendOptions{})
+			if !errors.Is(err, errSMTPTimeout) {
+				t.Fatalf("sendMail() error = %v, want errSMTPTimeout", err)
+			}
+			var unconfirmed *unconfirmedDeliveryError
+			if errors.As(err, &unconfirmed) != tt.wantUnconfirmed {
+				t.Errorf("sendMail() error = %v, want unconfirmed: %v", err, tt.wantUnconfirmed)
+			}
+			if isTransientSendError(err) != tt.wantTransient {
+				t.Errorf("isTransientSendError(%v) = %v, want %v", err, !tt.wantTransient, tt.wantTransient)
+			}
+		})
+	}
+}
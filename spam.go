@@ -0,0 +1,63 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// SpamFactor is one heuristic that contributed to a message's spam score
+type SpamFactor struct {
+	Name   string  `json:"name"`
+	Score  float64 `json:"score"`
+	Detail string  `json:"detail"`
+}
+
+// linkPattern matches links in plain text and HTML bodies
+var linkPattern = regexp.MustCompile(`(?i)https?://|\bhref\s*=`)
+
+// tagStripPattern matches HTML tags, to count only the visible words of a body
+var tagStripPattern = regexp.MustCompile(`<[^>]*>`)
+
+// scoreSpam rates how spammy a message looks using a few cheap heuristics, higher is worse
+func scoreSpam(subject, content string, html bool) (float64, []SpamFactor) {
+	var factors []SpamFactor
+
+	// Shouting subjects
+	letters, upper := 0, 0
+	for _, r := range subject {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	if letters >= 5 && upper == letters {
+		factors = append(factors, SpamFactor{"caps_subject", 2, "The subject is written in capital letters"})
+	}
+
+	// Excessive exclamation marks
+	if count := strings.Count(subject, "!"); count >= 2 {
+		factors = append(factors, SpamFactor{"exclamation_subject", 1.5, "The subject has several exclamation marks"})
+	}
+	if count := strings.Count(content, "!"); count >= 5 {
+		factors = append(factors, SpamFactor{"exclamation_body", 1, "The body has many exclamation marks"})
+	}
+
+	// Mostly links and little text
+	text := content
+	if html {
+		text = tagStripPattern.ReplaceAllString(content, " ")
+	}
+	words := len(strings.Fields(text))
+	if links := len(linkPattern.FindAllStringIndex(content, -1)); links > 0 && words < links*10 {
+		factors = append(factors, SpamFactor{"link_ratio", 2, "The body has few words for its number of links"})
+	}
+
+	score := 0.0
+	for _, factor := range factors {
+		score += factor.Score
+	}
+	return score, factors
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScoreSpam(t *testing.T) {
+	prose := strings.Repeat("word ", 30)
+	tests := []struct {
+		name        string
+		subject     string
+		content     string
+		html        bool
+		wantScore   float64
+		wantFactors []string
+	}{
+		{"ordinary", "Meeting notes", prose, false, 0, nil},
+		{"caps subject", "FREE MONEY", prose, false, 2, []string{"caps_subject"}},
+		{"short caps subject", "FYI", prose, false, 0, nil},
+		{"exclamation subject", "Act now!!", prose, false, 1.5, []string{"exclamation_subject"}},
+		{"exclamation body", "Hello", prose + "!!!!!", false, 1, []string{"exclamation_body"}},
+		{"links without text", "Hello", "https://a.example.com https://b.example.com", false, 2, []string{"link_ratio"}},
+		{"html links counted once", "Hello", `<a href="https://a.example.com">click</a>`, true, 2, []string{"link_ratio"}},
+		{"link in prose", "Hello", prose + "https://example.com", false, 0, nil},
+		{"every factor", "WIN BIG!!", "https://example.com !!!!!", false, 6.5, []string{"caps_subject", "exclamation_subject", "exclamation_body", "link_ratio"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			score, factors := scoreSpam(tt.subject, tt.content, tt.html)
+			var names []string
+			for _, factor := range factors {
+				names = append(names, factor.Name)
+			}
+			if score != tt.wantScore || strings.Join(names, ",") != strings.Join(tt.wantFactors, ",") {
+				t.Errorf("scoreSpam() = %v %v, want %v %v", score, names, tt.wantScore, tt.wantFactors)
+			}
+		})
+	}
+}
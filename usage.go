@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// UsageRecord describes the resources a single successful send used, for metering and billing
+type UsageRecord struct {
+	RequestID  string    `json:"request_id"`
+	Principal  string    `json:"principal"`
+	Recipients int       `json:"recipients"`
+	Bytes      int       `json:"bytes"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// UsageRecorder receives a usage record for every message handed to the mail server
+type UsageRecorder interface {
+	Record(record UsageRecord)
+}
+
+// nopUsageRecorder discards usage records, it is used when USAGE_RECORDER=none
+type nopUsageRecorder struct{}
+
+func (nopUsageRecorder) Record(UsageRecord) {}
+
+// MemoryUsageRecorder keeps the most recent usage records in memory
+type MemoryUsageRecorder struct {
+	mutex   sync.Mutex
+	records []UsageRecord
+	max     int
+}
+
+// NewMemoryUsageRecorder creates a recorder keeping at most max records, older ones are dropped first
+func NewMemoryUsageRecorder(max int) *MemoryUsageRecorder {
+	return &MemoryUsageRecorder{max: max}
+}
+
+// Record stores the record, dropping the oldest one when the recorder is full
+func (m *MemoryUsageRecorder) Record(record UsageRecord) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.max > 0 && len(m.records) >= m.max {
+		m.records = append(m.records[:0], m.records[1:]...)
+	}
+	m.records = append(m.records, record)
+}
+
+// Records returns a copy of the stored records, oldest first
+func (m *MemoryUsageRecorder) Records() []UsageRecord {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]UsageRecord{}, m.records...)
+}
+
+// newUsageRecorder creates the recorder selected by USAGE_RECORDER
+func newUsageRecorder(cfg *Config) UsageRecorder {
+	if cfg.UsageRecorder == "memory" {
+		return NewMemoryUsageRecorder(cfg.UsageRecordsMax)
+	}
+	return nopUsageRecorder{}
+}
+
+// GetUsageAdminHandler creates an HTTP handler listing the records of an in-memory usage recorder
+func GetUsageAdminHandler(recorder *MemoryUsageRecorder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"records": recorder.Records()})
+	}
+}
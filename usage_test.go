@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMemoryUsageRecorder(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int
+		records int
+		want    []string
+	}{
+		{"under the limit", 3, 2, []string{"0", "1"}},
+		{"oldest dropped", 2, 4, []string{"2", "3"}},
+		{"unlimited", 0, 3, []string{"0", "1", "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := NewMemoryUsageRecorder(tt.max)
+			for i := range tt.records {
+				recorder.Record(UsageRecord{RequestID: string(rune('0' + i))})
+			}
+			var got []string
+			for _, record := range recorder.Records() {
+				got = append(got, record.RequestID)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Records() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Records() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestUsageAdminHandler(t *testing.T) {
+	recorder := NewMemoryUsageRecorder(10)
+	recorder.Record(UsageRecord{RequestID: "abc", Principal: "user@example.com", Recipients: 2, Bytes: 100})
+
+	rec := httptest.NewRecorder()
+	GetUsageAdminHandler(recorder)(rec, httptest.NewRequest(http.MethodGet, "/admin/usage", nil))
+	var body struct {
+		Records []UsageRecord `json:"records"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || len(body.Records) != 1 || body.Records[0].Recipients != 2 {
+		t.Errorf("got %d %s, want the recorded send", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	GetUsageAdminHandler(recorder)(rec, httptest.NewRequest(http.MethodDelete, "/admin/usage", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE status = %d, want 405", rec.Code)
+	}
+}
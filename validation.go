@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+)
+
+// FieldError describes a single validation failure of a request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// allowedEncodings are the accepted values of the encoding field
+var allowedEncodings = map[string]bool{
+	"":                 true,
+	"7bit":             true,
+	"8bit":             true,
+	"base64":           true,
+	"quoted-printable": true,
+}
+
+// reservedHeaders are set by the API itself and can't be given as custom headers
+var reservedHeaders = map[string]bool{
+	"from":                      true,
+	"to":                        true,
+	"cc":                        true,
+	"bcc":                       true,
+	"reply-to":                  true,
+	"subject":                   true,
+	"content-type":              true,
+	"content-transfer-encoding": true,
+	"mime-version":              true,
+}
+
+// errHeaderInjection is returned for values that would break out of their header line
+var errHeaderInjection = errors.New("must not contain CR, LF or NUL characters")
+
+// sanitizeHeaderValue checks a value is safe to interpolate into a header line. CR and LF would end the
+// header and let a caller inject their own, e.g a Bcc, and NUL is rejected by most mail servers.
+func sanitizeHeaderValue(value string) error {
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return errHeaderInjection
+	}
+	return nil
+}
+
+// validateRequest returns every validation failure of the request, in field order
+func validateRequest(req *EmailRequest) []FieldError {
+	var errs []FieldError
+
+	if len(req.To) == 0 {
+		errs = append(errs, FieldError{"to", "required", "At least one recipient is required"})
+	}
+	errs = append(errs, validateRecipients("to", req.To)...)
+	errs = append(errs, validateRecipients("cc", req.Cc)...)
+	errs = append(errs, validateRecipients("bcc", req.Bcc)...)
+
+	// A whitespace only subject counts as missing
+	if strings.TrimSpace(req.Subject) == "" {
+		errs = append(errs, FieldError{"subject", "required", "The subject is required"})
+	} else if err := sanitizeHeaderValue(req.Subject); err != nil {
+		errs = append(errs, FieldError{"subject", "invalid_header_value", "The subject " + err.Error()})
+	}
+
+	if req.Content == "" {
+		errs = append(errs, FieldError{"content", "required", "The content is required"})
+	}
+
+	// The explicit body type fields have to agree with each other
+	contentType := strings.ToLower(req.ContentType)
+	if contentType != "" && contentType != "text/plain" && contentType != "text/html" {
+		errs = append(errs, FieldError{"content_type", "invalid", "The content type must be text/plain or text/html"})
+	} else if contentType != "" && req.HTML != nil && *req.HTML != (contentType == "text/html") {
+		errs = append(errs, FieldError{"content_type", "conflict", "The content type contradicts the html field"})
+	}
+	if req.TextContent != "" && ((req.HTML != nil && !*req.HTML) || contentType == "text/plain") {
+		errs = append(errs, FieldError{"text_content", "conflict", "A text version requires an HTML content"})
+	}
+
+	if err := sanitizeHeaderValue(req.Title); err != nil {
+		errs = append(errs, FieldError{"title", "invalid_header_value", "The title " + err.Error()})
+	}
+
+	if err := sanitizeHeaderValue(req.From); err != nil {
+		errs = append(errs, FieldError{"from", "invalid_header_value", "The from address " + err.Error()})
+	}
+
+	if err := sanitizeHeaderValue(req.ReplyTo); err != nil {
+		errs = append(errs, FieldError{"reply_to", "invalid_header_value", "The reply-to address " + err.Error()})
+	} else if _, err := mail.ParseAddress(req.ReplyTo); req.ReplyTo != "" && err != nil {
+		errs = append(errs, FieldError{"reply_to", "invalid", "The reply-to address is not a valid email address"})
+	}
+
+	if !allowedEncodings[strings.ToLower(req.Encoding)] {
+		errs = append(errs, FieldError{"encoding", "invalid",
+			"The encoding must be 7bit, 8bit, base64 or quoted-printable"})
+	}
+
+	errs = append(errs, validateHeaders(req.Headers)...)
+	errs = append(errs, validateAttachments(req.Attachments)...)
+
+	return errs
+}
+
+// validateHeaders checks the custom headers have valid names, safe values and don't replace a reserved header.
+// They are checked in sorted order so the error reported for several invalid headers is always the same.
+func validateHeaders(headers map[string]string) []FieldError {
+	seen := make(map[string]string, len(headers))
+	for _, name := range headerNames(headers) {
+		value := headers[name]
+		if other, ok := seen[strings.ToLower(name)]; ok {
+			return []FieldError{{"headers", "duplicate_header", "The " + other + " and " + name + " headers only differ by case"}}
+		}
+		seen[strings.ToLower(name)] = name
+		if !isHeaderName(name) {
+			return []FieldError{{"headers", "invalid_header_name", "Invalid header name " + strconv.Quote(name)}}
+		}
+		if reservedHeaders[strings.ToLower(name)] {
+			return []FieldError{{"headers", "reserved_header", "The " + name + " header can't be set"}}
+		}
+		if err := sanitizeHeaderValue(value); err != nil {
+			return []FieldError{{"headers", "invalid_header_value", "The " + name + " header " + err.Error()}}
+		}
+		id, isBracketed := strings.CutPrefix(value, "<")
+		if strings.EqualFold(name, "Message-ID") && (!isBracketed || !strings.HasSuffix(id, ">") || !strings.Contains(id, "@")) {
+			return []FieldError{{"headers", "invalid_header_value", "The Message-ID header must look like <id@domain>"}}
+		}
+	}
+	return nil
+}
+
+// isHeaderName reports whether name is a valid RFC 5322 field name: printable ASCII without a colon
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' || name[i] == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// isHostname reports whether name is a syntactically valid DNS hostname: dot separated labels of at most
+// 63 letters, digits and hyphens that don't start or end with a hyphen
+func isHostname(name string) bool {
+	if len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validateRecipients checks a list of addresses has no empty entries, header injection characters or
+// malformed addresses, reporting at most one failure of each kind
+func validateRecipients(field string, addresses []string) []FieldError {
+	var errs []FieldError
+	var empty, injection, invalid bool
+	for _, address := range addresses {
+		if strings.TrimSpace(address) == "" {
+			if !empty {
+				empty = true
+				errs = append(errs, FieldError{field, "empty_address", "Recipient addresses must not be empty"})
+			}
+			continue
+		}
+		if err := sanitizeHeaderValue(address); err != nil {
+			if !injection {
+				injection = true
+				errs = append(errs, FieldError{field, "invalid_header_value", "Recipient addresses " + err.Error()})
+			}
+			continue
+		}
+		if _, err := mail.ParseAddress(address); err != nil && !invalid {
+			invalid = true
+			errs = append(errs, FieldError{field, "invalid_address",
+				"Invalid recipient address " + strconv.Quote(address)})
+		}
+	}
+	return errs
+}
+
+// writeValidationErrors responds with the validation failures, only the first one unless all are requested
+func writeValidationErrors(w http.ResponseWriter, errs []FieldError, all bool) {
+	if !all {
+		errs = errs[:1]
+	}
+	writeErrorFields(w, "validation_failed", errs[0].Message, map[string]any{
+		"details": errs,
+	})
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// validEmailRequest returns a request that passes validation, for the tests to break one field of
+func validEmailRequest() *EmailRequest {
+	return &EmailRequest{To: []string{"to@example.com"}, Subject: "hi", Content: "hello"}
+}
+
+func TestValidateRequestHeaderInjection(t *testing.T) {
+	tests := []struct {
+		name      string
+		modify    func(*EmailRequest)
+		wantField string
+	}{
+		{"subject with LF", func(r *EmailRequest) { r.Subject = "hi\nBcc: victim@example.com" }, "subject"},
+		{"subject with CRLF", func(r *EmailRequest) { r.Subject = "hi\r\nBcc: victim@example.com" }, "subject"},
+		{"subject with NUL", func(r *EmailRequest) { r.Subject = "hi\x00" }, "subject"},
+		{"recipient with CRLF", func(r *EmailRequest) { r.To = []string{"to@example.com\r\nBcc: victim@example.com"} }, "to"},
+		{"cc with CR", func(r *EmailRequest) { r.Cc = []string{"cc@example.com\rBcc: victim@example.com"} }, "cc"},
+		{"title with LF", func(r *EmailRequest) { r.Title = "Sender\nBcc: victim@example.com" }, "title"},
+		{"from with CRLF", func(r *EmailRequest) { r.From = "from@example.com\r\nBcc: victim@example.com" }, "from"},
+		{"reply-to with LF", func(r *EmailRequest) { r.ReplyTo = "reply@example.com\nBcc: victim@example.com" }, "reply_to"},
+		{"custom header with CRLF", func(r *EmailRequest) {
+			r.Headers = map[string]string{"X-Campaign-Id": "1\r\nBcc: victim@example.com"}
+		}, "headers"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := validEmailRequest()
+			tt.modify(req)
+			errs := validateRequest(req)
+			if len(errs) != 1 || errs[0].Field != tt.wantField || errs[0].Code != "invalid_header_value" {
+				t.Errorf("validateRequest() = %+v, want one invalid_header_value error for %s", errs, tt.wantField)
+			}
+		})
+	}
+
+	if errs := validateRequest(validEmailRequest()); len(errs) != 0 {
+		t.Errorf("validateRequest() of a valid request = %+v, want none", errs)
+	}
+}
+
+func TestValidateRecipients(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		wantCodes []string
+	}{
+		{"valid", []string{"a@example.com", "Bee <b@example.com>"}, nil},
+		{"empty", []string{"a@example.com", " "}, []string{"empty_address"}},
+		{"invalid", []string{"not an address", "also@@invalid"}, []string{"invalid_address"}},
+		{"each kind once", []string{"", "x", "", "y"}, []string{"empty_address", "invalid_address"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var codes []string
+			for _, err := range validateRecipients("to", tt.addresses) {
+				codes = append(codes, err.Code)
+			}
+			if strings.Join(codes, ",") != strings.Join(tt.wantCodes, ",") {
+				t.Errorf("validateRecipients() codes = %v, want %v", codes, tt.wantCodes)
+			}
+		})
+	}
+}
+
+func TestValidateRequestMessageID(t *testing.T) {
+	tests := []struct {
+		messageID string
+		wantErr   bool
+	}{
+		{"<order-7@shop.example>", false},
+		{"order-7@shop.example", true},
+		{"<order-7>", true},
+		{"<order-7@shop.example", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.messageID, func(t *testing.T) {
+			req := validEmailRequest()
+			req.Headers = map[string]string{"Message-ID": tt.messageID}
+			if errs := validateRequest(req); (len(errs) != 0) != tt.wantErr {
+				t.Errorf("validateRequest() = %+v, want an error: %v", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateRequestSubject(t *testing.T) {
+	tests := []struct {
+		name     string
+		subject  string
+		wantCode string
+	}{
+		{"present", "hi", ""},
+		{"surrounded by spaces", "  hi  ", ""},
+		{"empty", "", "required"},
+		{"spaces", "   ", "required"},
+		{"tabs", "\t\t", "required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := validEmailRequest()
+			req.Subject = tt.subject
+			var code string
+			for _, err := range validateRequest(req) {
+				if err.Field == "subject" {
+					code = err.Code
+				}
+			}
+			if code != tt.wantCode {
+				t.Errorf("subject error = %q, want %q", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestMailHandlerReportAllValidationErrors(t *testing.T) {
+	const body = `{"to":[],"subject":" ","content":""}`
+	tests := []struct {
+		name       string
+		all        string
+		wantFields []string
+	}{
+		{"first only", "false", []string{"to"}},
+		{"all", "true", []string{"to", "subject", "content"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil, map[string]string{"REPORT_ALL_VALIDATION_ERRORS": tt.all})
+			handler := GetMailHandler(newTestRateLimiter(t, 10, nil), NewSlidingWindowLimiter(), &fakeMailer{}, cfg, nopUsageRecorder{}, Hooks{}, nil, nil)
+			rec := postEmail(t, handler, "secret", body, nil)
+
+			var response struct {
+				Code    string       `json:"code"`
+				Message string       `json:"message"`
+				Details []FieldError `json:"details"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != errorStatus("validation_failed") || response.Code != "validation_failed" {
+				t.Fatalf("got %d %s, want validation_failed", rec.Code, rec.Body)
+			}
+			var fields []string
+			for _, detail := range response.Details {
+				fields = append(fields, detail.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.wantFields, ",") {
+				t.Errorf("details fields = %v, want %v", fields, tt.wantFields)
+			}
+			if response.Message != response.Details[0].Message {
+				t.Errorf("message = %q, want the first error's", response.Message)
+			}
+		})
+	}
+}
+
+func TestValidateRequestBodyType(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name      string
+		modify    func(*EmailRequest)
+		wantField string
+		wantCode  string
+	}{
+		{"text version of html", func(r *EmailRequest) { r.Content, r.TextContent = "<p>hello</p>", "hello" }, "", ""},
+		{"text version with html", func(r *EmailRequest) { r.TextContent, r.HTML = "hello", &yes }, "", ""},
+		{"text version of text", func(r *EmailRequest) { r.TextContent, r.HTML = "hello", &no }, "text_content", "conflict"},
+		{"content type html", func(r *EmailRequest) { r.ContentType = "TEXT/HTML" }, "", ""},
+		{"content type agrees with html", func(r *EmailRequest) { r.ContentType, r.HTML = "text/plain", &no }, "", ""},
+		{"unknown content type", func(r *EmailRequest) { r.ContentType = "application/json" }, "content_type", "invalid"},
+		{"content type contradicts html", func(r *EmailRequest) { r.ContentType, r.HTML = "text/plain", &yes }, "content_type", "conflict"},
+		{"text version of text content type", func(r *EmailRequest) { r.TextContent, r.ContentType = "hello", "text/plain" }, "text_content", "conflict"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := validEmailRequest()
+			tt.modify(req)
+			errs := validateRequest(req)
+			if tt.wantCode == "" {
+				if len(errs) != 0 {
+					t.Errorf("validateRequest() = %+v, want none", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || errs[0].Field != tt.wantField || errs[0].Code != tt.wantCode {
+				t.Errorf("validateRequest() = %+v, want %s on %s", errs, tt.wantCode, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestValidateRequestReplyTo(t *testing.T) {
+	tests := []struct {
+		replyTo  string
+		wantCode string
+	}{
+		{"", ""},
+		{"replies@example.com", ""},
+		{"Support <replies@example.com>", ""},
+		{"not an address", "invalid"},
+		{"replies@example.com\nBcc: victim@example.com", "invalid_header_value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.replyTo, func(t *testing.T) {
+			req := validEmailRequest()
+			req.ReplyTo = tt.replyTo
+			var code string
+			for _, err := range validateRequest(req) {
+				if err.Field == "reply_to" {
+					code = err.Code
+				}
+			}
+			if code != tt.wantCode {
+				t.Errorf("reply_to error = %q, want %q", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestValidateHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		wantCode string
+	}{
+		{"custom", map[string]string{"X-Campaign-Id": "fall", "List-Unsubscribe": "<mailto:unsubscribe@example.com>"}, ""},
+		{"name with a colon", map[string]string{"X-Bad:Name": "1"}, "invalid_header_name"},
+		{"name with a space", map[string]string{"X Bad": "1"}, "invalid_header_name"},
+		{"empty name", map[string]string{"": "1"}, "invalid_header_name"},
+		{"reserved", map[string]string{"bcc": "victim@example.com"}, "reserved_header"},
+		{"reserved mime header", map[string]string{"Content-Type": "text/html"}, "reserved_header"},
+		{"names differing by case", map[string]string{"X-Campaign-Id": "1", "x-campaign-id": "2"}, "duplicate_header"},
+		{"first invalid in sorted order", map[string]string{"X-Ok": "1", "Bcc": "victim@example.com", "X Bad": "1", "A:Bad": "1"}, "invalid_header_name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var code string
+			if errs := validateHeaders(tt.headers); len(errs) > 0 {
+				code = errs[0].Code
+			}
+			if code != tt.wantCode {
+				t.Errorf("validateHeaders() code = %q, want %q", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestIsHostname(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"mail.example.com", true},
+		{"mail.example.com.", true},
+		{"localhost", true},
+		{"-mail.example.com", false},
+		{"mail-.example.com", false},
+		{"mail..example.com", false},
+		{"mail_1.example.com", false},
+		{"mail example.com", false},
+		{strings.Repeat("a", 64) + ".example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isHostname(tt.name); got != tt.want {
+				t.Errorf("isHostname(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+// The map order is random, the error for several invalid headers must not be
+func TestValidateHeadersDeterministic(t *testing.T) {
+	headers := map[string]string{"Z-Bad:Name": "1", "Bcc": "victim@example.com", "X-Value": "1\r\n", "M Bad": "1", "Cc": "x@example.com"}
+	want := validateHeaders(headers)
+	if len(want) != 1 || want[0].Message != "The Bcc header can't be set" {
+		t.Fatalf("validateHeaders() = %+v, want the sorted first header Bcc reported", want)
+	}
+	for range 50 {
+		if got := validateHeaders(headers); len(got) != 1 || got[0] != want[0] {
+			t.Fatalf("validateHeaders() = %+v, then %+v", want, got)
+		}
+	}
+}
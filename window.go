@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WindowLimit allows at most Max sends in any Window long period
+type WindowLimit struct {
+	Max    int    `json:"max"`
+	Window string `json:"window"` // e.g "1h"
+
+	window time.Duration
+}
+
+// init parses the window and checks the limit
+func (l *WindowLimit) init() error {
+	window, err := time.ParseDuration(l.Window)
+	if err != nil || window <= 0 {
+		return fmt.Errorf("invalid window_limit window %q", l.Window)
+	}
+	if l.Max <= 0 {
+		return fmt.Errorf("window_limit max must be positive")
+	}
+	l.window = window
+	return nil
+}
+
+// userWindow holds the sends of a user within the window, oldest first
+type userWindow struct {
+	events []time.Time
+	window time.Duration
+}
+
+// SlidingWindowLimiter counts the sends of every user over a sliding window, matching policies like
+// "no more than 100 per hour" exactly where the token bucket only smooths the rate
+type SlidingWindowLimiter struct {
+	mutex     sync.Mutex
+	users     map[string]*userWindow
+	lastSweep time.Time
+}
+
+// NewSlidingWindowLimiter creates an empty sliding window limiter
+func NewSlidingWindowLimiter() *SlidingWindowLimiter {
+	return &SlidingWindowLimiter{users: make(map[string]*userWindow)}
+}
+
+// Allow records a send of the user when fewer than limit.Max happened within the window. Otherwise it
+// reports how long until the oldest send leaves the window.
+func (l *SlidingWindowLimiter) Allow(user string, limit *WindowLimit) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	u, ok := l.users[user]
+	if !ok {
+		u = &userWindow{}
+		l.users[user] = u
+	}
+	u.window = limit.window
+
+	// Drop the sends that left the window
+	cutoff := now.Add(-limit.window)
+	i := 0
+	for i < len(u.events) && !u.events[i].After(cutoff) {
+		i++
+	}
+	u.events = u.events[i:]
+
+	if len(u.events) >= limit.Max {
+		return false, u.events[0].Add(limit.window).Sub(now)
+	}
+	u.events = append(u.events, now)
+	return true, 0
+}
+
+// Refund gives back the most recent send recorded by Allow, for a message that was refused or failed
+func (l *SlidingWindowLimiter) Refund(user string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if u, ok := l.users[user]; ok && len(u.events) > 0 {
+		u.events = u.events[:len(u.events)-1]
+	}
+}
+
+// sweep forgets users without sends in their window, at most once a minute.
+// The caller must hold the mutex.
+func (l *SlidingWindowLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for user, u := range l.users {
+		if len(u.events) == 0 || u.events[len(u.events)-1].Before(now.Add(-u.window)) {
+			delete(l.users, user)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowLimitInit(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   WindowLimit
+		wantErr bool
+	}{
+		{"valid", WindowLimit{Max: 100, Window: "1h"}, false},
+		{"invalid window", WindowLimit{Max: 100, Window: "hourly"}, true},
+		{"zero window", WindowLimit{Max: 100, Window: "0s"}, true},
+		{"zero max", WindowLimit{Max: 0, Window: "1h"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.limit.init(); (err != nil) != tt.wantErr {
+				t.Errorf("init() error = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSlidingWindowLimiter(t *testing.T) {
+	tests := []struct {
+		name   string
+		window string
+		// wait passes between the sends that fill the window and the next one
+		wait        time.Duration
+		wantAllowed bool
+	}{
+		{"window full", "1h", 0, false},
+		{"oldest send left the window", "50ms", 80 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit := &WindowLimit{Max: 3, Window: tt.window}
+			if err := limit.init(); err != nil {
+				t.Fatal(err)
+			}
+			limiter := NewSlidingWindowLimiter()
+			for i := range limit.Max {
+				if ok, _ := limiter.Allow("user", limit); !ok {
+					t.Fatalf("send %d refused inside the limit", i+1)
+				}
+			}
+			time.Sleep(tt.wait)
+
+			ok, retryAfter := limiter.Allow("user", limit)
+			if ok != tt.wantAllowed {
+				t.Fatalf("Allow() = %v, want %v", ok, tt.wantAllowed)
+			}
+			if !ok && (retryAfter <= 0 || retryAfter > limit.window) {
+				t.Errorf("retry after %v, want a wait within the %v window", retryAfter, limit.window)
+			}
+			if ok, _ := limiter.Allow("other", limit); !ok {
+				t.Error("another user was refused, the windows must be per user")
+			}
+		})
+	}
+}
+
+func TestSlidingWindowLimiterRefund(t *testing.T) {
+	limit := &WindowLimit{Max: 2, Window: "1h"}
+	if err := limit.init(); err != nil {
+		t.Fatal(err)
+	}
+	limiter := NewSlidingWindowLimiter()
+	limiter.Refund("unknown")
+
+	tests := []struct {
+		name   string
+		refund bool
+		want   bool
+	}{
+		{"first", false, true},
+		{"second", false, true},
+		{"full", false, false},
+		{"after a refund", true, true},
+		{"full again", false, false},
+	}
+	for _, tt := range tests {
+		if tt.refund {
+			limiter.Refund("user")
+		}
+		if ok, _ := limiter.Allow("user", limit); ok != tt.want {
+			t.Errorf("%s: Allow() = %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+}